@@ -0,0 +1,157 @@
+package ebp
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+)
+
+const (
+	BCH_TX_PROOF_GAS          uint64 = 10000
+	BCH_TX_PROOF_GAS_PER_BYTE uint64 = 6
+
+	// A 64-byte transaction has the same size as an inner node of the merkle tree and can be passed off as
+	// one (CVE-2017-12842), so the transactions smaller than BCH's consensus minimum are rejected
+	BCH_MIN_TX_SIZE = 100
+	// No block can have more than 2^32 transactions
+	BCH_MAX_MERKLE_DEPTH = 32
+)
+
+var (
+	ErrInvalidBchHeader      = errors.New("invalid BCH block header")
+	ErrInvalidBchTx          = errors.New("invalid BCH transaction")
+	ErrBchPowNotSatisfied    = errors.New("the block hash does not satisfy the target of the header")
+	ErrInvalidBchMerkleProof = errors.New("invalid merkle proof")
+)
+
+var (
+	bytesType, _      = abi.NewType("bytes", "", nil)
+	bytes32Type, _    = abi.NewType("bytes32", "", nil)
+	bytes32ArrType, _ = abi.NewType("bytes32[]", "", nil)
+	uint256Type, _    = abi.NewType("uint256", "", nil)
+	txOutArrType, _   = abi.NewType("tuple[]", "", []abi.ArgumentMarshaling{
+		{Name: "value", Type: "uint64"},
+		{Name: "pkScript", Type: "bytes"},
+	})
+
+	bchTxProofInputArgs = abi.Arguments{
+		{Name: "header", Type: bytesType},
+		{Name: "rawTx", Type: bytesType},
+		{Name: "txIndex", Type: uint256Type},
+		{Name: "merkleBranch", Type: bytes32ArrType},
+	}
+	bchTxProofOutputArgs = abi.Arguments{
+		{Name: "txid", Type: bytes32Type},
+		{Name: "blockHash", Type: bytes32Type},
+		{Name: "outputs", Type: txOutArrType},
+	}
+)
+
+// BchTxOutput is the Go counterpart of the tuple (uint64 value, bytes pkScript) in BchTxProofContract's output
+type BchTxOutput struct {
+	Value    uint64
+	PkScript []byte
+}
+
+// BchTxProofContract proves that a BCH transaction is included in a block whose header has valid
+// proof-of-work. Its input is abi.encode(bytes header, bytes rawTx, uint256 txIndex, bytes32[] merkleBranch)
+// and its output is abi.encode(bytes32 txid, bytes32 blockHash, (uint64 value, bytes pkScript)[] outputs).
+// The hashes are in internal byte order, i.e., reversed from how block explorers display them. Only the
+// header's own target is checked, so the caller must check the header's difficulty and its position in
+// the BCH chain by itself.
+type BchTxProofContract struct{}
+
+func (c *BchTxProofContract) RequiredGas(input []byte) uint64 {
+	return BCH_TX_PROOF_GAS + uint64(len(input))*BCH_TX_PROOF_GAS_PER_BYTE
+}
+
+func (c *BchTxProofContract) Run(input []byte) ([]byte, error) {
+	args, err := bchTxProofInputArgs.Unpack(input)
+	if err != nil {
+		return nil, err
+	}
+	headerBz := args[0].([]byte)
+	rawTx := args[1].([]byte)
+	txIndex := args[2].(*big.Int)
+	branch := args[3].([][32]byte)
+
+	var header wire.BlockHeader
+	if len(headerBz) != wire.MaxBlockHeaderPayload || header.Deserialize(bytes.NewReader(headerBz)) != nil {
+		return nil, ErrInvalidBchHeader
+	}
+	blockHash := header.BlockHash()
+	target := compactToBig(header.Bits)
+	if target.Sign() <= 0 || hashToBig(blockHash).Cmp(target) > 0 {
+		return nil, ErrBchPowNotSatisfied
+	}
+
+	if len(rawTx) < BCH_MIN_TX_SIZE {
+		return nil, ErrInvalidBchTx
+	}
+	var tx wire.MsgTx
+	reader := bytes.NewReader(rawTx)
+	if tx.DeserializeNoWitness(reader) != nil || reader.Len() != 0 {
+		return nil, ErrInvalidBchTx
+	}
+	txid := chainhash.DoubleHashH(rawTx)
+	if !verifyMerkleBranch(txid, txIndex, branch, header.MerkleRoot) {
+		return nil, ErrInvalidBchMerkleProof
+	}
+
+	outputs := make([]BchTxOutput, len(tx.TxOut))
+	for i, out := range tx.TxOut {
+		outputs[i] = BchTxOutput{Value: uint64(out.Value), PkScript: out.PkScript}
+	}
+	return bchTxProofOutputArgs.Pack([32]byte(txid), [32]byte(blockHash), outputs)
+}
+
+// compactToBig decodes the 'Bits' field of a header, which is the target in a floating point format
+func compactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+	var n *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		n = big.NewInt(int64(mantissa))
+	} else {
+		n = big.NewInt(int64(mantissa))
+		n.Lsh(n, 8*(exponent-3))
+	}
+	if isNegative {
+		n.Neg(n)
+	}
+	return n
+}
+
+// A hash is a little-endian number when compared with the target
+func hashToBig(hash chainhash.Hash) *big.Int {
+	for i := 0; i < chainhash.HashSize/2; i++ {
+		hash[i], hash[chainhash.HashSize-1-i] = hash[chainhash.HashSize-1-i], hash[i]
+	}
+	return new(big.Int).SetBytes(hash[:])
+}
+
+// The bits of index, from the lowest, tell whether the node at each level is a right child
+func verifyMerkleBranch(leaf chainhash.Hash, index *big.Int, branch [][32]byte, root chainhash.Hash) bool {
+	if len(branch) > BCH_MAX_MERKLE_DEPTH || index.Sign() < 0 || index.BitLen() > len(branch) {
+		return false
+	}
+	var buf [64]byte
+	curr := leaf
+	for i, sibling := range branch {
+		if index.Bit(i) == 1 {
+			copy(buf[:32], sibling[:])
+			copy(buf[32:], curr[:])
+		} else {
+			copy(buf[:32], curr[:])
+			copy(buf[32:], sibling[:])
+		}
+		curr = chainhash.DoubleHashH(buf[:])
+	}
+	return curr == root
+}
@@ -0,0 +1,139 @@
+package ebp
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBchTx(seed byte, values ...int64) []byte {
+	tx := wire.NewMsgTx(2)
+	// pads the script to make the tx no smaller than BCH_MIN_TX_SIZE
+	sigScript := append(bytes.Repeat([]byte{seed}, 40), 0x51)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{seed}, 0), sigScript, nil))
+	for i, v := range values {
+		tx.AddTxOut(wire.NewTxOut(v, []byte{0x76, 0xa9, byte(i)}))
+	}
+	var buf bytes.Buffer
+	if err := tx.SerializeNoWitness(&buf); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func hashPair(a, b chainhash.Hash) chainhash.Hash {
+	return chainhash.DoubleHashH(append(a[:], b[:]...))
+}
+
+// mineTestBchHeader finds a nonce satisfying bits, which must be an easy target
+func mineTestBchHeader(merkleRoot chainhash.Hash, bits uint32) []byte {
+	header := wire.NewBlockHeader(1, &chainhash.Hash{}, &merkleRoot, bits, 0)
+	for hashToBig(header.BlockHash()).Cmp(compactToBig(bits)) > 0 {
+		header.Nonce++
+	}
+	var buf bytes.Buffer
+	if err := header.Serialize(&buf); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBchTxProofContract(t *testing.T) {
+	txs := [][]byte{newTestBchTx(1, 5000), newTestBchTx(2, 100, 200), newTestBchTx(3, 300)}
+	var ids []chainhash.Hash
+	for _, tx := range txs {
+		ids = append(ids, chainhash.DoubleHashH(tx))
+	}
+	// with an odd number of nodes, the last one is paired with itself
+	h01 := hashPair(ids[0], ids[1])
+	h22 := hashPair(ids[2], ids[2])
+	root := hashPair(h01, h22)
+	branches := [][][32]byte{{ids[1], h22}, {ids[0], h22}, {ids[2], h01}}
+	header := mineTestBchHeader(root, 0x207fffff)
+	blockHash := chainhash.DoubleHashH(header)
+
+	c := &BchTxProofContract{}
+	for i, tx := range txs {
+		input, err := bchTxProofInputArgs.Pack(header, tx, big.NewInt(int64(i)), branches[i])
+		require.NoError(t, err)
+		require.Equal(t, BCH_TX_PROOF_GAS+uint64(len(input))*BCH_TX_PROOF_GAS_PER_BYTE, c.RequiredGas(input))
+		out, err := c.Run(input)
+		require.NoError(t, err)
+		res, err := bchTxProofOutputArgs.Unpack(out)
+		require.NoError(t, err)
+		require.Equal(t, [32]byte(ids[i]), res[0].([32]byte))
+		require.Equal(t, [32]byte(blockHash), res[1].([32]byte))
+		outputs := res[2].([]struct {
+			Value    uint64 `json:"value"`
+			PkScript []byte `json:"pkScript"`
+		})
+		var tx wire.MsgTx
+		require.NoError(t, tx.DeserializeNoWitness(bytes.NewReader(txs[i])))
+		require.Equal(t, len(tx.TxOut), len(outputs))
+		for j, o := range outputs {
+			require.Equal(t, uint64(tx.TxOut[j].Value), o.Value)
+			require.Equal(t, tx.TxOut[j].PkScript, o.PkScript)
+		}
+	}
+
+	run := func(header, tx []byte, index int64, branch [][32]byte) error {
+		input, err := bchTxProofInputArgs.Pack(header, tx, big.NewInt(index), branch)
+		require.NoError(t, err)
+		_, err = c.Run(input)
+		return err
+	}
+	require.Equal(t, ErrInvalidBchMerkleProof, run(header, txs[0], 1, branches[0]))
+	require.Equal(t, ErrInvalidBchMerkleProof, run(header, txs[0], 4, branches[0]))
+	require.Equal(t, ErrInvalidBchMerkleProof, run(header, txs[1], 1, branches[0]))
+	require.Equal(t, ErrInvalidBchTx, run(header, append(txs[0], 0), 0, branches[0]))
+	require.Equal(t, ErrInvalidBchTx, run(header, txs[0][:20], 0, branches[0]))
+	require.Equal(t, ErrInvalidBchHeader, run(header[:79], txs[0], 0, branches[0]))
+	hardHeader := append([]byte{}, header...)
+	copy(hardHeader[72:76], []byte{0xff, 0xff, 0x00, 0x1d}) // bits = 0x1d00ffff, BCH's pow limit
+	require.Equal(t, ErrBchPowNotSatisfied, run(hardHeader, txs[0], 0, branches[0]))
+	_, err := c.Run([]byte{1, 2, 3})
+	require.Error(t, err)
+}
+
+// A 64-byte tx can be passed off as an inner node of the merkle tree, whose children are its two halves
+func TestBchTxProofInnerNode(t *testing.T) {
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	tx.AddTxOut(wire.NewTxOut(5000, []byte{0x51, 0x51, 0x51, 0x51}))
+	var buf bytes.Buffer
+	require.NoError(t, tx.SerializeNoWitness(&buf))
+	rawTx := buf.Bytes()
+	require.Equal(t, 64, len(rawTx))
+
+	var left, right chainhash.Hash
+	copy(left[:], rawTx[:32])
+	copy(right[:], rawTx[32:])
+	sibling := chainhash.DoubleHashH([]byte{2})
+	root := hashPair(hashPair(left, right), sibling)
+	header := mineTestBchHeader(root, 0x207fffff)
+
+	c := &BchTxProofContract{}
+	run := func(rawTx []byte, index int64, branch [][32]byte) error {
+		input, err := bchTxProofInputArgs.Pack(header, rawTx, big.NewInt(index), branch)
+		require.NoError(t, err)
+		_, err = c.Run(input)
+		return err
+	}
+	// the tree is valid, but the tx must not be accepted as the node at level 1
+	require.True(t, verifyMerkleBranch(left, big.NewInt(0), [][32]byte{right, sibling}, root))
+	require.True(t, verifyMerkleBranch(chainhash.DoubleHashH(rawTx), big.NewInt(0), [][32]byte{sibling}, root))
+	require.Equal(t, ErrInvalidBchTx, run(rawTx, 0, [][32]byte{sibling}))
+
+	require.False(t, verifyMerkleBranch(left, big.NewInt(0), make([][32]byte, BCH_MAX_MERKLE_DEPTH+1), root))
+}
+
+func TestCompactToBig(t *testing.T) {
+	require.Equal(t, "ffff0000000000000000000000000000000000000000000000000000", compactToBig(0x1d00ffff).Text(16))
+	require.Equal(t, "12", compactToBig(0x01120000).Text(16))
+	require.Equal(t, "-1234560000", compactToBig(0x05923456).Text(16))
+	require.Equal(t, int64(0), compactToBig(0x00123456).Int64())
+}
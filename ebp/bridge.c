@@ -18,10 +18,14 @@ typedef int64_t (*zero_depth_call_func_t)(evmc_uint256be gas_price,
                      bridge_get_value_fn get_value_fn,
                      bridge_get_block_hash_fn get_block_hash_fn,
                      bridge_collect_result_fn collect_result_fn,
-                     bridge_call_precompiled_contract_fn call_precompiled_contract_fn);
+                     bridge_call_precompiled_contract_fn call_precompiled_contract_fn,
+                     bridge_revert_precompiled_contract_fn revert_precompiled_contract_fn);
 
 
+typedef bool (*is_precompiled_address_func_t)(const evmc_address* addr, const struct config* cfg);
+
 zero_depth_call_func_t zero_depth_call_func;
+is_precompiled_address_func_t is_precompiled_address_func;
 
 int64_t zero_depth_call_wrap(evmc_bytes32 gas_price,
                              int64_t gas_limit,
@@ -51,7 +55,12 @@ int64_t zero_depth_call_wrap(evmc_bytes32 gas_price,
                              get_value,
                              get_block_hash,
                              collect_result,
-                             call_precompiled_contract);
+                             call_precompiled_contract,
+                             revert_precompiled_contract);
+}
+
+bool is_precompiled_address_wrap(const evmc_address* addr, const struct config* cfg) {
+       return is_precompiled_address_func(addr, cfg);
 }
 
 enum dl_init_status init_dl() {
@@ -70,6 +79,12 @@ enum dl_init_status init_dl() {
         if (errorInfo != NULL) {
                 return SYMBOL_NOT_FOUND;
         }
+
+        is_precompiled_address_func = (is_precompiled_address_func_t)dlsym(lib_handle, "is_precompiled_address");
+        errorInfo = dlerror();
+        if (errorInfo != NULL) {
+                return SYMBOL_NOT_FOUND;
+        }
         
         return OK;
 }
@@ -10,6 +10,6 @@ func init() {
 	} else if res == C.FAIL_TO_OPEN {
 		panic("Cannot open the dynamic library specified by EVMWRAP")
 	} else if res == C.SYMBOL_NOT_FOUND {
-		panic("Cannot find zero_depth_call function in dynamic library")
+		panic("Cannot find zero_depth_call or is_precompiled_address function in dynamic library")
 	}
 }
@@ -0,0 +1,270 @@
+package ebp
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/log"
+
+	"github.com/smartbch/moeingevm/evmwrap/testcase"
+	"github.com/smartbch/moeingevm/types"
+)
+
+// Works like a uint256[] array at slot 0, operated with calldata (op, a, b):
+// op=1: push(a); op=2: pop(); op=3: arr[a] = b; op=4: truncate to length a, like 'arr.length = a' of solc 0.5
+const dynamicArrayAsm = `
+;; the length and the slot of the first element
+push 0
+sload
+push 0
+push 0
+mstore
+push 32
+push 0
+sha3
+push 0
+calldataload
+dup1
+push 1
+eq
+jumpi @doPush
+dup1
+push 2
+eq
+jumpi @doPop
+dup1
+push 3
+eq
+jumpi @doSet
+dup1
+push 4
+eq
+jumpi @doTruncate
+jump @fail
+
+doPush:
+pop
+push 32
+calldataload
+dup3
+dup3
+add
+sstore
+pop
+push 1
+add
+push 0
+sstore
+stop
+
+doPop:
+pop
+dup2
+iszero
+jumpi @fail
+push 0
+push 1
+dup4
+sub
+dup3
+add
+sstore
+pop
+push 1
+swap1
+sub
+push 0
+sstore
+stop
+
+doSet:
+pop
+dup2
+push 32
+calldataload
+lt
+iszero
+jumpi @fail
+push 64
+calldataload
+push 32
+calldataload
+dup3
+add
+sstore
+stop
+
+doTruncate:
+pop
+dup2
+push 32
+calldataload
+gt
+jumpi @fail
+push 32
+calldataload
+loop:
+dup3
+dup2
+lt
+iszero
+jumpi @done
+push 0
+dup3
+dup3
+add
+sstore
+push 1
+add
+jump @loop
+done:
+push 32
+calldataload
+push 0
+sstore
+stop
+
+fail:
+push 0
+dup1
+revert
+`
+
+// Applies the same random operations to the array in EVM and the array accessed by types.Context,
+// and compares their storage slots
+func TestDynamicArrayAgainstEVM(t *testing.T) {
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	prepareAccAndTx(e)
+	height := int64(0)
+	runTx := func(tx *gethtypes.Transaction) *types.Transaction {
+		tx, _ = tx.WithSignature(e.signer, from1.Bytes())
+		height++
+		committedTxs := runTxInBlock(e, func() *types.Context { return prepareCtx(trunk) }, height, tx)
+		require.Equal(t, 1, len(committedTxs))
+		return committedTxs[0]
+	}
+	runTx(gethtypes.NewContractCreation(0, big.NewInt(0), 1000000, big.NewInt(1), creationCode(compileAsm(dynamicArrayAsm))))
+	contract := gethcrypto.CreateAddress(from1, 0)
+	ctx := prepareCtx(trunk)
+	seq := ctx.GetAccount(contract).Sequence()
+	ctx.Close(false)
+	const mirrorSeq = 1 << 40
+	arrSlot := string(make([]byte, 32))
+	startSlot := uint256.NewInt(0).SetBytes(gethcrypto.Keccak256([]byte(arrSlot)))
+
+	r := rand.New(rand.NewSource(42))
+	randValue := func() *uint256.Int {
+		if r.Intn(4) == 0 {
+			return uint256.NewInt(0)
+		}
+		return uint256.NewInt(r.Uint64())
+	}
+	maxLength := uint64(0)
+	for i := 0; i < 200; i++ {
+		ctx = prepareCtx(trunk)
+		length, err := ctx.GetDynamicArrayLength(mirrorSeq, arrSlot)
+		require.Nil(t, err)
+		op := uint64(r.Intn(5) + 1)
+		if op == 5 { // push more often to grow the array
+			op = 1
+		}
+		a, b := randValue(), randValue()
+		if op == 3 || op == 4 {
+			a = uint256.NewInt(uint64(r.Intn(int(length) + 2)))
+		}
+		switch op {
+		case 1:
+			err = ctx.PushToDynamicArray(mirrorSeq, arrSlot, a.PaddedBytes(32))
+		case 2:
+			_, err = ctx.PopFromDynamicArray(mirrorSeq, arrSlot)
+		case 3:
+			err = ctx.SetDynamicArrayElement(mirrorSeq, arrSlot, a.Uint64(), b.PaddedBytes(32))
+		case 4:
+			err = ctx.TruncateDynamicArray(mirrorSeq, arrSlot, a.Uint64())
+		}
+		ctx.Close(true)
+
+		data := append(uint256.NewInt(op).PaddedBytes(32), a.PaddedBytes(32)...)
+		data = append(data, b.PaddedBytes(32)...)
+		tx := runTx(gethtypes.NewTransaction(uint64(i+1), contract, big.NewInt(0), 1000000, big.NewInt(1), data))
+		require.Equal(t, err == nil, tx.Status == gethtypes.ReceiptStatusSuccessful, "step %d op %d", i, op)
+
+		ctx = prepareCtx(trunk)
+		length, err = ctx.GetDynamicArrayLength(mirrorSeq, arrSlot)
+		require.Nil(t, err)
+		if length > maxLength {
+			maxLength = length
+		}
+		require.Equal(t, ctx.GetStorageAt(seq, arrSlot), ctx.GetStorageAt(mirrorSeq, arrSlot), "step %d op %d", i, op)
+		for j := uint64(0); j <= maxLength; j++ {
+			key := string(uint256.NewInt(0).AddUint64(startSlot, j).PaddedBytes(32))
+			require.Equal(t, ctx.GetStorageAt(seq, key), ctx.GetStorageAt(mirrorSeq, key), "step %d op %d index %d", i, op, j)
+		}
+		contents, err := ctx.GetDynamicArray(mirrorSeq, arrSlot)
+		require.Nil(t, err)
+		require.Equal(t, int(length), len(contents))
+		for j, val := range contents {
+			elem, err := ctx.GetDynamicArrayElement(mirrorSeq, arrSlot, uint64(j))
+			require.Nil(t, err)
+			require.Equal(t, elem, val)
+		}
+		ctx.Close(false)
+	}
+	require.Less(t, uint64(3), maxLength)
+
+	ctx = prepareCtx(trunk)
+	defer ctx.Close(false)
+	require.Nil(t, ctx.CreateDynamicArray(mirrorSeq, arrSlot, [][]byte{{1}, {2}}))
+	contents, err := ctx.GetDynamicArray(mirrorSeq, arrSlot)
+	require.Nil(t, err)
+	require.Equal(t, [][]byte{{1}, {2}}, contents)
+	for j := uint64(2); j <= maxLength; j++ {
+		key := string(uint256.NewInt(0).AddUint64(startSlot, j).PaddedBytes(32))
+		require.Nil(t, ctx.GetStorageAt(mirrorSeq, key))
+	}
+	var visited []uint64
+	err = ctx.IterateDynamicArray(mirrorSeq, arrSlot, func(index uint64, val []byte) bool {
+		visited = append(visited, index)
+		return true
+	})
+	require.Nil(t, err)
+	require.Equal(t, []uint64{0}, visited)
+	require.Nil(t, ctx.DeleteDynamicArray(mirrorSeq, arrSlot))
+	require.Nil(t, ctx.GetStorageAt(mirrorSeq, arrSlot))
+	_, err = ctx.PopFromDynamicArray(mirrorSeq, arrSlot)
+	require.Equal(t, types.ErrEmptyArray, err)
+
+	// the lengths which cannot be iterated are rejected
+	for _, length := range []*uint256.Int{
+		uint256.NewInt(types.MaxDynamicArrayLength + 1),
+		uint256.NewInt(0).Lsh(uint256.NewInt(1), 64),
+		uint256.NewInt(0).SetAllOne(),
+	} {
+		ctx.SetStorageAt(mirrorSeq, arrSlot, length.PaddedBytes(32))
+		_, err = ctx.GetDynamicArrayLength(mirrorSeq, arrSlot)
+		require.Equal(t, types.ErrArrayTooLong, err)
+		_, err = ctx.GetDynamicArrayElement(mirrorSeq, arrSlot, 0)
+		require.Equal(t, types.ErrArrayTooLong, err)
+		require.Equal(t, types.ErrArrayTooLong, ctx.SetDynamicArrayElement(mirrorSeq, arrSlot, 0, []byte{1}))
+		require.Equal(t, types.ErrArrayTooLong, ctx.PushToDynamicArray(mirrorSeq, arrSlot, []byte{1}))
+		_, err = ctx.PopFromDynamicArray(mirrorSeq, arrSlot)
+		require.Equal(t, types.ErrArrayTooLong, err)
+		_, err = ctx.GetDynamicArray(mirrorSeq, arrSlot)
+		require.Equal(t, types.ErrArrayTooLong, err)
+		require.Equal(t, types.ErrArrayTooLong, ctx.TruncateDynamicArray(mirrorSeq, arrSlot, 0))
+		require.Equal(t, types.ErrArrayTooLong, ctx.DeleteDynamicArray(mirrorSeq, arrSlot))
+		require.Equal(t, length.PaddedBytes(32), ctx.GetStorageAt(mirrorSeq, arrSlot))
+	}
+	ctx.SetStorageAt(mirrorSeq, arrSlot, uint256.NewInt(types.MaxDynamicArrayLength).PaddedBytes(32))
+	require.Equal(t, types.ErrArrayTooLong, ctx.PushToDynamicArray(mirrorSeq, arrSlot, []byte{1}))
+	_, err = ctx.GetDynamicArrayElement(mirrorSeq, arrSlot, types.MaxDynamicArrayLength-1)
+	require.Nil(t, err)
+}
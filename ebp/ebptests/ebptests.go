@@ -3,6 +3,7 @@ package ebptests
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
 	"math/big"
 	"os"
 	"os/exec"
@@ -56,6 +57,9 @@ var (
 
 var IgnoreFiles []string
 
+// BerlinForkBlock is passed to the Context which executes the test cases
+var BerlinForkBlock int64 = math.MaxInt64
+
 func runTestCase(filename string, theCase *tc.TestCase, printLog bool) {
 	ebp.AdjustGasUsed = false // to be compatible with EVM test vectors
 
@@ -101,6 +105,8 @@ func runTestCase(filename string, theCase *tc.TestCase, printLog bool) {
 	ctx := types.NewContext(nil, nil)
 	rbt = rabbit.NewRabbitStore(trunk)
 	ctx = ctx.WithRbt(&rbt)
+	ctx.SetCurrentHeight(currBlock.Number)
+	ctx.SetBerlinForkBlock(BerlinForkBlock)
 	txEngine.SetContext(ctx)
 	txEngine.CollectTx(currTx)
 	txEngine.Prepare(0, 0, ebp.DefaultTxGasLimit)
@@ -150,10 +156,6 @@ func InitIgnoreFiles() {
 	IgnoreFiles = append(IgnoreFiles, "stSpecialTest/push32withoutByte.txt")
 	IgnoreFiles = append(IgnoreFiles, "stSpecialTest/tx_e1c174e2.txt")
 	IgnoreFiles = append(IgnoreFiles, "stRevertTest/RevertPrecompiledTouch")
-	IgnoreFiles = append(IgnoreFiles, "stPreCompiledContracts/identity_to_bigger.txt")
-	IgnoreFiles = append(IgnoreFiles, "stPreCompiledContracts/identity_to_smaller.txt")
-	IgnoreFiles = append(IgnoreFiles, "stPreCompiledContracts/modexp_")
-	IgnoreFiles = append(IgnoreFiles, "stPreCompiledContracts2/modexp_")
 }
 
 func StandaloneMain() {
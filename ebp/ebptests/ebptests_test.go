@@ -1,6 +1,7 @@
 package ebptests
 
 import (
+	"math"
 	"os"
 	"testing"
 
@@ -73,3 +74,25 @@ func Test1(t *testing.T) {
 		tc.RunOneDir([]string{"run_test_dir", dir}, true, runTestCase)
 	}
 }
+
+// The cases call the modexp precompiled contract with the gas of the vectors in ebp/testdata, and
+// with one gas less, before and after the Berlin fork at height 10. The called contract stores the
+// call's success, RETURNDATASIZE and the keccak256 of the returned data at slot 0, 1 and 2.
+func TestModExpByBerlinFork(t *testing.T) {
+	BerlinForkBlock = 10
+	defer func() { BerlinForkBlock = math.MaxInt64 }()
+	tc.RunOneFile([]string{"run_test_file", "testdata/modexp_fork.txt"}, runTestCase)
+}
+
+// The modexp precompiled contract returns 4096 bytes, which are more than SMALL_BUF_SIZE
+func TestPrecompileBigOutput(t *testing.T) {
+	tc.RunOneFile([]string{"run_test_file", "testdata/modexp_big_output.txt"}, runTestCase)
+}
+
+// The identity precompiled contract is called with an output area bigger and smaller than its input.
+// The called contract stores the call's success, RETURNDATASIZE and the output area at slot 0, 1 and 2,
+// and identity_to_smaller also stores the whole returned data at slot 3.
+func TestIdentityOutputSize(t *testing.T) {
+	tc.RunOneFile([]string{"run_test_file", "testdata/identity_to_bigger.txt"}, runTestCase)
+	tc.RunOneFile([]string{"run_test_file", "testdata/identity_to_smaller.txt"}, runTestCase)
+}
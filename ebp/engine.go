@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"sync"
 	"sync/atomic"
 
@@ -25,6 +26,7 @@ const DefaultTxGasLimit uint64 = 1000_0000
 
 var Sep206Address = common.HexToAddress("0x0000000000000000000000000000000000002711")
 var _ TxExecutor = (*txEngine)(nil)
+var _ FeeDistributorSetter = (*txEngine)(nil)
 
 type TxRange struct {
 	start uint64
@@ -52,6 +54,11 @@ type txEngine struct {
 	cumulativeFeeRefund *uint256.Int
 	cumulativeGasFee    *uint256.Int
 
+	// Invoked at the end of Execute to distribute the collected gas fees
+	feeDistributor FeeDistributor
+	// Scans the world state to backfill the index from sequences to contracts at SeqIndexForkBlock
+	stateScanner types.StoreScanner
+
 	logger log.Logger
 }
 
@@ -61,9 +68,9 @@ func (exec *txEngine) Context() *types.Context {
 
 // Generated by parallelReadAccounts and insertToStandbyTxQ will store its tx into world state.
 type preparedInfo struct {
-	tx       *types.TxToRun
-	txBytes  []byte
-	errorStr string
+	tx      *types.TxToRun
+	txBytes []byte
+	status  types.Status //the reason why this tx is rejected, StatusSuccess means not rejected
 }
 
 // Generated by parallelReadAccounts and Prepare will use them for some validations.
@@ -74,6 +81,7 @@ type ctxAndAccounts struct {
 	totalGasFee  *uint256.Int                    //the gas fees payed by the accounts
 	addr2nonce   map[common.Address]uint64       //caches the latest nonce of accounts and won't write back to states
 	addr2Balance map[common.Address]*uint256.Int //caches latest balance
+	addr2Gas     map[common.Address]uint64       //total gas limit of the accounts' txs in standby queue
 }
 
 type frontier struct {
@@ -92,6 +100,7 @@ func NewFrontierWithCtxAA(ctxAA []*ctxAndAccounts, addr2idx map[common.Address]i
 		if nonce, ok := ctxAA[idx].addr2nonce[addr]; ok {
 			nm.addr2nonce[addr] = nonce
 			nm.addr2Balance[addr] = ctxAA[idx].addr2Balance[addr]
+			nm.addr2Gas[addr] = ctxAA[idx].addr2Gas[addr]
 			//there must both have nonce and balance same time
 			if nm.addr2Balance[addr] == nil {
 				nm.addr2Balance[addr] = uint256.NewInt(0)
@@ -157,18 +166,34 @@ func GetEmptyFrontier() Frontier {
 func NewEbpTxExec(exeRoundCount, runnerNumber, parallelNum, defaultTxListCap int, s gethtypes.Signer, logger log.Logger) *txEngine {
 	Runners = make([]*TxRunner, runnerNumber)
 	return &txEngine{
-		roundNum:     exeRoundCount,
-		runnerNumber: runnerNumber,
-		parallelNum:  parallelNum,
-		txList:       make([]*gethtypes.Transaction, 0, defaultTxListCap),
-		committedTxs: make([]*types.Transaction, 0, defaultTxListCap),
-		signer:       s,
-		logger:       logger,
+		roundNum:       exeRoundCount,
+		runnerNumber:   runnerNumber,
+		parallelNum:    parallelNum,
+		txList:         make([]*gethtypes.Transaction, 0, defaultTxListCap),
+		committedTxs:   make([]*types.Transaction, 0, defaultTxListCap),
+		signer:         s,
+		feeDistributor: NopFeeDistributor{},
+		logger:         logger,
 	}
 }
 
-// A new context must be set before Execute
+func (exec *txEngine) SetFeeDistributor(d FeeDistributor) {
+	exec.feeDistributor = d
+}
+
+// SetStateScanner sets the scanner of the world state, for example, the MoeingADS under the trunk store.
+// It must be set before the first SetContext if the context has a SeqIndexForkBlock which is not passed yet.
+func (exec *txEngine) SetStateScanner(scanner types.StoreScanner) {
+	exec.stateScanner = scanner
+}
+
+// A new context must be set before Execute. It panics if the sequence index will have to be backfilled
+// at ctx.SeqIndexForkBlock without a state scanner, such that a misconfigured node stops when it starts,
+// instead of at the fork block.
 func (exec *txEngine) SetContext(ctx *types.Context) {
+	if exec.stateScanner == nil && ctx.SeqIndexForkBlock != math.MaxInt64 && ctx.Height <= ctx.SeqIndexForkBlock {
+		panic("A state scanner is needed to backfill the sequence index at SeqIndexForkBlock")
+	}
 	exec.cleanCtx = ctx
 }
 
@@ -212,20 +237,25 @@ func (exec *txEngine) Prepare(reorderSeed int64, minGasPrice, maxTxGasLimit uint
 				continue
 			}
 			for _, info := range addr2Infos[addr] {
-				if len(info.errorStr) != 0 {
+				if info.status != types.StatusSuccess {
 					continue //skip it if already found error
 				}
 				sender := info.tx.From
-				if entry.addr2nonce[sender] != info.tx.Nonce {
+				if nonce := entry.addr2nonce[sender]; nonce != info.tx.Nonce {
 					//skip it if nonce is wrong
 					exec.logger.Debug("prepare::incorrect nonce", "txHash", info.tx.HashID.String())
-					info.errorStr = "incorrect nonce"
+					if info.tx.Nonce < nonce {
+						info.status = types.StatusTxNonceTooSmall
+					} else {
+						info.status = types.StatusTxNonceTooLarge
+					}
 					continue
 				}
 				entry.addr2nonce[sender]++
 				if exec.deductGasFeeAndUpdateFrontier(sender, info, entry) != nil {
 					continue
 				}
+				entry.addr2Gas[sender] += info.tx.Gas
 				entry.changed = true //now this context needs writeback
 				info.txBytes = info.tx.ToBytes()
 			}
@@ -258,34 +288,86 @@ func (exec *txEngine) deductGasFeeAndUpdateFrontier(sender common.Address, info
 	if err != nil {
 		exec.logger.Debug("prepare::deduct gas fee failed", "txHash", info.tx.HashID.String())
 		entry.addr2Balance[sender] = uint256.NewInt(0)
-		info.errorStr = "not enough balance to pay gasfee"
+		info.status = types.StatusNotEnoughGasFee
 		return err
 	} else {
-		if info.tx.To == Sep206Address {
-			entry.addr2Balance[sender] = uint256.NewInt(0)
+		// the BCH transferred by SEP206 is deducted just like the transaction's value
+		value := totalSpending(sender, info.tx.To, info.tx.Value, info.tx.Data)
+		if balance, exist := entry.addr2Balance[sender]; !exist {
+			entry.addr2Balance[sender] = GetBalanceAfterBchTransfer(entry.ctx, sender, value)
 		} else {
-			if balance, exist := entry.addr2Balance[sender]; !exist {
-				entry.addr2Balance[sender] = GetBalanceAfterBchTransfer(entry.ctx, sender, info.tx.Value)
-			} else {
-				if balance.Cmp(gasFee) < 0 {
-					entry.addr2Balance[sender] = uint256.NewInt(0)
-				} else {
-					balance.Sub(balance, gasFee)
-					txValue, _ := uint256.FromBig(utils.BigIntFromSlice32(info.tx.Value[:]))
-					if balance.Cmp(txValue) < 0 {
-						entry.addr2Balance[sender] = uint256.NewInt(0)
-					} else {
-						balance.Sub(balance, txValue)
-						entry.addr2Balance[sender] = balance
-					}
-				}
-			}
+			entry.addr2Balance[sender] = subGasFeeAndValue(balance, gasFee, value)
 		}
 		entry.totalGasFee.Add(entry.totalGasFee, gasFee)
 	}
 	return nil
 }
 
+// Deduct gasFee and the transferred value from balance, the result is clamped to zero
+func subGasFeeAndValue(balance, gasFee *uint256.Int, value [32]byte) *uint256.Int {
+	if balance.Cmp(gasFee) < 0 {
+		return uint256.NewInt(0)
+	}
+	balance.Sub(balance, gasFee)
+	txValue, _ := uint256.FromBig(utils.BigIntFromSlice32(value[:]))
+	if balance.Cmp(txValue) < 0 {
+		return uint256.NewInt(0)
+	}
+	return balance.Sub(balance, txValue)
+}
+
+// CheckTx validates a transaction against the frontier returned by Prepare, using the same rules
+// as parallelReadAccounts and deductGasFeeAndUpdateFrontier. The accounts which are not in the
+// frontier yet are read from ctx. On success, the sender's nonce, balance and total gas in the
+// frontier are updated, such that the following transactions from the same sender can be checked.
+func CheckTx(ctx *types.Context, signer gethtypes.Signer, tx *gethtypes.Transaction, f Frontier,
+	minGasPrice, maxTxGasLimit uint64) (sender common.Address, err error) {
+	sender, err = signer.Sender(tx)
+	if err != nil {
+		return sender, types.ErrInvalidSignature
+	}
+	if !tx.GasPrice().IsInt64() || tx.GasPrice().Int64() < int64(minGasPrice) {
+		return sender, types.ErrBadGasPrice
+	}
+	if tx.Gas() > maxTxGasLimit {
+		return sender, types.ErrBadGasLimit
+	}
+	nonce, exist := f.GetLatestNonce(sender)
+	balance, _ := f.GetLatestBalance(sender)
+	if !exist {
+		acc := ctx.GetAccount(sender)
+		if acc == nil {
+			return sender, types.ErrAccountNotExist
+		}
+		nonce = acc.Nonce()
+		balance = acc.Balance()
+	}
+	if balance == nil {
+		balance = uint256.NewInt(0)
+	}
+	if tx.Nonce() < nonce {
+		return sender, types.ErrNonceTooSmall
+	} else if tx.Nonce() > nonce {
+		return sender, types.ErrNonceTooLarge
+	}
+	gasFee := uint256.NewInt(0).SetUint64(tx.Gas())
+	gasFee.Mul(gasFee, uint256.NewInt(0).SetUint64(tx.GasPrice().Uint64()))
+	if balance.Cmp(gasFee) < 0 {
+		return sender, types.ErrNotEnoughGasFee
+	}
+	var value [32]byte
+	copy(value[:], utils.BigIntToSlice32(tx.Value()))
+	if to := tx.To(); to != nil {
+		value = totalSpending(sender, *to, value, tx.Data())
+	}
+	balance = subGasFeeAndValue(balance.Clone(), gasFee, value)
+	f.SetLatestNonce(sender, nonce+1)
+	f.SetLatestBalance(sender, balance)
+	totalGas, _ := f.GetLatestTotalGas(sender)
+	f.SetLatestTotalGas(sender, totalGas+tx.Gas())
+	return sender, nil
+}
+
 func (exec *txEngine) getCurrHeight() uint64 {
 	if exec.currentBlock != nil {
 		return uint64(exec.currentBlock.Number)
@@ -309,6 +391,7 @@ func (exec *txEngine) parallelReadAccounts(minGasPrice, maxTxGasLimit uint64) (i
 			totalGasFee:  uint256.NewInt(0),
 			addr2nonce:   make(map[common.Address]uint64, estimatedSize),
 			addr2Balance: make(map[common.Address]*uint256.Int, estimatedSize),
+			addr2Gas:     make(map[common.Address]uint64, estimatedSize),
 		}
 		for {
 			myIdx := atomic.AddInt64(&sharedIdx, 1)
@@ -324,21 +407,21 @@ func (exec *txEngine) parallelReadAccounts(minGasPrice, maxTxGasLimit uint64) (i
 			txToRun.FromGethTx(tx, sender, exec.getCurrHeight())
 			infoList[myIdx].tx = txToRun
 			if err != nil {
-				infoList[myIdx].errorStr = "invalid signature"
+				infoList[myIdx].status = types.StatusInvalidSignature
 				continue
 			}
 			if !tx.GasPrice().IsInt64() || tx.GasPrice().Int64() < int64(minGasPrice) {
-				infoList[myIdx].errorStr = "invalid gas price"
+				infoList[myIdx].status = types.StatusInvalidGasPrice
 				continue
 			}
 			if tx.Gas() > maxTxGasLimit {
-				infoList[myIdx].errorStr = "invalid gas limit"
+				infoList[myIdx].status = types.StatusInvalidGasLimit
 				continue
 			}
 			// access disk to fetch the account's detail
 			acc := ctxAA[workerId].ctx.GetAccount(sender)
 			if acc == nil {
-				infoList[myIdx].errorStr = "non-existent account"
+				infoList[myIdx].status = types.StatusAccountNotExist
 				continue
 			}
 			if _, ok := ctxAA[workerId].addr2nonce[sender]; !ok {
@@ -383,7 +466,7 @@ func (exec *txEngine) insertToStandbyTxQ(trunk storetypes.BaseStoreI, infoList [
 			// six kinds of errors: invalid signature; incorrect nonce;
 			// no such account; balance not enough; gas limit too high; gas price too low;
 			// if the proposor is honest, there should be no these kinds of errors.
-			if len(info.errorStr) != 0 {
+			if info.status != types.StatusSuccess {
 				exec.recordInvalidTx(info)
 				continue
 			}
@@ -411,7 +494,7 @@ func (exec *txEngine) recordInvalidTx(info *preparedInfo) {
 		CumulativeGasUsed: exec.cumulativeGasUsed,
 		GasUsed:           0,
 		Status:            gethtypes.ReceiptStatusFailed,
-		StatusStr:         info.errorStr,
+		StatusStr:         info.status.PrepareStatusStr(),
 	}
 	if exec.currentBlock != nil {
 		tx.BlockHash = exec.currentBlock.Hash
@@ -437,8 +520,10 @@ func (exec *txEngine) Execute(currBlock *types.BlockInfo) {
 	exec.cumulativeFeeRefund = uint256.NewInt(0)
 	exec.cumulativeGasFee = uint256.NewInt(0)
 	exec.currentBlock = currBlock
+	exec.beginBlock()
 	startKey, endKey := exec.getStandbyQueueRange()
 	if startKey == endKey {
+		exec.endBlock()
 		return
 	}
 	txRange := &TxRange{
@@ -446,6 +531,8 @@ func (exec *txEngine) Execute(currBlock *types.BlockInfo) {
 		end:   endKey,
 	}
 	committableRunnerList := make([]*TxRunner, 0, 4096)
+	committedGasUsed := uint64(0)
+	gasLimit := exec.blockGasLimit()
 	// Repeat exec.roundNum round for execute txs in standby q. At the end of each round
 	// modifications made by TXs are written to world state. So TXs in later rounds can
 	// see the modifications made by TXs in earlier rounds.
@@ -453,17 +540,100 @@ func (exec *txEngine) Execute(currBlock *types.BlockInfo) {
 		if txRange.start == txRange.end {
 			break
 		}
-		numTx := exec.executeOneRound(txRange, exec.currentBlock)
+		// The committable TXs are added to exec.cumulativeGasUsed after this loop, so now it only contains
+		// the gas charged to the invalid TXs of earlier rounds
+		gasUsed := exec.cumulativeGasUsed + committedGasUsed
+		if gasUsed >= gasLimit {
+			break // the left TXs stay in standby queue for the next block
+		}
+		numTx := exec.executeOneRound(txRange, exec.currentBlock, gasLimit-gasUsed)
+		if numTx == 0 {
+			break // the gas left is not enough for the next TX in standby queue
+		}
 		for i := 0; i < numTx; i++ {
 			if Runners[i] == nil {
 				continue // the TX is not committable and needs re-execution
 			}
+			committedGasUsed += Runners[i].GasUsed
 			committableRunnerList = append(committableRunnerList, Runners[i])
 			Runners[i] = nil
 		}
 	}
 	exec.setStandbyQueueRange(txRange.start, txRange.end)
 	exec.collectCommittableTxs(committableRunnerList)
+	exec.endBlock()
+}
+
+// Run the migrations scheduled at current height and then the BeginBlock hooks of predefined contracts.
+// The current height is the Height of the context, which also decides the forks.
+func (exec *txEngine) beginBlock() {
+	height := exec.cleanCtx.Height
+	if height == exec.cleanCtx.SeqIndexForkBlock {
+		exec.backfillSequenceIndex()
+	}
+	for _, m := range PredefinedContractMigrations[height] {
+		migrator, ok := PredefinedContractManager[m.Address].(types.Migrator)
+		if !ok { // the contract is removed or replaced after the migration is scheduled
+			exec.logger.Error("skipped the migration of a contract which does not support it",
+				"contract", m.Address.String(), "height", height)
+			continue
+		}
+		exec.runHook("migrate", m.Address, func(ctx *types.Context) error {
+			return migrator.Migrate(ctx, m.FromVersion)
+		})
+	}
+	for _, addr := range sortedPredefinedContracts() {
+		if blocker, ok := PredefinedContractManager[addr].(types.BeginBlocker); ok {
+			exec.runHook("begin block", addr, func(ctx *types.Context) error {
+				return blocker.BeginBlock(ctx, exec.currentBlock)
+			})
+		}
+	}
+}
+
+// Index the contracts created before SeqIndexForkBlock, once at the beginning of the fork block
+func (exec *txEngine) backfillSequenceIndex() {
+	if exec.stateScanner == nil {
+		panic("A state scanner is needed to backfill the sequence index")
+	}
+	ctx := exec.cleanCtx.WithRbtCopy()
+	count := ctx.BackfillSequenceIndex(exec.stateScanner)
+	ctx.Close(true)
+	exec.logger.Info("backfilled the sequence index", "contracts", count)
+}
+
+// Distribute the gas fees and then run the EndBlock hooks of predefined contracts
+func (exec *txEngine) endBlock() {
+	exec.distributeFee()
+	for _, addr := range sortedPredefinedContracts() {
+		if blocker, ok := PredefinedContractManager[addr].(types.EndBlocker); ok {
+			exec.runHook("end block", addr, func(ctx *types.Context) error {
+				return blocker.EndBlock(ctx, exec.currentBlock)
+			})
+		}
+	}
+}
+
+// Run a hook of the predefined contract at 'addr'. If it fails, the changes made by it are discarded.
+func (exec *txEngine) runHook(name string, addr common.Address, hook func(ctx *types.Context) error) {
+	ctx := exec.cleanCtx.WithRbtCopy()
+	err := hook(ctx)
+	if err != nil {
+		exec.logger.Error("failed to "+name, "contract", addr.String(), "error", err.Error())
+	}
+	ctx.Close(err == nil)
+}
+
+// Call exec.feeDistributor with the gas used and fees of current block. If it fails, the changes
+// made by it are discarded, and the fees stay in the system account.
+func (exec *txEngine) distributeFee() {
+	gasUsed, feeRefund, gasFee := exec.GasUsedInfo()
+	ctx := exec.cleanCtx.WithRbtCopy()
+	err := exec.feeDistributor.DistributeFee(ctx, exec.currentBlock, gasUsed, &feeRefund, &gasFee, exec.committedTxs)
+	if err != nil {
+		exec.logger.Error("failed to distribute fee", "error", err.Error())
+	}
+	ctx.Close(err == nil)
 }
 
 // Get the start and end position of standby queue
@@ -488,26 +658,48 @@ func (exec *txEngine) setStandbyQueueRange(start, end uint64) {
 	})
 }
 
+// The gas limit of the current block, zero or negative GasLimit means no limit. Before BlockGasLimitForkBlock,
+// the gas limit of the block is ignored.
+func (exec *txEngine) blockGasLimit() uint64 {
+	if !exec.cleanCtx.IsBlockGasLimitFork() || exec.currentBlock == nil || exec.currentBlock.GasLimit <= 0 {
+		return math.MaxUint64
+	}
+	return uint64(exec.currentBlock.GasLimit)
+}
+
 // Execute 'runnerNumber' transactions in parallel and commit the ones without any interdependency
-func (exec *txEngine) executeOneRound(txRange *TxRange, currBlock *types.BlockInfo) int {
-	txBundle := exec.loadStandbyTxs(txRange)
+func (exec *txEngine) executeOneRound(txRange *TxRange, currBlock *types.BlockInfo, gasLeft uint64) int {
+	txBundle := exec.loadStandbyTxs(txRange, gasLeft)
 	kvCount := exec.runTxInParallel(txRange, txBundle, currBlock)
 	exec.checkTxDepsAndUptStandbyQ(txRange, txBundle, int(kvCount))
 	return len(txBundle)
 }
 
-// Load at most 'exec.runnerNumber' transactions from standby queue
-func (exec *txEngine) loadStandbyTxs(txRange *TxRange) (txBundle []types.TxToRun) {
+// Load at most 'exec.runnerNumber' transactions from standby queue, whose total gas limit is no larger
+// than 'gasLeft'. A TX whose gas limit is larger than the block's gas limit only reserves the block's
+// gas limit, such that it can be loaded into a fresh block and will not stay in standby queue forever.
+func (exec *txEngine) loadStandbyTxs(txRange *TxRange, gasLeft uint64) (txBundle []types.TxToRun) {
 	ctx := exec.cleanCtx.WithRbtCopy()
 	end := txRange.end
 	if end > txRange.start+uint64(exec.runnerNumber) { // load at most exec.runnerNumber
 		end = txRange.start + uint64(exec.runnerNumber)
 	}
-	txBundle = make([]types.TxToRun, end-txRange.start)
+	gasLimit := exec.blockGasLimit()
+	txBundle = make([]types.TxToRun, 0, end-txRange.start)
 	for i := txRange.start; i < end; i++ {
 		k := types.GetStandbyTxKey(i)
 		bz := ctx.Rbt.GetBaseStore().Get(k)
-		txBundle[i-txRange.start].FromBytes(bz)
+		var tx types.TxToRun
+		tx.FromBytes(bz)
+		reservedGas := tx.Gas
+		if reservedGas > gasLimit {
+			reservedGas = gasLimit
+		}
+		if reservedGas > gasLeft {
+			break // TXs must be loaded in order, so the following ones cannot be loaded either
+		}
+		gasLeft -= reservedGas
+		txBundle = append(txBundle, tx)
 	}
 	ctx.Close(false)
 	return
@@ -3,7 +3,9 @@ package ebp
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
 	"math/big"
 	"math/rand"
 	"os"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/asm"
 	gethtypes "github.com/ethereum/go-ethereum/core/types"
 	gethcrypto "github.com/ethereum/go-ethereum/crypto"
 	"github.com/holiman/uint256"
@@ -27,6 +30,11 @@ import (
 )
 
 func prepareTruck() (*store.TrunkStore, *store.RootStore) {
+	trunk, root, _ := prepareTruckAndADS()
+	return trunk, root
+}
+
+func prepareTruckAndADS() (*store.TrunkStore, *store.RootStore, *moeingads.MoeingADS) {
 	var (
 		GuardStart = []byte{0, 0, 0, 0, 0, 0, 0, 0}
 		GuardEnd   = []byte{255, 255, 255, 255, 255, 255, 255, 255, 255}
@@ -38,7 +46,7 @@ func prepareTruck() (*store.TrunkStore, *store.RootStore) {
 	root := store.NewRootStore(mads, nil)
 	height := int64(1)
 	root.SetHeight(height)
-	return root.GetTrunkStore(1000).(*store.TrunkStore), root
+	return root.GetTrunkStore(1000).(*store.TrunkStore), root, mads
 }
 
 func prepareCtx(t *store.TrunkStore) *types.Context {
@@ -100,7 +108,7 @@ func TestTxEngine_DifferentAccount(t *testing.T) {
 	txsStandby := e.loadStandbyTxs(&TxRange{
 		start: startKey,
 		end:   endKey,
-	})
+	}, math.MaxUint64)
 	require.Equal(t, 2, len(txsStandby))
 	require.Equal(t, true, bytes.Equal(txs[0].To().Bytes(), txsStandby[0].To.Bytes()))
 	require.Equal(t, true, bytes.Equal(txs[1].To().Bytes(), txsStandby[1].To.Bytes()))
@@ -154,7 +162,7 @@ func TestTxEngine_SameAccount(t *testing.T) {
 	txsStandby := e.loadStandbyTxs(&TxRange{
 		start: startKey,
 		end:   endKey,
-	})
+	}, math.MaxUint64)
 	require.Equal(t, 4, len(txsStandby))
 	//require.Equal(t, true, bytes.Equal(txs[0].To().Bytes(), txsStandby[0].To.Bytes()))
 	//require.Equal(t, true, bytes.Equal(txs[1].To().Bytes(), txsStandby[1].To.Bytes()))
@@ -267,7 +275,7 @@ func executeTxs(randomTxs []*gethtypes.Transaction, trunk *store.TrunkStore) exe
 	standbyTxs := e.loadStandbyTxs(&TxRange{
 		start: startKey,
 		end:   endKey,
-	})
+	}, math.MaxUint64)
 	e.SetContext(prepareCtx(trunk))
 	e.Execute(&types.BlockInfo{})
 	//collect states
@@ -351,6 +359,518 @@ func TestAccBalanceNotEnough(t *testing.T) {
 	e.SetContext(prepareCtx(trunk))
 }
 
+func TestBlockGasLimit(t *testing.T) {
+	AdjustGasUsed = false
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	txs := prepareAccAndTx(e)
+	heightCtx := func(height int64) *types.Context {
+		ctx := prepareCtx(trunk)
+		ctx.SetCurrentHeight(height)
+		ctx.SetBlockGasLimitForkBlock(2)
+		return ctx
+	}
+	e.SetContext(heightCtx(1))
+	for _, tx := range txs {
+		e.CollectTx(tx)
+	}
+	frontier := e.Prepare(0, 0, DefaultTxGasLimit)
+	totalGas, _ := frontier.GetLatestTotalGas(from1)
+	require.Equal(t, uint64(100000), totalGas)
+	//before the fork, the gas limit of the block is ignored
+	e.SetContext(heightCtx(1))
+	e.Execute(&types.BlockInfo{Number: 1, GasLimit: 110000})
+	require.Equal(t, 2, len(e.CommittedTxs()))
+
+	tx1, _ := gethtypes.NewTransaction(1, to1, big.NewInt(100), 100000, big.NewInt(1), nil).WithSignature(e.signer, from1.Bytes())
+	tx2, _ := gethtypes.NewTransaction(1, to2, big.NewInt(100), 100000, big.NewInt(1), nil).WithSignature(e.signer, from2.Bytes())
+	e.SetContext(heightCtx(2))
+	e.CollectTx(tx1)
+	e.CollectTx(tx2)
+	e.Prepare(0, 0, DefaultTxGasLimit)
+	//the gas left after the first tx is not enough for the second one
+	e.SetContext(heightCtx(2))
+	e.Execute(&types.BlockInfo{Number: 2, GasLimit: 110000})
+	require.Equal(t, 1, len(e.CommittedTxs()))
+	e.SetContext(heightCtx(2))
+	startKey, endKey := e.getStandbyQueueRange()
+	require.Equal(t, uint64(3), startKey)
+	require.Equal(t, uint64(4), endKey)
+	//the left tx is executed in the next block, even if its gas limit exceeds the block's
+	e.SetContext(heightCtx(3))
+	e.Execute(&types.BlockInfo{Number: 3, GasLimit: 50000})
+	require.Equal(t, 1, len(e.CommittedTxs()))
+	e.SetContext(heightCtx(3))
+	startKey, endKey = e.getStandbyQueueRange()
+	require.Equal(t, true, startKey == endKey && endKey == 4)
+	e.cleanCtx.Close(false)
+}
+
+func TestSplitFeeDistributor(t *testing.T) {
+	AdjustGasUsed = false
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	_, err := NewSplitFeeDistributor(5000, 3000, 3000, to2)
+	require.Equal(t, ErrInvalidFeeShares, err)
+	_, err = NewSplitFeeDistributor(math.MaxUint64, 2, 0, to2) // the sum overflows to 1
+	require.Equal(t, ErrInvalidFeeShares, err)
+	treasury := common.HexToAddress("0x30")
+	coinbase := common.HexToAddress("0x40")
+	d, err := NewSplitFeeDistributor(5000, 3000, 1000, treasury)
+	require.Nil(t, err)
+	var exec TxExecutor = e
+	exec.(FeeDistributorSetter).SetFeeDistributor(d)
+	e.SetContext(prepareCtx(trunk))
+	txs := prepareAccAndTx(e)
+	e.SetContext(prepareCtx(trunk))
+	for _, tx := range txs {
+		e.CollectTx(tx)
+	}
+	e.Prepare(0, 0, DefaultTxGasLimit)
+	e.SetContext(prepareCtx(trunk))
+	e.Execute(&types.BlockInfo{Coinbase: coinbase})
+	require.Equal(t, 2, len(e.CommittedTxs()))
+	gasUsed, feeRefund, gasFee := e.GasUsedInfo()
+	require.Equal(t, uint64(21000*2), gasUsed)
+	require.Equal(t, uint64((100000-21000)*2), feeRefund.Uint64())
+	require.Equal(t, uint64(21000*2), gasFee.Uint64())
+	e.SetContext(prepareCtx(trunk))
+	require.Equal(t, uint64(21000), e.cleanCtx.GetAccount(coinbase).Balance().Uint64())
+	require.Equal(t, uint64(12600), GetBlackHoleBalance(e.cleanCtx).Uint64())
+	require.Equal(t, uint64(4200), e.cleanCtx.GetAccount(treasury).Balance().Uint64())
+	require.Equal(t, uint64(4200), GetSystemBalance(e.cleanCtx).Uint64())
+	e.cleanCtx.Close(false)
+}
+
+type hookContract struct {
+	beginCount, endCount common.Address
+}
+
+func (c *hookContract) RequiredGas(input []byte) uint64           { return 0 }
+func (c *hookContract) Run(input []byte) ([]byte, error)          { return nil, nil }
+func (c *hookContract) Init(ctx *types.Context)                   {}
+func (c *hookContract) IsSystemContract(addr common.Address) bool { return true }
+func (c *hookContract) Execute(ctx *types.Context, currBlock *types.BlockInfo, tx *types.TxToRun) (int, []types.EvmLog, uint64, []byte) {
+	return 0, nil, 0, nil
+}
+
+func (c *hookContract) BeginBlock(ctx *types.Context, currBlock *types.BlockInfo) error {
+	return updateBalance(ctx, c.beginCount, uint256.NewInt(1), true)
+}
+
+func (c *hookContract) EndBlock(ctx *types.Context, currBlock *types.BlockInfo) error {
+	err := updateBalance(ctx, c.endCount, uint256.NewInt(1), true)
+	if currBlock.Number == 3 {
+		return errors.New("failed at height 3")
+	}
+	return err
+}
+
+func (c *hookContract) Migrate(ctx *types.Context, fromVersion uint64) error {
+	return updateBalance(ctx, c.beginCount, uint256.NewInt(fromVersion*100), true)
+}
+
+func TestBlockHooks(t *testing.T) {
+	contractAddr := common.HexToAddress("0x2799")
+	c := &hookContract{beginCount: common.HexToAddress("0x50"), endCount: common.HexToAddress("0x51")}
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	ctx := prepareCtx(trunk)
+	RegisterPredefinedContract(ctx, contractAddr, c)
+	ctx.Close(false)
+	defer delete(PredefinedContractManager, contractAddr)
+	require.Panics(t, func() { ScheduleMigration(common.HexToAddress("0x2798"), 2, 1) })
+	ScheduleMigration(contractAddr, 2, 7)
+	defer delete(PredefinedContractMigrations, 2)
+	// a migration of a contract which is no longer a Migrator is skipped
+	PredefinedContractMigrations[3] = []ContractMigration{{Address: common.HexToAddress("0x2798"), FromVersion: 1}}
+	defer delete(PredefinedContractMigrations, 3)
+
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	txs := prepareAccAndTx(e)
+	for h := int64(1); h <= 3; h++ {
+		if h == 1 { // a block with transactions
+			e.SetContext(prepareCtx(trunk))
+			for _, tx := range txs {
+				e.CollectTx(tx)
+			}
+			e.Prepare(0, 0, DefaultTxGasLimit)
+		}
+		ctx := prepareCtx(trunk)
+		ctx.SetCurrentHeight(h)
+		e.SetContext(ctx)
+		e.Execute(&types.BlockInfo{Number: h})
+	}
+	ctx = prepareCtx(trunk)
+	defer ctx.Close(false)
+	require.Equal(t, uint64(3+700), ctx.GetAccount(c.beginCount).Balance().Uint64())
+	require.Equal(t, uint64(2), ctx.GetAccount(c.endCount).Balance().Uint64()) // the change at height 3 is discarded
+}
+
+// writes to 'target' and fails if the first byte of calldata is not zero
+type failableContract struct {
+	hookContract
+	target common.Address
+}
+
+func (c *failableContract) Execute(ctx *types.Context, currBlock *types.BlockInfo, tx *types.TxToRun) (int, []types.EvmLog, uint64, []byte) {
+	_ = updateBalance(ctx, c.target, uint256.NewInt(1), true)
+	logs := []types.EvmLog{{Address: tx.To}}
+	if tx.Data[0] != 0 {
+		return int(types.StatusRevert), logs, 30000, nil
+	}
+	return int(types.StatusSuccess), logs, 30000, []byte{1}
+}
+
+func TestSystemContractTx(t *testing.T) {
+	AdjustGasUsed = false
+	contractAddr := common.HexToAddress("0x2799")
+	c := &failableContract{target: common.HexToAddress("0x52")}
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	ctx := prepareCtx(trunk)
+	RegisterPredefinedContract(ctx, contractAddr, c)
+	ctx.Close(false)
+	defer delete(PredefinedContractManager, contractAddr)
+
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	prepareAccAndTx(e)
+	ctx = prepareCtx(trunk)
+	balance := ctx.GetAccount(from1).Balance().Uint64()
+	ctx.Close(false)
+	for i, data := range [][]byte{{0}, {1}} {
+		tx, _ := gethtypes.NewTransaction(uint64(i), contractAddr, big.NewInt(0), 100000, big.NewInt(1), data).WithSignature(e.signer, from1.Bytes())
+		committedTxs := runTxInBlock(e, func() *types.Context { return prepareCtx(trunk) }, int64(i+1), tx)
+		require.Equal(t, 1, len(committedTxs))
+		committed := committedTxs[0]
+		require.Equal(t, uint64(30000), committed.GasUsed)
+		_, feeRefund, _ := e.GasUsedInfo()
+		require.Equal(t, uint64(100000-30000), feeRefund.Uint64())
+		if i == 0 {
+			require.Equal(t, uint64(1), committed.Status)
+			require.Equal(t, 1, len(committed.Logs))
+		} else {
+			require.Equal(t, uint64(0), committed.Status)
+			require.Equal(t, 0, len(committed.Logs))
+		}
+	}
+	ctx = prepareCtx(trunk)
+	defer ctx.Close(false)
+	require.Equal(t, uint64(1), ctx.GetAccount(c.target).Balance().Uint64()) // the write of the failed tx is discarded
+	require.Equal(t, uint64(2), ctx.GetAccount(from1).Nonce())
+	require.Equal(t, balance-30000*2, ctx.GetAccount(from1).Balance().Uint64())
+}
+
+// counts the calls from smart contracts in its storage, and records the last caller and depth
+type counterContract struct {
+	hookContract
+	writeAccount bool // also pays one wei to the caller, which is not allowed
+}
+
+const counterContractSeq = 1000
+
+var (
+	countSlot  = string(common.BigToHash(big.NewInt(0)).Bytes())
+	callerSlot = string(common.BigToHash(big.NewInt(1)).Bytes())
+	depthSlot  = string(common.BigToHash(big.NewInt(2)).Bytes())
+)
+
+func (c *counterContract) RequiredGas(input []byte) uint64 { return 100 }
+func (c *counterContract) RunWithContext(ctx *types.Context, call *types.SystemContractCall, input []byte) ([]byte, error) {
+	count := uint256.NewInt(0).SetBytes(ctx.GetStorageAt(counterContractSeq, countSlot))
+	count.AddUint64(count, 1)
+	ctx.SetStorageAt(counterContractSeq, countSlot, count.PaddedBytes(32))
+	ctx.SetStorageAt(counterContractSeq, callerSlot, call.Caller.Bytes())
+	ctx.SetStorageAt(counterContractSeq, depthSlot, []byte{byte(call.Depth)})
+	if c.writeAccount {
+		acc := ctx.GetAccount(call.Caller)
+		acc.UpdateBalance(uint256.NewInt(0).AddUint64(acc.Balance(), 1))
+		ctx.SetAccount(call.Caller, acc)
+	}
+	return count.PaddedBytes(32), nil
+}
+
+// call(gas(), 0x2799, 0, 0, 0, 0, 0); if(calldatasize() != 0) { revert(0, 0) }
+const composableCallerAsm = `
+push 0
+push 0
+push 0
+push 0
+push 0
+push 0x2799
+gas
+call
+pop
+calldatasize
+jumpi @fail
+stop
+fail:
+push 0
+push 0
+revert
+`
+
+// sstore(0, staticcall(gas(), 0x2799, 0, 0, 0, 0))
+const composableStaticCallerAsm = `
+push 0
+push 0
+push 0
+push 0
+push 0x2799
+gas
+staticcall
+push 0
+sstore
+stop
+`
+
+// sstore(0, delegatecall(10000, 0x2799, 0, 0, 0, 0)); sstore(1, callcode(10000, 0x2799, 0, 0, 0, 0, 0)); sstore(2, 1)
+const composableDelegateCallerAsm = `
+push 0
+push 0
+push 0
+push 0
+push 0x2799
+push 10000
+delegatecall
+push 0
+sstore
+push 0
+push 0
+push 0
+push 0
+push 0
+push 0x2799
+push 10000
+callcode
+push 1
+sstore
+push 1
+push 2
+sstore
+stop
+`
+
+func TestComposableSystemContract(t *testing.T) {
+	contractAddr := common.HexToAddress("0x2799")
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	ctx := prepareCtx(trunk)
+	counter := &counterContract{}
+	RegisterPredefinedContract(ctx, contractAddr, counter)
+	ctx.Close(false)
+	defer delete(PredefinedContractManager, contractAddr)
+
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	prepareAccAndTx(e)
+	newCtx := func() *types.Context { return prepareCtx(trunk) }
+	runTx := func(height int64, tx *gethtypes.Transaction) {
+		require.Equal(t, 1, len(runTxInBlock(e, newCtx, height, tx)))
+	}
+	deploy := func(height int64, nonce uint64, runtime string) common.Address {
+		code := creationCode(compileAsm(runtime))
+		tx, _ := gethtypes.NewContractCreation(nonce, big.NewInt(0), 1000000, big.NewInt(1), code).WithSignature(e.signer, from1.Bytes())
+		runTx(height, tx)
+		return gethcrypto.CreateAddress(from1, nonce)
+	}
+	caller := deploy(1, 0, composableCallerAsm)
+	staticCaller := deploy(2, 1, composableStaticCallerAsm)
+	getCount := func() uint64 {
+		ctx := prepareCtx(trunk)
+		defer ctx.Close(false)
+		return uint256.NewInt(0).SetBytes(ctx.GetStorageAt(counterContractSeq, countSlot)).Uint64()
+	}
+
+	tx, _ := gethtypes.NewTransaction(2, caller, big.NewInt(0), 1000000, big.NewInt(1), nil).WithSignature(e.signer, from1.Bytes())
+	runTx(3, tx)
+	require.Equal(t, uint64(1), e.CommittedTxs()[0].Status)
+	require.Equal(t, uint64(1), getCount())
+	ctx = prepareCtx(trunk)
+	require.Equal(t, caller.Bytes(), ctx.GetStorageAt(counterContractSeq, callerSlot))
+	require.Equal(t, []byte{1}, ctx.GetStorageAt(counterContractSeq, depthSlot))
+	ctx.Close(false)
+
+	// the write made by the system contract is reverted with its caller
+	tx, _ = gethtypes.NewTransaction(3, caller, big.NewInt(0), 1000000, big.NewInt(1), []byte{1}).WithSignature(e.signer, from1.Bytes())
+	runTx(4, tx)
+	require.Equal(t, uint64(0), e.CommittedTxs()[0].Status)
+	require.Equal(t, uint64(1), getCount())
+
+	// writing in a static call fails
+	tx, _ = gethtypes.NewTransaction(4, staticCaller, big.NewInt(0), 1000000, big.NewInt(1), nil).WithSignature(e.signer, from1.Bytes())
+	runTx(5, tx)
+	require.Equal(t, uint64(1), e.CommittedTxs()[0].Status)
+	require.Equal(t, uint64(1), getCount())
+	ctx = prepareCtx(trunk)
+	acc := ctx.GetAccount(staticCaller)
+	require.Equal(t, 0, len(ctx.GetStorageAt(acc.Sequence(), countSlot)))
+	ctx.Close(false)
+
+	// DELEGATECALL and CALLCODE fail
+	delegateCaller := deploy(6, 5, composableDelegateCallerAsm)
+	tx, _ = gethtypes.NewTransaction(6, delegateCaller, big.NewInt(0), 1000000, big.NewInt(1), nil).WithSignature(e.signer, from1.Bytes())
+	runTx(7, tx)
+	require.Equal(t, uint64(1), e.CommittedTxs()[0].Status)
+	require.Equal(t, uint64(1), getCount())
+	ctx = prepareCtx(trunk)
+	seq := ctx.GetAccount(delegateCaller).Sequence()
+	require.Equal(t, 0, len(ctx.GetStorageAt(seq, string(common.BigToHash(big.NewInt(0)).Bytes()))))
+	require.Equal(t, 0, len(ctx.GetStorageAt(seq, string(common.BigToHash(big.NewInt(1)).Bytes()))))
+	require.Equal(t, common.BigToHash(big.NewInt(1)).Bytes(), ctx.GetStorageAt(seq, string(common.BigToHash(big.NewInt(2)).Bytes())))
+	ctx.Close(false)
+
+	// writing an account fails, and the other writes are reverted
+	counter.writeAccount = true
+	tx, _ = gethtypes.NewTransaction(7, caller, big.NewInt(0), 1000000, big.NewInt(1), nil).WithSignature(e.signer, from1.Bytes())
+	runTx(8, tx)
+	require.Equal(t, uint64(1), e.CommittedTxs()[0].Status)
+	require.Equal(t, uint64(1), getCount())
+	ctx = prepareCtx(trunk)
+	require.True(t, ctx.GetAccount(caller).Balance().IsZero())
+	ctx.Close(false)
+}
+
+// succeeds only if 'target' has a non-zero balance, without writing anything
+type balanceCheckContract struct {
+	hookContract
+	target common.Address
+}
+
+func (c *balanceCheckContract) Execute(ctx *types.Context, currBlock *types.BlockInfo, tx *types.TxToRun) (int, []types.EvmLog, uint64, []byte) {
+	if ctx.GetAccount(c.target).Balance().IsZero() {
+		return int(types.StatusRevert), nil, 30000, nil
+	}
+	return int(types.StatusSuccess), nil, 30000, nil
+}
+
+// A failed system contract TX reads the state written by a former TX in the same round, so it must be re-executed
+// in the next round instead of being committed with the result based on stale state
+func TestFailedSystemContractTxConflict(t *testing.T) {
+	AdjustGasUsed = false
+	contractAddr := common.HexToAddress("0x2799")
+	c := &balanceCheckContract{target: common.HexToAddress("0x52")}
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	ctx := prepareCtx(trunk)
+	RegisterPredefinedContract(ctx, contractAddr, c)
+	ctx.SetAccount(c.target, types.ZeroAccountInfo())
+	ctx.Close(true)
+	defer delete(PredefinedContractManager, contractAddr)
+
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	prepareAccAndTx(e)
+	tx0, _ := gethtypes.NewTransaction(0, c.target, big.NewInt(1), 100000, big.NewInt(1), nil).WithSignature(e.signer, from2.Bytes())
+	tx1, _ := gethtypes.NewTransaction(0, contractAddr, big.NewInt(0), 100000, big.NewInt(1), nil).WithSignature(e.signer, from1.Bytes())
+	// prepares them one by one, such that tx0 is before tx1 in standby queue
+	for _, tx := range []*gethtypes.Transaction{tx0, tx1} {
+		e.SetContext(prepareCtx(trunk))
+		e.CollectTx(tx)
+		e.Prepare(0, 0, DefaultTxGasLimit)
+	}
+	e.SetContext(prepareCtx(trunk))
+	e.Execute(&types.BlockInfo{Number: 1})
+	require.Equal(t, 2, len(e.CommittedTxs()))
+	require.Equal(t, contractAddr, common.Address(e.CommittedTxs()[1].To))
+	require.Equal(t, uint64(1), e.CommittedTxs()[1].Status)
+}
+
+func TestCheckTx(t *testing.T) {
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	prepareAccAndTx(e)
+	ctx := prepareCtx(trunk)
+	defer ctx.Close(false)
+	f := GetEmptyFrontier()
+	newTx := func(nonce uint64, value int64, gas uint64, gasPrice int64, from common.Address) *gethtypes.Transaction {
+		tx, _ := gethtypes.NewTransaction(nonce, to1, big.NewInt(value), gas, big.NewInt(gasPrice), nil).WithSignature(e.signer, from.Bytes())
+		return tx
+	}
+	_, err := CheckTx(ctx, e.signer, newTx(0, 100, 100000, 1, from1), f, 2, DefaultTxGasLimit)
+	require.Equal(t, types.ErrBadGasPrice, err)
+	_, err = CheckTx(ctx, e.signer, newTx(0, 100, DefaultTxGasLimit+1, 1, from1), f, 0, DefaultTxGasLimit)
+	require.Equal(t, types.ErrBadGasLimit, err)
+	_, err = CheckTx(ctx, e.signer, newTx(0, 100, 100000, 1, to2), f, 0, DefaultTxGasLimit)
+	require.Equal(t, types.ErrAccountNotExist, err)
+	_, err = CheckTx(ctx, e.signer, newTx(1, 100, 100000, 1, from1), f, 0, DefaultTxGasLimit)
+	require.Equal(t, types.ErrNonceTooLarge, err)
+	sender, err := CheckTx(ctx, e.signer, newTx(0, 100, 100000, 1, from1), f, 0, DefaultTxGasLimit)
+	require.Nil(t, err)
+	require.Equal(t, from1, sender)
+	nonce, _ := f.GetLatestNonce(from1)
+	require.Equal(t, uint64(1), nonce)
+	balance, _ := f.GetLatestBalance(from1)
+	require.Equal(t, uint64(10000_0000_0000-100000-100), balance.Uint64())
+	totalGas, _ := f.GetLatestTotalGas(from1)
+	require.Equal(t, uint64(100000), totalGas)
+	_, err = CheckTx(ctx, e.signer, newTx(0, 100, 100000, 1, from1), f, 0, DefaultTxGasLimit)
+	require.Equal(t, types.ErrNonceTooSmall, err)
+	_, err = CheckTx(ctx, e.signer, newTx(1, 100, 100000, 10000_0000, from1), f, 0, DefaultTxGasLimit)
+	require.Equal(t, types.ErrNotEnoughGasFee, err)
+	//the rejected txs do not change the frontier
+	nonce, _ = f.GetLatestNonce(from1)
+	require.Equal(t, uint64(1), nonce)
+	//the account's state in ctx is not changed
+	require.Equal(t, uint64(10000_0000_0000), ctx.GetAccount(from1).Balance().Uint64())
+}
+
+func TestStatusToStr(t *testing.T) {
+	require.Equal(t, "success", StatusToStr(0))
+	require.Equal(t, "revert", StatusToStr(2))
+	require.Equal(t, "failed-to-commit", StatusToStr(types.FAILED_TO_COMMIT))
+	require.Equal(t, "nonce-too-large", StatusToStr(types.TX_NONCE_TOO_LARGE))
+	require.Equal(t, "invalid gas price", StatusToStr(int(types.StatusInvalidGasPrice)))
+	require.Equal(t, "unknown", StatusToStr(12345))
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	ctx := prepareCtx(trunk)
+	defer ctx.Close(false)
+	_, err := ctx.CheckNonce(from2, 0)
+	require.Equal(t, "account does not exist", err.Error())
+	status, ok := types.ErrorToStatus(fmt.Errorf("check nonce: %w", err))
+	require.True(t, ok)
+	require.Equal(t, types.StatusAccountNotExist, status)
+	// the same rejection has the same code in CheckTx and Prepare
+	status, _ = types.ErrorToStatus(types.ErrNotEnoughGasFee)
+	require.Equal(t, types.StatusNotEnoughGasFee, status)
+	status, _ = types.ErrorToStatus(types.ErrInsufficientBalance)
+	require.Equal(t, types.StatusInsufficientBalance, status)
+	_, ok = types.ErrorToStatus(errors.New("other error"))
+	require.False(t, ok)
+	// the first condition checked by Prepare wins
+	for i := 0; i < 10; i++ {
+		status, _ = types.ErrorToStatus(twoErrors{types.ErrNotEnoughGasFee, types.ErrNonceTooSmall})
+		require.Equal(t, types.StatusTxNonceTooSmall, status)
+	}
+	// the receipts of the txs rejected in Prepare keep their old strings
+	require.Equal(t, "incorrect nonce", types.StatusTxNonceTooSmall.PrepareStatusStr())
+	require.Equal(t, "incorrect nonce", types.StatusTxNonceTooLarge.PrepareStatusStr())
+	require.Equal(t, "non-existent account", types.StatusAccountNotExist.PrepareStatusStr())
+	require.Equal(t, "invalid signature", types.StatusInvalidSignature.PrepareStatusStr())
+	require.Equal(t, "nonce-too-small", StatusToStr(types.TX_NONCE_TOO_SMALL))
+}
+
+// twoErrors is an error which is both of the errors
+type twoErrors struct {
+	first, second error
+}
+
+func (e twoErrors) Error() string {
+	return e.first.Error() + ": " + e.second.Error()
+}
+
+func (e twoErrors) Is(target error) bool {
+	return target == e.first || target == e.second
+}
+
 func TestContractCreation(t *testing.T) {
 	trunk, root := prepareTruck()
 	defer closeTestCtx(root)
@@ -471,6 +991,35 @@ func closeTestCtx(rootStore *store.RootStore) {
 	_ = os.RemoveAll("./testdbdata")
 }
 
+// runTxInBlock collects, prepares and executes tx in the block at height, with the contexts returned by
+// newCtx, and returns the committed transactions
+func runTxInBlock(e *txEngine, newCtx func() *types.Context, height int64, tx *gethtypes.Transaction) []*types.Transaction {
+	e.SetContext(newCtx())
+	e.CollectTx(tx)
+	e.Prepare(0, 0, DefaultTxGasLimit)
+	e.SetContext(newCtx())
+	e.Execute(&types.BlockInfo{Number: height})
+	return e.CommittedTxs()
+}
+
+// compileAsm compiles the assembly of go-ethereum's core/asm into bytecode
+func compileAsm(src string) []byte {
+	c := asm.NewCompiler(false)
+	c.Feed(asm.Lex([]byte(src), false))
+	bin, errs := c.Compile()
+	if len(errs) != 0 {
+		panic(errs[0])
+	}
+	return hexToBytes(bin)
+}
+
+// creationCode returns the creation bytecode which deploys runtime:
+// push2 len(runtime); dup1; push1 12; push1 0; codecopy; push1 0; return
+func creationCode(runtime []byte) []byte {
+	code := hexToBytes(fmt.Sprintf("61%04x80600c6000396000f3", len(runtime)))
+	return append(code, runtime...)
+}
+
 func hexToBytes(s string) []byte {
 	s = strings.TrimPrefix(s, "0x")
 	s = strings.TrimSpace(s)
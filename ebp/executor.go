@@ -32,6 +32,13 @@ type TxExecutor interface {
 	StandbyQLen() int
 }
 
+// FeeDistributorSetter is implemented by the TxExecutors which support a FeeDistributor other than
+// NopFeeDistributor. It is separated from TxExecutor such that the existing implementations still work.
+type FeeDistributorSetter interface {
+	//set the policy to distribute gas fees at the end of Execute
+	SetFeeDistributor(d FeeDistributor)
+}
+
 type Frontier interface {
 	GetLatestNonce(addr common.Address) (nonce uint64, exist bool)
 	SetLatestNonce(addr common.Address, newNonce uint64)
@@ -0,0 +1,89 @@
+package ebp
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+
+	"github.com/smartbch/moeingevm/types"
+)
+
+const BasisPointsDenominator uint64 = 10000
+
+// FeeDistributor decides where the gas fees collected in a block go. It is invoked at the end of Execute,
+// with the values returned by GasUsedInfo and the committed transactions. In Prepare, the gas fees of all
+// the transactions (gas limit * gas price) have been moved into the system account, and during execution
+// 'feeRefund' has been returned to the senders without being subtracted from the system account.
+type FeeDistributor interface {
+	DistributeFee(ctx *types.Context, currBlock *types.BlockInfo, gasUsed uint64,
+		feeRefund, gasFee *uint256.Int, committedTxs []*types.Transaction) error
+}
+
+// The default FeeDistributor does nothing and the embedding application must handle the fees and
+// refunds in the system account by itself, as before FeeDistributor is introduced.
+type NopFeeDistributor struct{}
+
+var _ FeeDistributor = NopFeeDistributor{}
+
+func (NopFeeDistributor) DistributeFee(ctx *types.Context, currBlock *types.BlockInfo, gasUsed uint64,
+	feeRefund, gasFee *uint256.Int, committedTxs []*types.Transaction) error {
+	return nil
+}
+
+// SplitFeeDistributor subtracts the refunded fee from the system account and then splits the gas fee
+// among coinbase, the black hole account (burnt) and a treasury account, with the shares denominated
+// in basis points. The part which is not assigned to anyone stays in the system account.
+type SplitFeeDistributor struct {
+	CoinbaseShare uint64
+	BurnShare     uint64
+	TreasuryShare uint64
+	Treasury      common.Address
+}
+
+var _ FeeDistributor = &SplitFeeDistributor{}
+
+var ErrInvalidFeeShares = errors.New("the sum of fee shares is larger than 10000 basis points")
+
+func NewSplitFeeDistributor(coinbaseShare, burnShare, treasuryShare uint64, treasury common.Address) (*SplitFeeDistributor, error) {
+	// checks the shares one by one, such that their sum can not overflow
+	if coinbaseShare > BasisPointsDenominator || burnShare > BasisPointsDenominator ||
+		treasuryShare > BasisPointsDenominator || coinbaseShare+burnShare+treasuryShare > BasisPointsDenominator {
+		return nil, ErrInvalidFeeShares
+	}
+	return &SplitFeeDistributor{
+		CoinbaseShare: coinbaseShare,
+		BurnShare:     burnShare,
+		TreasuryShare: treasuryShare,
+		Treasury:      treasury,
+	}, nil
+}
+
+func (d *SplitFeeDistributor) DistributeFee(ctx *types.Context, currBlock *types.BlockInfo, gasUsed uint64,
+	feeRefund, gasFee *uint256.Int, committedTxs []*types.Transaction) error {
+	if err := SubSystemAccBalance(ctx, feeRefund); err != nil {
+		return err
+	}
+	shares := []struct {
+		addr  common.Address
+		share uint64
+	}{
+		{currBlock.Coinbase, d.CoinbaseShare},
+		{blackHoleContractAddress, d.BurnShare},
+		{d.Treasury, d.TreasuryShare},
+	}
+	for _, s := range shares {
+		if s.share == 0 {
+			continue
+		}
+		amount := uint256.NewInt(0).Mul(gasFee, uint256.NewInt(s.share))
+		amount.Div(amount, uint256.NewInt(BasisPointsDenominator))
+		if err := SubSystemAccBalance(ctx, amount); err != nil {
+			return err
+		}
+		if err := updateBalance(ctx, s.addr, amount, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package ebp
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+
+	"github.com/smartbch/moeingevm/types"
+)
+
+// For the SEP20 tokens whose bytecode is verified and registered in NativeTokenRegistry, the successful
+// transfer/transferFrom/approve transactions are executed natively in Go, instead of in the EVM. The
+// registered bytecode must follow the standard storage layout and behavior of OpenZeppelin's ERC20:
+//   - mapping(address => uint256) balances and mapping(address => mapping(address => uint256)) allowances
+//   - the calls are non-payable and revert on zero addresses, insufficient balance/allowance and overflow
+//   - transfer/transferFrom update the sender's balance before the recipient's, and emit Transfer
+//   - transferFrom always decreases the allowance and emits Approval, after transferring like OpenZeppelin
+//     3.x, or before transferring like OpenZeppelin 4.x if SpendAllowanceFirst is set
+//   - approve emits Approval
+//   - all of them return true
+// The transactions which would fail in EVM are not executed natively, they fall back to EVM.
+
+const (
+	SelectorTransfer     uint32 = 0xa9059cbb // transfer(address,uint256)
+	SelectorTransferFrom uint32 = 0x23b872dd // transferFrom(address,address,uint256)
+	SelectorApprove      uint32 = 0x095ea7b3 // approve(address,uint256)
+)
+
+var (
+	TransferEventTopic = common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+	ApprovalEventTopic = common.HexToHash("0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925")
+)
+
+// The gas costs used by EVM, which must be the same as evmwrap's
+const (
+	txGas             uint64 = 21000
+	txDataZeroGas     uint64 = 4
+	txDataNonZeroGas  uint64 = 16
+	sloadGas          uint64 = 800
+	sstoreSetGas      uint64 = 20000
+	sstoreResetGas    uint64 = 5000
+	sstoreClearRefund uint64 = 15000
+	sstoreSentryGas   uint64 = 2300
+)
+
+// NativeTokenInfo describes a registered token bytecode. The gas fields are the gas consumed by the
+// bytecode for a successful call, excluding the intrinsic gas and the SSTOREs. They must be calibrated
+// against the EVM for each registered bytecode.
+type NativeTokenInfo struct {
+	BalancesSlot    uint64
+	AllowancesSlot  uint64
+	TransferGas     uint64
+	TransferFromGas uint64
+	ApproveGas      uint64
+	// Like OpenZeppelin 4.x, transferFrom spends the allowance before transferring, and does not spend
+	// an unlimited allowance. The calls with an unlimited allowance fall back to EVM.
+	SpendAllowanceFirst bool
+}
+
+// Maps the code hashes of verified token bytecode to their information. It is empty by default, so the
+// native execution is opt-in.
+var NativeTokenRegistry map[[32]byte]NativeTokenInfo
+
+func RegisterNativeToken(codeHash [32]byte, info NativeTokenInfo) {
+	NativeTokenRegistry[codeHash] = info
+}
+
+func init() {
+	NativeTokenRegistry = make(map[[32]byte]NativeTokenInfo)
+}
+
+func intrinsicGas(data []byte) uint64 {
+	gas := txGas
+	for _, b := range data {
+		if b == 0 {
+			gas += txDataZeroGas
+		} else {
+			gas += txDataNonZeroGas
+		}
+	}
+	return gas
+}
+
+// sstoreMeter buffers the storage changes of a contract and calculates the gas and refund of
+// SSTORE in the same way as tx_control::set_value does (EIP-2200).
+type sstoreMeter struct {
+	ctx     *types.Context
+	seq     uint64
+	origin  map[string][]byte
+	current map[string][]byte
+	keys    []string // keep the order of writing
+	gas     uint64
+	refund  int64
+}
+
+func newSstoreMeter(ctx *types.Context, seq uint64) *sstoreMeter {
+	return &sstoreMeter{
+		ctx:     ctx,
+		seq:     seq,
+		origin:  make(map[string][]byte),
+		current: make(map[string][]byte),
+	}
+}
+
+func (m *sstoreMeter) load(key string) *uint256.Int {
+	v, ok := m.current[key]
+	if !ok {
+		v = m.ctx.GetStorageAt(m.seq, key)
+		m.origin[key] = v
+		m.current[key] = v
+	}
+	return uint256.NewInt(0).SetBytes(v)
+}
+
+// the key must have been loaded before storing
+func (m *sstoreMeter) store(key string, value *uint256.Int) {
+	var newValue []byte
+	if !value.IsZero() {
+		newValue = value.PaddedBytes(32)
+	}
+	prev, origin := m.current[key], m.origin[key]
+	m.current[key] = newValue
+	m.keys = append(m.keys, key)
+	if bytes.Equal(prev, newValue) {
+		m.gas += sloadGas
+		return
+	}
+	if bytes.Equal(origin, prev) {
+		if len(origin) == 0 {
+			m.gas += sstoreSetGas
+		} else {
+			m.gas += sstoreResetGas
+			if len(newValue) == 0 {
+				m.refund += int64(sstoreClearRefund)
+			}
+		}
+		return
+	}
+	m.gas += sloadGas
+	if len(origin) != 0 {
+		if len(prev) == 0 {
+			m.refund -= int64(sstoreClearRefund)
+		}
+		if len(newValue) == 0 {
+			m.refund += int64(sstoreClearRefund)
+		}
+	}
+	if bytes.Equal(origin, newValue) {
+		if len(origin) == 0 {
+			m.refund += int64(sstoreSetGas - sloadGas)
+		} else {
+			m.refund += int64(sstoreResetGas - sloadGas)
+		}
+	}
+}
+
+func (m *sstoreMeter) commit() {
+	for _, key := range m.keys {
+		if v := m.current[key]; len(v) == 0 {
+			m.ctx.DeleteStorageAt(m.seq, key)
+		} else {
+			m.ctx.SetStorageAt(m.seq, key, v)
+		}
+	}
+}
+
+func addressToSlot(addr common.Address) string {
+	return string(common.LeftPadBytes(addr[:], 32))
+}
+
+func uint64ToSlot(n uint64) string {
+	var slot [32]byte
+	binary.BigEndian.PutUint64(slot[24:], n)
+	return string(slot[:])
+}
+
+func balanceKey(info *NativeTokenInfo, owner common.Address) string {
+	return string(crypto.Keccak256([]byte(addressToSlot(owner)), []byte(uint64ToSlot(info.BalancesSlot))))
+}
+
+func allowanceKey(info *NativeTokenInfo, owner, spender common.Address) string {
+	inner := crypto.Keccak256([]byte(addressToSlot(owner)), []byte(uint64ToSlot(info.AllowancesSlot)))
+	return string(crypto.Keccak256([]byte(addressToSlot(spender)), inner))
+}
+
+func (m *sstoreMeter) transfer(info *NativeTokenInfo, from, to common.Address, amount *uint256.Int) (log types.EvmLog, ok bool) {
+	if from == (common.Address{}) || to == (common.Address{}) {
+		return
+	}
+	fromKey := balanceKey(info, from)
+	fromBalance := m.load(fromKey)
+	if fromBalance.Lt(amount) {
+		return
+	}
+	m.store(fromKey, fromBalance.Sub(fromBalance, amount))
+	toKey := balanceKey(info, to)
+	toBalance := m.load(toKey)
+	newBalance, overflow := uint256.NewInt(0).AddOverflow(toBalance, amount)
+	if overflow {
+		return
+	}
+	m.store(toKey, newBalance)
+	return makeTokenLog(TransferEventTopic, from, to, amount), true
+}
+
+func (m *sstoreMeter) approve(info *NativeTokenInfo, owner, spender common.Address, amount *uint256.Int) types.EvmLog {
+	m.load(allowanceKey(info, owner, spender))
+	m.store(allowanceKey(info, owner, spender), amount)
+	return makeTokenLog(ApprovalEventTopic, owner, spender, amount)
+}
+
+func (m *sstoreMeter) spendAllowance(info *NativeTokenInfo, owner, spender common.Address, amount *uint256.Int) (log types.EvmLog, ok bool) {
+	key := allowanceKey(info, owner, spender)
+	allowance := m.load(key)
+	if allowance.Lt(amount) {
+		return
+	}
+	allowance.Sub(allowance, amount)
+	m.store(key, allowance)
+	return makeTokenLog(ApprovalEventTopic, owner, spender, allowance), true
+}
+
+func makeTokenLog(topic common.Hash, addr1, addr2 common.Address, amount *uint256.Int) types.EvmLog {
+	return types.EvmLog{
+		Topics: []common.Hash{topic, common.BytesToHash(addr1[:]), common.BytesToHash(addr2[:])},
+		Data:   amount.PaddedBytes(32),
+	}
+}
+
+// Reads the idx-th argument of a call as an address, returns false if its higher 12 bytes are not zero
+func addressArgument(data []byte, idx int) (addr common.Address, ok bool) {
+	arg := data[4+idx*32 : 4+(idx+1)*32]
+	for _, b := range arg[:12] {
+		if b != 0 {
+			return
+		}
+	}
+	copy(addr[:], arg[12:])
+	return addr, true
+}
+
+func uint256Argument(data []byte, idx int) *uint256.Int {
+	return uint256.NewInt(0).SetBytes32(data[4+idx*32 : 4+(idx+1)*32])
+}
+
+// Try to execute runner.Tx natively if it calls a registered token. If the transaction is not eligible,
+// or if it would fail in EVM, or if its gas is not enough, nothing is changed and false is returned,
+// then the transaction must be executed by EVM.
+func (runner *TxRunner) runNativeTokenTx() bool {
+	tx := runner.Tx
+	if len(NativeTokenRegistry) == 0 || runner.ForRpc || EnableRWList {
+		return false
+	}
+	if tx.Value != ([32]byte{}) || len(tx.Data) < 4 {
+		return false
+	}
+	bi := runner.Ctx.GetCode(tx.To)
+	if bi == nil {
+		return false
+	}
+	var codeHash [32]byte
+	copy(codeHash[:], bi.CodeHashSlice())
+	info, ok := NativeTokenRegistry[codeHash]
+	if !ok {
+		return false
+	}
+	acc := runner.Ctx.GetAccount(tx.To)
+	if acc == nil {
+		return false
+	}
+	m := newSstoreMeter(runner.Ctx, acc.Sequence())
+	var logs []types.EvmLog
+	var execGas uint64
+	switch binary.BigEndian.Uint32(tx.Data[:4]) {
+	case SelectorTransfer:
+		if len(tx.Data) != 4+32*2 {
+			return false
+		}
+		to, ok := addressArgument(tx.Data, 0)
+		if !ok {
+			return false
+		}
+		log, ok := m.transfer(&info, tx.From, to, uint256Argument(tx.Data, 1))
+		if !ok {
+			return false
+		}
+		logs = append(logs, log)
+		execGas = info.TransferGas
+	case SelectorTransferFrom:
+		if len(tx.Data) != 4+32*3 {
+			return false
+		}
+		from, ok1 := addressArgument(tx.Data, 0)
+		to, ok2 := addressArgument(tx.Data, 1)
+		if !ok1 || !ok2 {
+			return false
+		}
+		amount := uint256Argument(tx.Data, 2)
+		if info.SpendAllowanceFirst {
+			unlimited := uint256.NewInt(0).SetAllOne()
+			if m.load(allowanceKey(&info, from, tx.From)).Eq(unlimited) {
+				return false
+			}
+			log1, ok1 := m.spendAllowance(&info, from, tx.From, amount)
+			if !ok1 {
+				return false
+			}
+			log2, ok2 := m.transfer(&info, from, to, amount)
+			if !ok2 {
+				return false
+			}
+			logs = append(logs, log1, log2)
+		} else {
+			log1, ok1 := m.transfer(&info, from, to, amount)
+			if !ok1 {
+				return false
+			}
+			log2, ok2 := m.spendAllowance(&info, from, tx.From, amount)
+			if !ok2 {
+				return false
+			}
+			logs = append(logs, log1, log2)
+		}
+		execGas = info.TransferFromGas
+	case SelectorApprove:
+		if len(tx.Data) != 4+32*2 {
+			return false
+		}
+		spender, ok := addressArgument(tx.Data, 0)
+		if !ok {
+			return false
+		}
+		logs = append(logs, m.approve(&info, tx.From, spender, uint256Argument(tx.Data, 1)))
+		execGas = info.ApproveGas
+	default:
+		return false
+	}
+	execGas += m.gas
+	intrinsic := intrinsicGas(tx.Data)
+	// EVM requires more than sstoreSentryGas to be left before each SSTORE, here we use a stricter
+	// condition to make sure EVM would not run out of gas
+	if tx.Gas < intrinsic || tx.Gas-intrinsic < execGas+sstoreSentryGas {
+		return false
+	}
+	// the refund of a successful call is never negative, let EVM decide if it were
+	if m.refund < 0 {
+		return false
+	}
+	m.commit()
+	for i := range logs {
+		logs[i].Address = tx.To
+	}
+	callGas := tx.Gas - intrinsic
+	gasLeft := callGas - execGas
+	runner.Logs = logs
+	runner.OutData = uint256.NewInt(1).PaddedBytes(32)
+	runner.Status = int(types.StatusSuccess)
+	runner.InternalTxCalls = append(runner.InternalTxCalls, types.InternalTxCall{
+		Gas:         int64(callGas),
+		Destination: tx.To,
+		Sender:      tx.From,
+		Input:       append([]byte{}, tx.Data...),
+		Value:       tx.Value,
+	})
+	runner.InternalTxReturns = append(runner.InternalTxReturns, types.InternalTxReturn{
+		GasLeft: int64(gasLeft),
+		Output:  append([]byte{}, runner.OutData...),
+	})
+	runner.refundGasFee(gasLeft, uint64(m.refund))
+	return true
+}
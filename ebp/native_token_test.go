@@ -0,0 +1,539 @@
+package ebp
+
+import (
+	"encoding/binary"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/log"
+
+	"github.com/smartbch/moeingevm/evmwrap/testcase"
+	"github.com/smartbch/moeingevm/types"
+)
+
+// A minimal token following the standard ERC20 storage layout (balances at slot 0, allowances at slot 1),
+// written in assembly because no Solidity compiler is available for the tests.
+const testTokenAsm = `
+;; dispatch by selector
+push 0
+calldataload
+push 0xe0
+shr
+dup1
+push 0xa9059cbb
+eq
+jumpi @transfer
+dup1
+push 0x23b872dd
+eq
+jumpi @transferFrom
+dup1
+push 0x095ea7b3
+eq
+jumpi @approve
+fail:
+push 0
+dup1
+revert
+
+;; transfer(address to, uint256 amount)
+transfer:
+callvalue
+jumpi @fail
+push 68
+calldatasize
+lt
+jumpi @fail
+caller
+push 0x80
+mstore
+push 4
+calldataload
+dup1
+push 0xa0
+shr
+jumpi @fail
+push 0xa0
+mstore
+push 36
+calldataload
+push 0xc0
+mstore
+push @transferDone
+jump @doTransfer
+transferDone:
+jump @returnTrue
+
+;; transferFrom(address from, address to, uint256 amount)
+transferFrom:
+callvalue
+jumpi @fail
+push 100
+calldatasize
+lt
+jumpi @fail
+push 4
+calldataload
+dup1
+push 0xa0
+shr
+jumpi @fail
+push 0x80
+mstore
+push 36
+calldataload
+dup1
+push 0xa0
+shr
+jumpi @fail
+push 0xa0
+mstore
+push 68
+calldataload
+push 0xc0
+mstore
+push @transferFromDone
+jump @doTransfer
+transferFromDone:
+;; slot of allowances[from][caller]
+push 0x80
+mload
+push 0
+mstore
+push 1
+push 0x20
+mstore
+push 0x40
+push 0
+sha3
+push 0x20
+mstore
+caller
+push 0
+mstore
+push 0x40
+push 0
+sha3
+dup1
+sload
+push 0xc0
+mload
+dup2
+dup2
+gt
+jumpi @fail
+swap1
+sub
+dup1
+push 0xe0
+mstore
+swap1
+sstore
+;; Approval(from, caller, allowance)
+caller
+push 0x80
+mload
+push 0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925
+push 0x20
+push 0xe0
+log3
+jump @returnTrue
+
+;; approve(address spender, uint256 amount)
+approve:
+callvalue
+jumpi @fail
+push 68
+calldatasize
+lt
+jumpi @fail
+push 4
+calldataload
+dup1
+push 0xa0
+shr
+jumpi @fail
+;; slot of allowances[caller][spender]
+caller
+push 0
+mstore
+push 1
+push 0x20
+mstore
+push 0x40
+push 0
+sha3
+push 0x20
+mstore
+dup1
+push 0
+mstore
+push 36
+calldataload
+dup1
+push 0xc0
+mstore
+push 0x40
+push 0
+sha3
+sstore
+;; Approval(caller, spender, amount)
+caller
+push 0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925
+push 0x20
+push 0xc0
+log3
+jump @returnTrue
+
+;; moves mem[0xc0] from mem[0x80] to mem[0xa0], then jumps to the address on the stack
+doTransfer:
+push 0x80
+mload
+iszero
+jumpi @fail
+push 0xa0
+mload
+iszero
+jumpi @fail
+push 0x80
+mload
+push 0
+mstore
+push 0
+push 0x20
+mstore
+push 0x40
+push 0
+sha3
+dup1
+sload
+push 0xc0
+mload
+dup2
+dup2
+gt
+jumpi @fail
+swap1
+sub
+swap1
+sstore
+push 0xa0
+mload
+push 0
+mstore
+push 0x40
+push 0
+sha3
+dup1
+sload
+push 0xc0
+mload
+add
+dup1
+push 0xc0
+mload
+gt
+jumpi @fail
+swap1
+sstore
+;; Transfer(from, to, amount)
+push 0xa0
+mload
+push 0x80
+mload
+push 0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef
+push 0x20
+push 0xc0
+log3
+jump
+
+returnTrue:
+push 1
+push 0
+mstore
+push 0x20
+push 0
+return
+`
+
+// Calibrated against EVM for the bytecode of testTokenAsm, which is checked by TestNativeTokenGasFields
+var testTokenInfo = NativeTokenInfo{
+	BalancesSlot:    0,
+	AllowancesSlot:  1,
+	TransferGas:     3827,
+	TransferFromGas: 6631,
+	ApproveGas:      2101,
+}
+
+var testTokenAddr = common.HexToAddress("0x7070")
+
+const testTokenSeq uint64 = 0x1234
+
+func compileTestToken() []byte {
+	return compileAsm(testTokenAsm)
+}
+
+// Like OpenZeppelin 4.x, transferFrom of this token spends the allowance and emits Approval before
+// transferring. Unlike OpenZeppelin 4.x, it spends unlimited allowances too.
+var testApprovalFirstTokenInfo = NativeTokenInfo{
+	BalancesSlot:        0,
+	AllowancesSlot:      1,
+	TransferGas:         3827,
+	TransferFromGas:     6619,
+	ApproveGas:          2101,
+	SpendAllowanceFirst: true,
+}
+
+func compileApprovalFirstToken() []byte {
+	src := testTokenAsm
+	for _, r := range [][2]string{
+		{"push @transferFromDone\njump @doTransfer\ntransferFromDone:\n", ""},
+		{"log3\njump @returnTrue\n\n;; approve", "log3\npush @returnTrue\njump @doTransfer\n\n;; approve"},
+	} {
+		if !strings.Contains(src, r[0]) {
+			panic("cannot reorder transferFrom")
+		}
+		src = strings.Replace(src, r[0], r[1], 1)
+	}
+	return compileAsm(src)
+}
+
+func deployTestToken(ctx *types.Context, code []byte) {
+	codeHash := gethcrypto.Keccak256(code)
+	bz := append(append([]byte{0}, codeHash...), code...)
+	ctx.Rbt.Set(types.GetBytecodeKey(testTokenAddr), bz)
+	acc := types.ZeroAccountInfo()
+	acc.UpdateNonce(1)
+	acc.UpdateSequence(testTokenSeq)
+	ctx.SetAccount(testTokenAddr, acc)
+	ctx.SetStorageAt(testTokenSeq, balanceKey(&testTokenInfo, from1), uint256.NewInt(10000).PaddedBytes(32))
+}
+
+func tokenCallData(selector uint32, args ...interface{}) []byte {
+	data := make([]byte, 4, 4+32*len(args))
+	binary.BigEndian.PutUint32(data, selector)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case common.Address:
+			data = append(data, common.LeftPadBytes(v[:], 32)...)
+		case int:
+			data = append(data, uint256.NewInt(uint64(v)).PaddedBytes(32)...)
+		}
+	}
+	return data
+}
+
+type tokenTxStep struct {
+	from common.Address
+	data []byte
+}
+
+var tokenTxSteps = []tokenTxStep{
+	{from1, tokenCallData(SelectorTransfer, to1, 100)},
+	{from1, tokenCallData(SelectorApprove, from2, 1000)},
+	{from2, tokenCallData(SelectorTransferFrom, from1, to2, 300)},
+	{from2, tokenCallData(SelectorTransferFrom, from1, from1, 50)},
+	{from2, tokenCallData(SelectorTransferFrom, from1, to2, 10000)}, // insufficient balance
+	{from1, tokenCallData(SelectorTransfer, to1, 9600)},
+	{from1, tokenCallData(SelectorApprove, from2, 0)},
+	{from2, tokenCallData(SelectorTransfer, to1, 1)}, // insufficient balance
+}
+
+type tokenTxsResult struct {
+	committedTxs []*types.Transaction
+	storage      [][]byte
+	accounts     []*types.AccountInfo
+}
+
+// Executes each step of tokenTxSteps in a block, and returns the committed txs and the states
+func runTokenTxSteps(newCtx func() *types.Context, code []byte) (r tokenTxsResult) {
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(newCtx())
+	prepareAccAndTx(e)
+	ctx := newCtx()
+	deployTestToken(ctx, code)
+	ctx.Close(true)
+	nonces := make(map[common.Address]uint64)
+	for i, step := range tokenTxSteps {
+		tx, _ := gethtypes.NewTransaction(nonces[step.from], testTokenAddr, big.NewInt(0), 100000,
+			big.NewInt(1), step.data).WithSignature(e.signer, step.from.Bytes())
+		nonces[step.from]++
+		r.committedTxs = append(r.committedTxs, runTxInBlock(e, newCtx, int64(i+1), tx)...)
+	}
+	ctx = newCtx()
+	for _, addr := range []common.Address{from1, from2, to1, to2} {
+		r.storage = append(r.storage, ctx.GetStorageAt(testTokenSeq, balanceKey(&testTokenInfo, addr)))
+		r.accounts = append(r.accounts, ctx.GetAccount(addr))
+	}
+	r.storage = append(r.storage, ctx.GetStorageAt(testTokenSeq, allowanceKey(&testTokenInfo, from1, from2)))
+	ctx.Close(false)
+	return
+}
+
+func compareTokenTxsResults(t *testing.T, evmResult, nativeResult tokenTxsResult) {
+	require.Equal(t, len(tokenTxSteps), len(evmResult.committedTxs))
+	require.Equal(t, len(tokenTxSteps), len(nativeResult.committedTxs))
+	for i, tx := range evmResult.committedTxs {
+		nativeTx := nativeResult.committedTxs[i]
+		require.Equal(t, tx.Status, nativeTx.Status)
+		require.Equal(t, tx.StatusStr, nativeTx.StatusStr)
+		require.Equal(t, tx.GasUsed, nativeTx.GasUsed)
+		require.Equal(t, tx.CumulativeGasUsed, nativeTx.CumulativeGasUsed)
+		require.Equal(t, tx.OutData, nativeTx.OutData)
+		require.Equal(t, tx.Logs, nativeTx.Logs)
+		require.Equal(t, tx.LogsBloom, nativeTx.LogsBloom)
+		require.Equal(t, tx.InternalTxCalls, nativeTx.InternalTxCalls)
+		require.Equal(t, tx.InternalTxReturns, nativeTx.InternalTxReturns)
+	}
+	require.Equal(t, evmResult.storage, nativeResult.storage)
+	require.Equal(t, evmResult.accounts, nativeResult.accounts)
+}
+
+func TestNativeTokenTx(t *testing.T) {
+	AdjustGasUsed = false
+	defer func() {
+		NativeTokenRegistry = make(map[[32]byte]NativeTokenInfo)
+	}()
+	trunk, root := prepareTruck()
+	evmResult := runTokenTxSteps(func() *types.Context { return prepareCtx(trunk) }, compileTestToken())
+	closeTestCtx(root)
+
+	var codeHash [32]byte
+	copy(codeHash[:], gethcrypto.Keccak256(compileTestToken()))
+	RegisterNativeToken(codeHash, testTokenInfo)
+	trunk, root = prepareTruck()
+	defer closeTestCtx(root)
+	nativeResult := runTokenTxSteps(func() *types.Context { return prepareCtx(trunk) }, compileTestToken())
+
+	compareTokenTxsResults(t, evmResult, nativeResult)
+	require.Equal(t, uint64(100+9600), uint256.NewInt(0).SetBytes(nativeResult.storage[2]).Uint64())
+	require.Equal(t, 0, len(nativeResult.storage[0]))
+	require.Equal(t, 0, len(nativeResult.storage[4]))
+
+	// a successful transfer is executed natively
+	ctx := prepareCtx(trunk)
+	defer ctx.Close(false)
+	txToRun := &types.TxToRun{
+		BasicTx: types.BasicTx{
+			From: to1,
+			To:   testTokenAddr,
+			Gas:  100000,
+			Data: tokenCallData(SelectorTransfer, to2, 700),
+		},
+	}
+	ctx.SetAccount(to1, types.ZeroAccountInfo())
+	runner := NewTxRunner(ctx, txToRun)
+	require.True(t, runner.runNativeTokenTx())
+	require.Equal(t, int(types.StatusSuccess), runner.Status)
+	require.Equal(t, 1, len(runner.Logs))
+	require.Equal(t, uint64(9000), uint256.NewInt(0).SetBytes(ctx.GetStorageAt(testTokenSeq, balanceKey(&testTokenInfo, to1))).Uint64())
+	require.Equal(t, uint64(1000), uint256.NewInt(0).SetBytes(ctx.GetStorageAt(testTokenSeq, balanceKey(&testTokenInfo, to2))).Uint64())
+	// a transfer which would fail in EVM is not executed natively
+	txToRun.Data = tokenCallData(SelectorTransfer, to2, 9001)
+	require.False(t, NewTxRunner(ctx, txToRun).runNativeTokenTx())
+}
+
+func TestNativeTokenSpendAllowanceFirst(t *testing.T) {
+	AdjustGasUsed = false
+	defer func() {
+		NativeTokenRegistry = make(map[[32]byte]NativeTokenInfo)
+	}()
+	code := compileApprovalFirstToken()
+	trunk, root := prepareTruck()
+	evmResult := runTokenTxSteps(func() *types.Context { return prepareCtx(trunk) }, code)
+	closeTestCtx(root)
+	// Approval is emitted before Transfer
+	require.Equal(t, [32]byte(ApprovalEventTopic), evmResult.committedTxs[2].Logs[0].Topics[0])
+	require.Equal(t, [32]byte(TransferEventTopic), evmResult.committedTxs[2].Logs[1].Topics[0])
+
+	var codeHash [32]byte
+	copy(codeHash[:], gethcrypto.Keccak256(code))
+	RegisterNativeToken(codeHash, testApprovalFirstTokenInfo)
+	trunk, root = prepareTruck()
+	defer closeTestCtx(root)
+	nativeResult := runTokenTxSteps(func() *types.Context { return prepareCtx(trunk) }, code)
+	compareTokenTxsResults(t, evmResult, nativeResult)
+
+	// transferFrom with an unlimited allowance is not executed natively
+	ctx := prepareCtx(trunk)
+	defer ctx.Close(false)
+	ctx.SetAccount(to1, types.ZeroAccountInfo())
+	ctx.SetStorageAt(testTokenSeq, allowanceKey(&testApprovalFirstTokenInfo, to1, from2), uint256.NewInt(0).SetAllOne().PaddedBytes(32))
+	txToRun := &types.TxToRun{
+		BasicTx: types.BasicTx{
+			From: from2,
+			To:   testTokenAddr,
+			Gas:  100000,
+			Data: tokenCallData(SelectorTransferFrom, to1, to2, 100),
+		},
+	}
+	require.False(t, NewTxRunner(ctx, txToRun).runNativeTokenTx())
+	txToRun.Data = tokenCallData(SelectorTransfer, to2, 100)
+	txToRun.From = to1
+	require.True(t, NewTxRunner(ctx, txToRun).runNativeTokenTx())
+}
+
+// Each gas field of NativeTokenInfo must make the gas used by a successful call the same as in EVM. A call
+// is executed natively with the field set to zero, then the field must be the gas it uses less than EVM. The
+// calls change the storage slots from zero to non-zero or between non-zero values, so there is no refund.
+func TestNativeTokenGasFields(t *testing.T) {
+	AdjustGasUsed = false
+	defer func() {
+		NativeTokenRegistry = make(map[[32]byte]NativeTokenInfo)
+	}()
+	for _, token := range []struct {
+		code []byte
+		info NativeTokenInfo
+	}{
+		{compileTestToken(), testTokenInfo},
+		{compileApprovalFirstToken(), testApprovalFirstTokenInfo},
+	} {
+		for _, c := range []struct {
+			field string
+			gas   func(info *NativeTokenInfo) *uint64
+			from  common.Address
+			data  []byte
+		}{
+			{"TransferGas", func(info *NativeTokenInfo) *uint64 { return &info.TransferGas },
+				from1, tokenCallData(SelectorTransfer, to1, 100)},
+			{"TransferFromGas", func(info *NativeTokenInfo) *uint64 { return &info.TransferFromGas },
+				from2, tokenCallData(SelectorTransferFrom, from1, to2, 300)},
+			{"ApproveGas", func(info *NativeTokenInfo) *uint64 { return &info.ApproveGas },
+				from1, tokenCallData(SelectorApprove, from2, 1000)},
+		} {
+			gasUsed := make([]uint64, 2)
+			for i := range gasUsed {
+				if i == 1 {
+					info := token.info
+					*c.gas(&info) = 0
+					var codeHash [32]byte
+					copy(codeHash[:], gethcrypto.Keccak256(token.code))
+					RegisterNativeToken(codeHash, info)
+				}
+				trunk, root := prepareTruck()
+				newCtx := func() *types.Context { return prepareCtx(trunk) }
+				e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+				e.SetContext(newCtx())
+				prepareAccAndTx(e)
+				ctx := newCtx()
+				deployTestToken(ctx, token.code)
+				ctx.SetStorageAt(testTokenSeq, allowanceKey(&token.info, from1, from2), uint256.NewInt(1000).PaddedBytes(32))
+				ctx.Close(true)
+				tx, _ := gethtypes.NewTransaction(0, testTokenAddr, big.NewInt(0), 100000, big.NewInt(1), c.data).WithSignature(e.signer, c.from.Bytes())
+				committedTxs := runTxInBlock(e, newCtx, 1, tx)
+				require.Equal(t, 1, len(committedTxs))
+				require.Equal(t, types.ReceiptStatusSuccessful, committedTxs[0].Status)
+				gasUsed[i] = committedTxs[0].GasUsed
+				closeTestCtx(root)
+				NativeTokenRegistry = make(map[[32]byte]NativeTokenInfo)
+			}
+			require.Equal(t, gasUsed[0]-gasUsed[1], *c.gas(&token.info), c.field)
+		}
+	}
+}
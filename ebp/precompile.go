@@ -1,16 +1,20 @@
 package ebp
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"errors"
+	"math/big"
 	"unsafe"
 
 	"github.com/btcsuite/btcd/btcec"
-	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/holiman/uint256"
 	"github.com/vechain/go-ecvrf"
+
+	"github.com/smartbch/moeingevm/types"
 )
 
-//#include <stdint.h>
+//#include "../evmwrap/host_bridge/bridge.h"
 import "C"
 
 //var PrecompiledContractsIstanbul map[common.Address]PrecompiledContract
@@ -28,8 +32,20 @@ import "C"
 
 const (
 	VRF_VERIFY_GAS uint64 = 5000
+
+	VRF_ALPHA_LEN  = 32
+	VRF_PUBKEY_LEN = 33
+	VRF_PI_LEN     = 81 // gamma (33 bytes) || c (16 bytes) || s (32 bytes)
+	// the length of an item of VrfBatchVerifyContract's input
+	VRF_BATCH_ITEM_LEN = VRF_ALPHA_LEN + VRF_PUBKEY_LEN + VRF_PI_LEN
+
+	ED25519_VERIFY_GAS          uint64 = 2000
+	ED25519_VERIFY_GAS_PER_BYTE uint64 = 1
+	SCHNORR_VERIFY_GAS          uint64 = 3000
 )
 
+var ErrWriteInStaticCall = errors.New("system contract writes states in static call")
+
 type VrfVerifyContract struct{}
 
 func (vdfc *VrfVerifyContract) RequiredGas(input []byte) uint64 {
@@ -45,38 +61,190 @@ func (vdfc *VrfVerifyContract) Run(input []byte) ([]byte, error) {
 	alpha := input[0:32]
 	pubKeyBytes := input[32 : 32+33]
 	pi := input[32+33:]
-	pubKey, err := btcec.ParsePubKey(pubKeyBytes, btcec.S256())
+	beta, err := vrfVerify(alpha, pubKeyBytes, pi)
 	if err != nil {
 		return zeros[:], err
 	}
+	return beta, nil
+}
+
+func vrfVerify(alpha, pubKeyBytes, pi []byte) ([]byte, error) {
+	pubKey, err := btcec.ParsePubKey(pubKeyBytes, btcec.S256())
+	if err != nil {
+		return nil, err
+	}
 	vrf := ecvrf.NewSecp256k1Sha256Tai()
-	beta, err := vrf.Verify(pubKey.ToECDSA(), alpha, pi)
+	return vrf.Verify(pubKey.ToECDSA(), alpha, pi)
+}
+
+// VrfBatchVerifyContract verifies several proofs in one call. Its input is the concatenation of items,
+// each of which is abi.encodePacked(alpha/*uint256*/, pubKeyBytes/*33 bytes*/, pi/*81 bytes*/), and
+// its output is the concatenation of the betas. If any of the proofs is invalid, the call fails.
+type VrfBatchVerifyContract struct{}
+
+func (vbvc *VrfBatchVerifyContract) RequiredGas(input []byte) uint64 {
+	count := uint64(len(input) / VRF_BATCH_ITEM_LEN)
+	if count == 0 {
+		return VRF_VERIFY_GAS
+	}
+	return count * VRF_VERIFY_GAS
+}
+
+func (vbvc *VrfBatchVerifyContract) Run(input []byte) ([]byte, error) {
+	if len(input) == 0 || len(input)%VRF_BATCH_ITEM_LEN != 0 {
+		return nil, errors.New("invalid input length")
+	}
+	count := len(input) / VRF_BATCH_ITEM_LEN
+	output := make([]byte, 0, count*32)
+	for i := 0; i < count; i++ {
+		item := input[i*VRF_BATCH_ITEM_LEN : (i+1)*VRF_BATCH_ITEM_LEN]
+		beta, err := vrfVerify(item[:VRF_ALPHA_LEN], item[VRF_ALPHA_LEN:VRF_ALPHA_LEN+VRF_PUBKEY_LEN],
+			item[VRF_ALPHA_LEN+VRF_PUBKEY_LEN:])
+		if err != nil {
+			return nil, err
+		}
+		output = append(output, beta...)
+	}
+	return output, nil
+}
+
+// Ed25519VerifyContract verifies an Ed25519 signature. Its input is abi.encodePacked(pubKey/*32 bytes*/,
+// sig/*64 bytes*/, msg/*variable-length bytes*/), and it returns uint256(1) if the signature is valid,
+// otherwise uint256(0).
+type Ed25519VerifyContract struct{}
+
+func (c *Ed25519VerifyContract) RequiredGas(input []byte) uint64 {
+	return ED25519_VERIFY_GAS + uint64(len(input))*ED25519_VERIFY_GAS_PER_BYTE
+}
+
+func (c *Ed25519VerifyContract) Run(input []byte) ([]byte, error) {
+	if len(input) < ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, errors.New("input too short")
+	}
+	pubKey := ed25519.PublicKey(input[:ed25519.PublicKeySize])
+	sig := input[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize]
+	msg := input[ed25519.PublicKeySize+ed25519.SignatureSize:]
+	return boolToWord(ed25519.Verify(pubKey, msg, sig)), nil
+}
+
+// SchnorrVerifyContract verifies a BCH-style Schnorr signature over secp256k1, which is used by
+// OP_CHECKSIG and OP_CHECKDATASIG since the 2019-05 upgrade of Bitcoin Cash. Its input is
+// abi.encodePacked(msgHash/*32 bytes*/, pubKey/*33 bytes*/, sig/*64 bytes*/), and it returns
+// uint256(1) if the signature is valid, otherwise uint256(0).
+type SchnorrVerifyContract struct{}
+
+func (c *SchnorrVerifyContract) RequiredGas(input []byte) uint64 {
+	return SCHNORR_VERIFY_GAS
+}
+
+func (c *SchnorrVerifyContract) Run(input []byte) ([]byte, error) {
+	if len(input) != 32+33+64 {
+		return nil, errors.New("invalid input length")
+	}
+	pubKey, err := btcec.ParsePubKey(input[32:32+33], btcec.S256())
 	if err != nil {
-		return zeros[:], err
+		return nil, err
+	}
+	return boolToWord(SchnorrVerify(input[:32], pubKey, input[32+33:])), nil
+}
+
+// SchnorrVerify checks sig=(r, s) against msgHash and pubKey with the BCH Schnorr algorithm:
+// e = sha256(r || compressed(pubKey) || msgHash), R = s*G - e*pubKey, and R must have a
+// quadratic-residue y and an x equal to r.
+func SchnorrVerify(msgHash []byte, pubKey *btcec.PublicKey, sig []byte) bool {
+	if len(sig) != 64 {
+		return false
+	}
+	curve := btcec.S256()
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if r.Cmp(curve.P) >= 0 || s.Cmp(curve.N) >= 0 {
+		return false
+	}
+	h := sha256.New()
+	h.Write(sig[:32])
+	h.Write(pubKey.SerializeCompressed())
+	h.Write(msgHash)
+	e := new(big.Int).SetBytes(h.Sum(nil))
+	e.Mod(e, curve.N)
+	e.Sub(curve.N, e) // -e, such that R = s*G + (-e)*pubKey
+	sx, sy := curve.ScalarBaseMult(s.Bytes())
+	ex, ey := curve.ScalarMult(pubKey.X, pubKey.Y, e.Bytes())
+	rx, ry := curve.Add(sx, sy, ex, ey)
+	if rx.Sign() == 0 && ry.Sign() == 0 { // the point at infinity
+		return false
+	}
+	if big.Jacobi(ry, curve.P) != 1 {
+		return false
+	}
+	return rx.Cmp(r) == 0
+}
+
+func boolToWord(b bool) []byte {
+	var word [32]byte
+	if b {
+		word[31] = 1
+	}
+	return word[:]
+}
+
+func init() {
+	if C.MAX_GO_PRECOMPILES != MaxGoPrecompiles {
+		panic("MaxGoPrecompiles is different from MAX_GO_PRECOMPILES")
 	}
-	return beta, nil
+}
+
+// Tell the C environment which addresses are precompiled contracts implemented in Go, including the
+// active ones in Precompiles and the predefined system contracts. Register and RegisterPredefinedContract
+// make sure that they are not more than MaxGoPrecompiles.
+func fillGoPrecompiles(bi *block_info, ctx *types.Context) {
+	ids := make([]uint64, 0, C.MAX_GO_PRECOMPILES)
+	for _, addr := range Precompiles.ActiveAddresses(ctx) {
+		id, _ := precompileID(addr)
+		ids = append(ids, id)
+	}
+	for addr := range PredefinedContractManager {
+		if id, ok := precompileID(addr); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > C.MAX_GO_PRECOMPILES {
+		panic("too many precompiled contracts")
+	}
+	for i, id := range ids {
+		bi.cfg.go_precompiles[i] = C.uint64_t(id)
+	}
+	bi.cfg.go_precompile_count = C.int(len(ids))
 }
 
 //export call_precompiled_contract
-func call_precompiled_contract(contract_addr *evmc_address,
+func call_precompiled_contract(handler C.int,
+	contract_addr *evmc_address,
+	caller *evmc_address,
+	value *evmc_bytes32,
+	kind C.int,
+	is_static C.int,
+	depth C.int,
 	input_ptr unsafe.Pointer,
 	input_size C.int,
 	gas_left *C.uint64_t,
 	ret_value *C.int,
 	out_of_gas *C.int,
 	output_ptr *small_buffer,
+	big_output_ptr **C.uint8_t,
 	output_size *C.int) {
 	*output_size = 0
+	runner := getRunner(int(handler))
 	addr := toAddress(contract_addr)
-	contract, ok := vm.PrecompiledContractsIstanbul[addr]
-	if addr == common.Address([20]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x27, 0x13}) {
-		contract = &VrfVerifyContract{}
-		ok = true
-	} else if executor, exist := PredefinedContractManager[addr]; exist {
+	contract, ok := Precompiles.Get(runner.Ctx, addr)
+	if executor, exist := PredefinedContractManager[addr]; !ok && exist {
 		contract = executor
 		ok = true
 	}
-	if !ok {
+	composable, isComposable := contract.(types.ComposableSystemContract)
+	// in DELEGATECALL and CALLCODE, the caller and the value belong to the calling frame, and the value is
+	// not sent to the composable system contract, so it refuses such calls
+	if !ok || (isComposable && kind != C.EVMC_CALL) {
 		*ret_value = 0
 		*out_of_gas = 0
 		return
@@ -90,20 +258,69 @@ func call_precompiled_contract(contract_addr *evmc_address,
 		return
 	}
 	*gas_left -= gasRequired
-	output, err := contract.Run(input)
+	snapshot := runner.Ctx.Snapshot()
+	var output []byte
+	var err error
+	if isComposable {
+		valueHash := toHash(value)
+		call := &types.SystemContractCall{
+			CurrBlock: runner.currBlock,
+			Caller:    toAddress(caller),
+			Value:     uint256.NewInt(0).SetBytes32(valueHash[:]),
+			IsStatic:  is_static != 0,
+			Depth:     int(depth),
+		}
+		output, err = runWithContext(composable, runner.Ctx, call, input)
+		if err == nil && call.IsStatic && runner.Ctx.Snapshot() != snapshot {
+			err = ErrWriteInStaticCall
+		}
+	} else {
+		output, err = contract.Run(input)
+	}
 	if err != nil {
+		runner.Ctx.RevertToSnapshot(snapshot)
 		*ret_value = 0
 		*out_of_gas = 0
 		return
 	}
+	// the C environment will call revert_precompiled_contract if the calling frame reverts
+	runner.precompileSnapshots = append(runner.precompileSnapshots, snapshot)
 	size := len(output)
-	if size > SMALL_BUF_SIZE { // limit the copied data to prevent overflow
-		size = SMALL_BUF_SIZE
-	}
 	*output_size = C.int(size)
-	for i := 0; i < size; i++ {
-		output_ptr.data[i] = C.uint8_t(output[i])
+	if size > SMALL_BUF_SIZE { // C.CBytes allocates memory with malloc and C will free it
+		*big_output_ptr = (*C.uint8_t)(C.CBytes(output))
+	} else {
+		for i := 0; i < size; i++ {
+			output_ptr.data[i] = C.uint8_t(output[i])
+		}
 	}
 	*ret_value = 1
 	*out_of_gas = 0
 }
+
+// runWithContext runs a composable system contract with the accounts of ctx locked, and turns the panic of
+// writing them into an error, which makes the call fail
+func runWithContext(composable types.ComposableSystemContract, ctx *types.Context,
+	call *types.SystemContractCall, input []byte) (output []byte, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			if r != types.ErrAccountsLocked {
+				panic(r)
+			}
+			err = types.ErrAccountsLocked
+		}
+	}()
+	ctx.LockAccounts()
+	defer ctx.UnlockAccounts()
+	return composable.RunWithContext(ctx, call, input)
+}
+
+//export revert_precompiled_contract
+func revert_precompiled_contract(handler C.int) {
+	// revert the changes made by the last successful call to a Go-implemented precompiled contract
+	runner := getRunner(int(handler))
+	last := len(runner.precompileSnapshots) - 1
+	runner.Ctx.RevertToSnapshot(runner.precompileSnapshots[last])
+	runner.precompileSnapshots = runner.precompileSnapshots[:last]
+}
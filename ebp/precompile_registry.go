@@ -0,0 +1,166 @@
+package ebp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+
+	"github.com/smartbch/moeingevm/types"
+)
+
+// An ActivationFunc decides whether a precompiled contract is active in the block being executed by ctx
+type ActivationFunc func(ctx *types.Context) bool
+
+func AlwaysActive(ctx *types.Context) bool {
+	return true
+}
+
+func ActiveAfterXHedgeFork(ctx *types.Context) bool {
+	return ctx.IsXHedgeFork()
+}
+
+func ActiveAfterBerlinFork(ctx *types.Context) bool {
+	return ctx.IsBerlinFork()
+}
+
+func ActiveSince(height int64) ActivationFunc {
+	return func(ctx *types.Context) bool {
+		return ctx.Height >= height
+	}
+}
+
+// MaxGoPrecompiles is MAX_GO_PRECOMPILES of evmwrap, the max number of addresses which can be passed to the
+// C environment as the precompiled contracts implemented in Go
+const MaxGoPrecompiles = 64
+
+type precompileEntry struct {
+	contract vm.PrecompiledContract // its RequiredGas is the gas function
+	isActive ActivationFunc
+}
+
+// PrecompileRegistry contains the precompiled contracts implemented in Go. One address can have several
+// versions (for example, before and after a repricing fork), and the latest registered version which is
+// active in current block takes effect. The IDs of the active addresses are passed to the C environment,
+// such that evmwrap treats them as precompiled contracts.
+type PrecompileRegistry struct {
+	entries map[common.Address][]precompileEntry
+}
+
+func NewPrecompileRegistry() *PrecompileRegistry {
+	return &PrecompileRegistry{entries: make(map[common.Address][]precompileEntry)}
+}
+
+// The C environment identifies a precompiled contract with the last 8 bytes of its address
+func precompileID(addr common.Address) (uint64, bool) {
+	for _, b := range addr[:12] {
+		if b != 0 {
+			return 0, false
+		}
+	}
+	id := binary.BigEndian.Uint64(addr[12:])
+	return id, int64(id) > 0
+}
+
+func (r *PrecompileRegistry) Register(addr common.Address, contract vm.PrecompiledContract, isActive ActivationFunc) {
+	if _, ok := precompileID(addr); !ok {
+		panic(fmt.Sprintf("address %s cannot be used by precompiled contracts", addr.String()))
+	}
+	r.entries[addr] = append(r.entries[addr], precompileEntry{contract: contract, isActive: isActive})
+	r.checkGoPrecompileCount()
+}
+
+// checkGoPrecompileCount panics if the addresses registered to r and the predefined system contracts at
+// precompiled addresses may be more than MaxGoPrecompiles, such that fillGoPrecompiles would fail at runtime
+func (r *PrecompileRegistry) checkGoPrecompileCount() {
+	count := len(r.entries)
+	for addr := range PredefinedContractManager {
+		if _, ok := precompileID(addr); ok {
+			count++
+		}
+	}
+	if count > MaxGoPrecompiles {
+		panic(fmt.Sprintf("more than %d precompiled contracts are implemented in Go", MaxGoPrecompiles))
+	}
+}
+
+// Get returns the version of the precompiled contract at addr which is active in the block of ctx
+func (r *PrecompileRegistry) Get(ctx *types.Context, addr common.Address) (vm.PrecompiledContract, bool) {
+	entries := r.entries[addr]
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].isActive(ctx) {
+			return entries[i].contract, true
+		}
+	}
+	return nil, false
+}
+
+// ActiveAddresses returns the sorted addresses which have an active precompiled contract in the block of ctx
+func (r *PrecompileRegistry) ActiveAddresses(ctx *types.Context) []common.Address {
+	addrs := make([]common.Address, 0, len(r.entries))
+	for addr := range r.entries {
+		if _, ok := r.Get(ctx, addr); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return string(addrs[i][:]) < string(addrs[j][:])
+	})
+	return addrs
+}
+
+var (
+	sep109ContractAddress = common.Address{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x27, 0x13}
+
+	VrfBatchVerifyContractAddress = common.Address{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x27, 0x20}
+	Ed25519VerifyContractAddress  = common.Address{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x27, 0x21}
+	SchnorrVerifyContractAddress  = common.Address{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x27, 0x22}
+	BchTxProofContractAddress     = common.Address{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x27, 0x23}
+)
+
+// Precompiles is used by all the TxRunners. New precompiled contracts can be registered to it in init functions.
+var Precompiles *PrecompileRegistry
+
+func init() {
+	Precompiles = NewPrecompileRegistry()
+	for addr, contract := range vm.PrecompiledContractsIstanbul {
+		if id, _ := precompileID(addr); id == 2 || id == 3 || id == 4 {
+			continue // sha256, ripemd160 and identity are implemented in C and always active
+		}
+		Precompiles.Register(addr, contract, AlwaysActive)
+	}
+	// Berlin reprices bigModExp with EIP-2565. evmwrap still runs EVMC_ISTANBUL, so this repricing is
+	// the only change brought by the Berlin fork.
+	modExpAddr := common.BytesToAddress([]byte{5})
+	Precompiles.Register(modExpAddr, vm.PrecompiledContractsBerlin[modExpAddr], ActiveAfterBerlinFork)
+	Precompiles.Register(sep109ContractAddress, &VrfVerifyContract{}, ActiveAfterXHedgeFork)
+}
+
+// RegisterBLSPrecompiles enables the BLS12-381 precompiled contracts of EIP-2537, which are not
+// activated by default. It should be called before any transaction is executed.
+func RegisterBLSPrecompiles(isActive ActivationFunc) {
+	for addr, contract := range vm.PrecompiledContractsBLS {
+		Precompiles.Register(addr, contract, isActive)
+	}
+}
+
+// RegisterVrfBatchVerifyContract enables VrfBatchVerifyContract at VrfBatchVerifyContractAddress, which is
+// not activated by default. It should be called before any transaction is executed.
+func RegisterVrfBatchVerifyContract(isActive ActivationFunc) {
+	Precompiles.Register(VrfBatchVerifyContractAddress, &VrfBatchVerifyContract{}, isActive)
+}
+
+// RegisterSignatureVerifyContracts enables Ed25519VerifyContract and SchnorrVerifyContract, which are
+// not activated by default. It should be called before any transaction is executed.
+func RegisterSignatureVerifyContracts(isActive ActivationFunc) {
+	Precompiles.Register(Ed25519VerifyContractAddress, &Ed25519VerifyContract{}, isActive)
+	Precompiles.Register(SchnorrVerifyContractAddress, &SchnorrVerifyContract{}, isActive)
+}
+
+// RegisterBchTxProofContract enables BchTxProofContract at BchTxProofContractAddress, which is not
+// activated by default. It should be called before any transaction is executed.
+func RegisterBchTxProofContract(isActive ActivationFunc) {
+	Precompiles.Register(BchTxProofContractAddress, &BchTxProofContract{}, isActive)
+}
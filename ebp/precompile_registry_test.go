@@ -0,0 +1,146 @@
+package ebp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/log"
+
+	"github.com/smartbch/moeingevm/evmwrap/testcase"
+	"github.com/smartbch/moeingevm/types"
+)
+
+type constGasContract uint64
+
+func (c constGasContract) RequiredGas(input []byte) uint64  { return uint64(c) }
+func (c constGasContract) Run(input []byte) ([]byte, error) { return input, nil }
+
+func TestPrecompileRegistry(t *testing.T) {
+	addr1 := common.HexToAddress("0x2801")
+	addr2 := common.HexToAddress("0x2802")
+	r := NewPrecompileRegistry()
+	r.Register(addr1, constGasContract(100), AlwaysActive)
+	r.Register(addr1, constGasContract(50), ActiveSince(10)) // repriced at height 10
+	r.Register(addr2, constGasContract(200), ActiveAfterXHedgeFork)
+	require.Panics(t, func() {
+		r.Register(common.HexToAddress("0x0100000000000000000000000000000000000001"), constGasContract(1), AlwaysActive)
+	})
+
+	ctx := &types.Context{Height: 9, XHedgeForkBlock: 20}
+	c, ok := r.Get(ctx, addr1)
+	require.True(t, ok)
+	require.Equal(t, uint64(100), c.RequiredGas(nil))
+	_, ok = r.Get(ctx, addr2)
+	require.False(t, ok)
+	require.Equal(t, []common.Address{addr1}, r.ActiveAddresses(ctx))
+
+	ctx.Height = 20
+	c, ok = r.Get(ctx, addr1)
+	require.True(t, ok)
+	require.Equal(t, uint64(50), c.RequiredGas(nil))
+	c, ok = r.Get(ctx, addr2)
+	require.True(t, ok)
+	require.Equal(t, uint64(200), c.RequiredGas(nil))
+	require.Equal(t, []common.Address{addr1, addr2}, r.ActiveAddresses(ctx))
+
+	// the addresses which can be passed to the C environment are limited
+	r = NewPrecompileRegistry()
+	for i := int64(1); i <= MaxGoPrecompiles; i++ {
+		r.Register(common.BigToAddress(big.NewInt(0x3000+i)), constGasContract(1), AlwaysActive)
+	}
+	require.Panics(t, func() {
+		r.Register(common.HexToAddress("0x4000"), constGasContract(1), AlwaysActive)
+	})
+}
+
+// the addresses which have always been precompiled stay precompiled when no contract is registered at them
+func TestUnregisteredPrecompiledAddress(t *testing.T) {
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	prepareAccAndTx(e)
+	newCtx := func() *types.Context { return prepareCtx(trunk) }
+	staking := common.HexToAddress("0x2710")
+	_, ok := PredefinedContractManager[staking]
+	require.False(t, ok)
+	// calling a precompiled address without a contract fails, while calling an empty account succeeds
+	for i, to := range []common.Address{staking, common.HexToAddress("0x2798")} {
+		tx, _ := gethtypes.NewTransaction(uint64(i), to, big.NewInt(0), 100000, big.NewInt(1), nil).WithSignature(e.signer, from1.Bytes())
+		committedTxs := runTxInBlock(e, newCtx, int64(i+1), tx)
+		require.Equal(t, 1, len(committedTxs))
+		require.Equal(t, uint64(i), committedTxs[0].Status)
+	}
+}
+
+func TestDefaultPrecompiles(t *testing.T) {
+	ctx := &types.Context{Height: 9, XHedgeForkBlock: 10}
+	// sha256, ripemd160 and identity are implemented in C
+	require.Equal(t, len(vm.PrecompiledContractsIstanbul)-3, len(Precompiles.ActiveAddresses(ctx)))
+	for id := byte(2); id <= 4; id++ {
+		_, ok := Precompiles.Get(ctx, common.BytesToAddress([]byte{id}))
+		require.False(t, ok)
+	}
+	_, ok := Precompiles.Get(ctx, sep109ContractAddress)
+	require.False(t, ok)
+	ctx.Height = 10
+	require.Equal(t, len(vm.PrecompiledContractsIstanbul)-2, len(Precompiles.ActiveAddresses(ctx)))
+	c, ok := Precompiles.Get(ctx, sep109ContractAddress)
+	require.True(t, ok)
+	require.Equal(t, VRF_VERIFY_GAS, c.RequiredGas(nil))
+}
+
+type precompileVector struct {
+	Input    string
+	Expected string
+	Name     string
+	Gas      uint64
+}
+
+func loadPrecompileVectors(t *testing.T, file string) (vectors []precompileVector) {
+	bz, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(bz, &vectors))
+	return
+}
+
+func TestModExpGasByFork(t *testing.T) {
+	modExpAddr := common.BytesToAddress([]byte{5})
+	ctx := &types.Context{Height: 9, XHedgeForkBlock: 0, BerlinForkBlock: 10}
+	for fork, file := range []string{"testdata/modexp.json", "testdata/modexp_eip2565.json"} {
+		ctx.Height = int64(9 + fork) // before and after the Berlin fork
+		c, ok := Precompiles.Get(ctx, modExpAddr)
+		require.True(t, ok)
+		for _, v := range loadPrecompileVectors(t, file) {
+			input, _ := hex.DecodeString(v.Input)
+			require.Equal(t, v.Gas, c.RequiredGas(input), v.Name)
+			out, err := c.Run(input)
+			require.NoError(t, err)
+			require.Equal(t, v.Expected, hex.EncodeToString(out), v.Name)
+		}
+	}
+}
+
+func TestRegisterBLSPrecompiles(t *testing.T) {
+	defer func() {
+		for addr := range vm.PrecompiledContractsBLS {
+			delete(Precompiles.entries, addr)
+		}
+	}()
+	RegisterBLSPrecompiles(ActiveSince(100))
+	ctx := &types.Context{Height: 99, XHedgeForkBlock: 0}
+	n := len(Precompiles.ActiveAddresses(ctx))
+	for addr := range vm.PrecompiledContractsBLS {
+		_, ok := Precompiles.Get(ctx, addr)
+		require.False(t, ok)
+	}
+	ctx.Height = 100
+	require.Equal(t, n+len(vm.PrecompiledContractsBLS), len(Precompiles.ActiveAddresses(ctx)))
+}
@@ -0,0 +1,138 @@
+package ebp
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartbch/moeingevm/types"
+)
+
+func mustHex(s string) []byte {
+	bz, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return bz
+}
+
+// schnorrSign is the BCH Schnorr signing algorithm, with a caller-provided nonce k
+func schnorrSign(privKey *btcec.PrivateKey, msgHash []byte, k *big.Int) []byte {
+	curve := btcec.S256()
+	rx, ry := curve.ScalarBaseMult(k.Bytes())
+	if big.Jacobi(ry, curve.P) != 1 {
+		k = new(big.Int).Sub(curve.N, k)
+	}
+	var sig [64]byte
+	rx.FillBytes(sig[:32])
+	h := sha256.New()
+	h.Write(sig[:32])
+	h.Write(privKey.PubKey().SerializeCompressed())
+	h.Write(msgHash)
+	e := new(big.Int).SetBytes(h.Sum(nil))
+	s := e.Mul(e, privKey.D)
+	s.Add(s, k)
+	s.Mod(s, curve.N)
+	s.FillBytes(sig[32:])
+	return sig[:]
+}
+
+func TestEd25519VerifyContract(t *testing.T) {
+	// test 2 of RFC 8032
+	pubKey := mustHex("3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c")
+	msg := mustHex("72")
+	sig := mustHex("92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da" +
+		"085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00")
+	input := append(append(append([]byte{}, pubKey...), sig...), msg...)
+	c := &Ed25519VerifyContract{}
+	require.Equal(t, ED25519_VERIFY_GAS+97*ED25519_VERIFY_GAS_PER_BYTE, c.RequiredGas(input))
+	out, err := c.Run(input)
+	require.NoError(t, err)
+	require.Equal(t, boolToWord(true), out)
+
+	input[len(input)-1] ^= 1
+	out, err = c.Run(input)
+	require.NoError(t, err)
+	require.Equal(t, boolToWord(false), out)
+
+	_, err = c.Run(input[:95])
+	require.Error(t, err)
+
+	_, privKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	msg = make([]byte, 1000)
+	sig = ed25519.Sign(privKey, msg)
+	out, err = c.Run(append(append(append([]byte{}, privKey.Public().(ed25519.PublicKey)...), sig...), msg...))
+	require.NoError(t, err)
+	require.Equal(t, boolToWord(true), out)
+}
+
+func TestSchnorrVerifyContract(t *testing.T) {
+	c := &SchnorrVerifyContract{}
+	// test vectors of the Schnorr specification of Bitcoin Cash (2019-05-15)
+	vectors := []struct {
+		pubKey, msgHash, sig string
+	}{
+		{"0279BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"787A848E71043D280C50470E8E1532B2DD5D20EE912A45DBDD2BD1DFBF187EF6" +
+				"7031A98831859DC34DFFEEDDA86831842CCD0079E1F92AF177F7F22CC1DCED05"},
+		{"02DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"2A298DACAE57395A15D0795DDBFD1DCB564DA82B0F269BC70A74F8220429BA1D" +
+				"1E51A22CCEC35599B8F266912281F8365FFC2D035A230434A1A64DC59F7013FD"},
+	}
+	for _, v := range vectors {
+		input := append(append(mustHex(v.msgHash), mustHex(v.pubKey)...), mustHex(v.sig)...)
+		require.Equal(t, SCHNORR_VERIFY_GAS, c.RequiredGas(input))
+		out, err := c.Run(input)
+		require.NoError(t, err)
+		require.Equal(t, boolToWord(true), out)
+		input[0] ^= 1
+		out, err = c.Run(input)
+		require.NoError(t, err)
+		require.Equal(t, boolToWord(false), out)
+	}
+
+	privKey, err := btcec.NewPrivateKey(btcec.S256())
+	require.NoError(t, err)
+	msgHash := sha256.Sum256([]byte("hello"))
+	for k := int64(1); k <= 4; k++ { // both parities of R.y are covered
+		sig := schnorrSign(privKey, msgHash[:], big.NewInt(k))
+		require.True(t, SchnorrVerify(msgHash[:], privKey.PubKey(), sig))
+		sig[63] ^= 1
+		require.False(t, SchnorrVerify(msgHash[:], privKey.PubKey(), sig))
+	}
+	sig := schnorrSign(privKey, msgHash[:], big.NewInt(5))
+	copy(sig[:32], btcec.S256().P.Bytes()) // r >= p
+	require.False(t, SchnorrVerify(msgHash[:], privKey.PubKey(), sig))
+
+	_, err = c.Run(make([]byte, 32+33+63))
+	require.Error(t, err)
+	_, err = c.Run(make([]byte, 32+33+64)) // invalid public key
+	require.Error(t, err)
+}
+
+func TestRegisterSignatureVerifyContracts(t *testing.T) {
+	defer delete(Precompiles.entries, Ed25519VerifyContractAddress)
+	defer delete(Precompiles.entries, SchnorrVerifyContractAddress)
+	RegisterSignatureVerifyContracts(ActiveSince(10))
+	ctx := &types.Context{Height: 9}
+	for _, addr := range []common.Address{Ed25519VerifyContractAddress, SchnorrVerifyContractAddress} {
+		_, ok := Precompiles.Get(ctx, addr)
+		require.False(t, ok)
+	}
+	ctx.Height = 10
+	c, ok := Precompiles.Get(ctx, Ed25519VerifyContractAddress)
+	require.True(t, ok)
+	require.IsType(t, &Ed25519VerifyContract{}, c)
+	c, ok = Precompiles.Get(ctx, SchnorrVerifyContractAddress)
+	require.True(t, ok)
+	require.IsType(t, &SchnorrVerifyContract{}, c)
+}
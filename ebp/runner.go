@@ -1,14 +1,18 @@
 package ebp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"runtime"
+	"sort"
 	"sync/atomic"
 	"unsafe"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/holiman/uint256"
+	"github.com/smartbch/moeingads/store/rabbit"
 
 	"github.com/smartbch/moeingevm/types"
 	"github.com/smartbch/moeingevm/utils"
@@ -47,11 +51,48 @@ func RegisterPredefinedContract(ctx *types.Context, address common.Address, exec
 	if !executor.IsSystemContract(address) {
 		panic(fmt.Sprintf("contract %s is not system contract", address.String()))
 	}
+	Precompiles.checkGoPrecompileCount()
 	executor.Init(ctx)
 }
 
+type ContractMigration struct {
+	Address     common.Address
+	FromVersion uint64
+}
+
+// The migrations of predefined contracts scheduled at each height, see ScheduleMigration
+var PredefinedContractMigrations map[int64][]ContractMigration
+
+// ScheduleMigration makes the engine call the Migrate method of the predefined contract at 'address'
+// at the beginning of the block whose height is 'height', that is, when the Height of the context set for
+// Execute is 'height'. The contract must implement types.Migrator.
+func ScheduleMigration(address common.Address, height int64, fromVersion uint64) {
+	executor, ok := PredefinedContractManager[address]
+	if !ok {
+		panic(fmt.Sprintf("contract %s is not predefined", address.String()))
+	}
+	if _, ok := executor.(types.Migrator); !ok {
+		panic(fmt.Sprintf("contract %s does not support migration", address.String()))
+	}
+	PredefinedContractMigrations[height] = append(PredefinedContractMigrations[height],
+		ContractMigration{Address: address, FromVersion: fromVersion})
+}
+
+// The addresses of the predefined contracts in a deterministic order
+func sortedPredefinedContracts() []common.Address {
+	addrs := make([]common.Address, 0, len(PredefinedContractManager))
+	for addr := range PredefinedContractManager {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return bytes.Compare(addrs[i][:], addrs[j][:]) < 0
+	})
+	return addrs
+}
+
 func init() {
 	PredefinedContractManager = make(map[common.Address]types.SystemContractExecutor)
+	PredefinedContractMigrations = make(map[int64][]ContractMigration)
 }
 
 // This is a global variable. The parameter 'collector_handler' passed to zero_depth_call_wrap is
@@ -121,6 +162,11 @@ type TxRunner struct {
 	InternalTxReturns []types.InternalTxReturn
 
 	RwLists *types.ReadWriteLists
+
+	currBlock *types.BlockInfo
+	// the snapshots of Ctx taken before the successful calls to Go-implemented precompiled contracts,
+	// which are popped when the C environment reverts these calls
+	precompileSnapshots []int
 }
 
 func NewTxRunner(ctx *types.Context, tx *types.TxToRun) *TxRunner {
@@ -163,6 +209,19 @@ func writeCBytes20WithArray(arr *evmc_address, bz [20]byte) {
 	}
 }
 
+// isPrecompiledAddress asks evmwrap whether addr is a precompiled contract, with the same configuration
+// as fillGoPrecompiles passes to it
+func isPrecompiledAddress(ctx *types.Context, addr common.Address) bool {
+	if _, ok := precompileID(addr); !ok {
+		return false
+	}
+	var bi block_info
+	fillGoPrecompiles(&bi, ctx)
+	var cAddr evmc_address
+	writeCBytes20WithArray(&cAddr, addr)
+	return bool(C.is_precompiled_address_wrap(&cAddr, &bi.cfg))
+}
+
 //Following are some getter/setter functions which provide world state to the C environment and
 //apply the changes made by the C environment to world state.
 
@@ -220,6 +279,11 @@ func (runner *TxRunner) changeAccount(chg_acc *changed_account) {
 		binary.BigEndian.PutUint64(acc.NonceSlice(), uint64(chg_acc.nonce))
 		binary.BigEndian.PutUint64(acc.SequenceSlice(), uint64(chg_acc.sequence))
 		writeSliceWithCBytes32(acc.BalanceSlice(), &chg_acc.balance)
+		if seq := acc.Sequence(); seq != math.MaxUint64 && runner.Ctx.IsSeqIndexFork() { // a new sequence is assigned by set_bytecode
+			if oldAcc := runner.Ctx.GetAccount(addr); oldAcc == nil || oldAcc.Sequence() != seq {
+				runner.Ctx.SetAddressOfSequence(seq, addr)
+			}
+		}
 		runner.Ctx.Rbt.Set(k, acc.Bytes())
 	}
 	if !EnableRWList {
@@ -318,11 +382,11 @@ func (runner *TxRunner) getBlockHash(num C.uint64_t) (result evmc_bytes32) {
 }
 
 // Refund gas fee to the sender according to the real consumed gas
-func (runner *TxRunner) refundGasFee(ret_value *evmc_result, refund C.uint64_t) {
+func (runner *TxRunner) refundGasFee(gasLeft, refund uint64) {
 	if runner.ForRpc {
 		return
 	}
-	gasUsed := runner.Tx.Gas - uint64(ret_value.gas_left)
+	gasUsed := runner.Tx.Gas - gasLeft
 	if AdjustGasUsed {
 		if gasUsed*4 < runner.Tx.Gas {
 			gasUsed = runner.Tx.Gas
@@ -404,7 +468,7 @@ func convertTxReturns(data_ptr C.size_t, ret *internal_tx_return) (txReturn type
 func (runner *TxRunner) collectResult(result *all_changed, ret_value *evmc_result) {
 	if result == nil {
 		runner.Status = int(ret_value.status_code)
-		runner.refundGasFee(ret_value, 0)
+		runner.refundGasFee(uint64(ret_value.gas_left), 0)
 		return
 	}
 	runner.OutData = C.GoBytes(unsafe.Pointer(ret_value.output_data), C.int(ret_value.output_size))
@@ -458,7 +522,7 @@ func (runner *TxRunner) collectResult(result *all_changed, ret_value *evmc_resul
 		}
 	}
 	runner.Status = int(ret_value.status_code)
-	runner.refundGasFee(ret_value, result.refund)
+	runner.refundGasFee(uint64(ret_value.gas_left), uint64(result.refund))
 	runner.CreatedContractAddress = toAddress(&ret_value.create_address)
 }
 
@@ -520,17 +584,16 @@ func runTxHelper(idx int, currBlock *types.BlockInfo, estimateGas bool) int64 {
 	}
 	acc, err := runner.Ctx.CheckNonce(runner.Tx.From, runner.Tx.Nonce)
 	if !runner.ForRpc && err != nil { // For RPC, we do not care about sender and its nonce
-		if err == types.ErrAccountNotExist {
-			runner.Status = types.ACCOUNT_NOT_EXIST
-		} else if err == types.ErrNonceTooLarge {
-			runner.Status = types.TX_NONCE_TOO_LARGE
-		} else if err == types.ErrNonceTooSmall {
-			runner.Status = types.TX_NONCE_TOO_SMALL
-		} else {
+		status, ok := types.ErrorToStatus(err)
+		if !ok {
 			panic("Unknown Error")
 		}
+		runner.Status = int(status)
 		return 0
 	}
+	if executor, exist := PredefinedContractManager[runner.Tx.To]; exist {
+		return runner.runSystemContractTx(executor, acc, currBlock)
+	}
 	if acc != nil {
 		// GasFee was deducted in Prepare(), so here we just increase the nonce
 		acc.UpdateNonce(acc.Nonce() + 1)
@@ -549,21 +612,20 @@ func runTxHelper(idx int, currBlock *types.BlockInfo, estimateGas bool) int64 {
 	bi.timestamp = C.int64_t(currBlock.Timestamp)
 	bi.gas_limit = C.int64_t(currBlock.GasLimit)
 	bi.cfg.after_xhedge_fork = C.bool(runner.Ctx.IsXHedgeFork())
+	fillGoPrecompiles(&bi, runner.Ctx)
 	writeCBytes32WithSlice(&bi.difficulty, currBlock.Difficulty[:])
 	writeCBytes32WithSlice(&bi.chain_id, currBlock.ChainId[:])
 	data_ptr := (*C.uint8_t)(nil)
 	if len(runner.Tx.Data) != 0 {
 		data_ptr = (*C.uint8_t)(unsafe.Pointer(&runner.Tx.Data[0]))
 	}
-	if executor, exist := PredefinedContractManager[runner.Tx.To]; exist {
-		status, logs, gasUsed, out := executor.Execute(runner.Ctx, currBlock, runner.Tx)
-		runner.Status = status
-		runner.Logs = logs
-		runner.GasUsed = gasUsed
-		runner.OutData = out
-		return int64(gasUsed)
+	if runner.runNativeTokenTx() {
+		return 0
 	}
 
+	runner.currBlock = currBlock
+	runner.precompileSnapshots = runner.precompileSnapshots[:0]
+	runner.Ctx.StartJournal()
 	gasEstimated := C.zero_depth_call_wrap(gas_price,
 		C.int64_t(runner.Tx.Gas),
 		&to,
@@ -575,59 +637,65 @@ func runTxHelper(idx int, currBlock *types.BlockInfo, estimateGas bool) int64 {
 		C.int(idx),
 		C.bool(estimateGas),
 		C.EVMC_ISTANBUL)
+	runner.Ctx.StopJournal()
 	return int64(gasEstimated)
 }
 
+// Run a TX sent to a predefined contract. The executor runs in a nested layer over the same base store as
+// runner.Ctx, which replaces runner.Ctx if the execution succeeds, and is discarded otherwise such that the
+// failed TX only increases the sender's nonce. Then the gas fee is refunded in the same way as EVM TXs.
+func (runner *TxRunner) runSystemContractTx(executor types.SystemContractExecutor, acc *types.AccountInfo,
+	currBlock *types.BlockInfo) int64 {
+	if acc != nil {
+		// GasFee was deducted in Prepare(), so here we just increase the nonce
+		acc.UpdateNonce(acc.Nonce() + 1)
+	}
+	ctx := runner.Ctx.WithNestedRbt()
+	if acc != nil {
+		ctx.SetAccount(runner.Tx.From, acc)
+	}
+	status, logs, gasUsed, out := executor.Execute(ctx, currBlock, runner.Tx)
+	if status == int(types.StatusSuccess) && !runner.ForRpc {
+		runner.Ctx.Close(false)
+		runner.Ctx = ctx
+	} else {
+		runner.loadTouchedKeys(ctx)
+		ctx.Close(false)
+		if acc != nil {
+			runner.Ctx.SetAccount(runner.Tx.From, acc)
+		}
+		if status != int(types.StatusSuccess) {
+			logs = nil
+		}
+	}
+	runner.Status = status
+	runner.Logs = logs
+	runner.OutData = out
+	if gasUsed > runner.Tx.Gas {
+		gasUsed = runner.Tx.Gas
+	}
+	runner.GasUsed = gasUsed
+	runner.refundGasFee(runner.Tx.Gas-gasUsed, 0)
+	return int64(gasUsed)
+}
+
+// Read the keys touched by the discarded nested layer ctx into runner.Ctx, such that checkTxDepsAndUptStandbyQ
+// can find the conflicts between them and the keys written by the former TXs in the same round. The cache of
+// RabbitStore only has the short keys, and the original keys are found in the entries of the base store.
+func (runner *TxRunner) loadTouchedKeys(ctx *types.Context) {
+	parent := ctx.Rbt.GetBaseStore()
+	ctx.Rbt.ScanAllShortKeys(func(key [rabbit.KeySize]byte, _ bool) bool {
+		if bz := parent.Get(key[:]); bz != nil {
+			runner.Ctx.Rbt.Get(rabbit.BytesToCachedValue(bz).GetKey())
+		}
+		return false
+	})
+}
+
 func StatusIsFailure(status int) bool {
 	return status != int(C.EVMC_SUCCESS)
 }
 
 func StatusToStr(status int) string {
-	switch status {
-	case int(C.EVMC_SUCCESS):
-		return "success"
-	case int(C.EVMC_FAILURE):
-		return "failure"
-	case int(C.EVMC_REVERT):
-		return "revert"
-	case int(C.EVMC_OUT_OF_GAS):
-		return "out-of-gas"
-	case int(C.EVMC_INVALID_INSTRUCTION):
-		return "invalid-instruction"
-	case int(C.EVMC_UNDEFINED_INSTRUCTION):
-		return "undefined-instruction"
-	case int(C.EVMC_STACK_OVERFLOW):
-		return "stack-overflow"
-	case int(C.EVMC_STACK_UNDERFLOW):
-		return "stack-underflow"
-	case int(C.EVMC_BAD_JUMP_DESTINATION):
-		return "bad-jump-destination"
-	case int(C.EVMC_INVALID_MEMORY_ACCESS):
-		return "invalid-memory-access"
-	case int(C.EVMC_CALL_DEPTH_EXCEEDED):
-		return "call-depth-exceeded"
-	case int(C.EVMC_STATIC_MODE_VIOLATION):
-		return "static-mode-violation"
-	case int(C.EVMC_PRECOMPILE_FAILURE):
-		return "precompile-failure"
-	case int(C.EVMC_CONTRACT_VALIDATION_FAILURE):
-		return "contract-validation-failure"
-	case int(C.EVMC_ARGUMENT_OUT_OF_RANGE):
-		return "argument-out-of-range"
-	case int(C.EVMC_INSUFFICIENT_BALANCE):
-		return "insufficient-balance"
-	case int(C.EVMC_INTERNAL_ERROR):
-		return "internal-error"
-	case int(C.EVMC_REJECTED):
-		return "rejected"
-	case int(C.EVMC_OUT_OF_MEMORY):
-		return "out-of-memory"
-	case types.IGNORE_TOO_OLD_TX:
-		return "too-old-and-ignored"
-	case types.ACCOUNT_NOT_EXIST:
-		return "account-not-exist"
-	case types.TX_NONCE_TOO_SMALL:
-		return "nonce-too-small"
-	}
-	return "unknown"
+	return types.Status(status).String()
 }
@@ -0,0 +1,334 @@
+package ebp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+
+	"github.com/smartbch/moeingevm/types"
+)
+
+// This file is a Go reference implementation of SEP206, the ERC20 facade of the native token BCH at
+// Sep206Address. The contract is executed by evmwrap in C++ (see evmwrap/host_bridge/host_context.cpp),
+// and RunSep206 must produce exactly the same results. The balances are the accounts' BCH balances, and
+// each allowance is stored as a 72-byte entry (32-byte allowance, 20-byte owner, 20-byte spender) in the
+// storage of Sep206Sequence, under the key sha256(abi.encode(owner, spender)).
+
+// Must be the same as SEP206_SEQUENCE in evmwrap
+const Sep206Sequence uint64 = 2000
+
+const (
+	SelectorName              uint32 = 0x06fdde03 // name()
+	SelectorSymbol            uint32 = 0x95d89b41 // symbol()
+	SelectorDecimals          uint32 = 0x313ce567 // decimals()
+	SelectorTotalSupply       uint32 = 0x18160ddd // totalSupply()
+	SelectorBalanceOf         uint32 = 0x70a08231 // balanceOf(address)
+	SelectorAllowance         uint32 = 0xdd62ed3e // allowance(address,address)
+	SelectorIncreaseAllowance uint32 = 0x39509351 // increaseAllowance(address,uint256)
+	SelectorDecreaseAllowance uint32 = 0xa457c2d7 // decreaseAllowance(address,uint256)
+)
+
+// The gas costs of SEP206's functions, which must be the same as evmwrap's
+var sep206Gas = map[uint32]uint64{
+	SelectorName:              3000,
+	SelectorSymbol:            3000,
+	SelectorDecimals:          1000,
+	SelectorTotalSupply:       1000,
+	SelectorBalanceOf:         20000,
+	SelectorAllowance:         20000,
+	SelectorApprove:           25000,
+	SelectorIncreaseAllowance: 31000,
+	SelectorDecreaseAllowance: 31000,
+	SelectorTransfer:          32000,
+	SelectorTransferFrom:      40000,
+}
+
+const sep206AllowanceEntrySize = 32 + 20 + 20
+
+var (
+	// 21 million BCH with 18 decimals
+	Sep206TotalSupply = uint256.NewInt(0).Mul(uint256.NewInt(2100*10000), uint256.NewInt(1000000000000000000))
+	// after the XHedge fork, transferFrom must leave 0.001 BCH in the owner's account
+	sep206TransferFromMargin = uint256.NewInt(1000 * 1000 * 1000 * 1000 * 1000)
+)
+
+// Sep206Result is the result of running SEP206 in Go. The failed calls consume all the gas. Refund is the
+// SSTORE refund of EIP-2200 for deleting allowance entries, assuming the entries were not changed earlier
+// in the same transaction.
+type Sep206Result struct {
+	Status  types.Status
+	OutData []byte
+	Logs    []types.EvmLog
+	GasLeft uint64
+	Refund  uint64
+}
+
+func sep206Failure(status types.Status) *Sep206Result {
+	return &Sep206Result{Status: status}
+}
+
+func sep206Success(out []byte, logs []types.EvmLog, gasLeft uint64) *Sep206Result {
+	return &Sep206Result{Status: types.StatusSuccess, OutData: out, Logs: logs, GasLeft: gasLeft}
+}
+
+func sep206SuccessWithRefund(out []byte, logs []types.EvmLog, gasLeft, refund uint64) *Sep206Result {
+	res := sep206Success(out, logs, gasLeft)
+	res.Refund = refund
+	return res
+}
+
+func Sep206AllowanceKey(owner, spender common.Address) string {
+	return sep206AllowanceKeyFromArgs(common.LeftPadBytes(owner[:], 32), common.LeftPadBytes(spender[:], 32))
+}
+
+// The key is calculated from the ABI-encoded arguments as they are, just like evmwrap does
+func sep206AllowanceKeyFromArgs(owner, spender []byte) string {
+	key := sha256.Sum256(append(append([]byte{}, owner...), spender...))
+	return string(key[:])
+}
+
+func getSep206Allowance(ctx *types.Context, key string) *uint256.Int {
+	entry := ctx.GetStorageAt(Sep206Sequence, key)
+	if len(entry) < 32 {
+		return uint256.NewInt(0)
+	}
+	return uint256.NewInt(0).SetBytes32(entry[:32])
+}
+
+// GetSep206Allowance returns the amount of BCH that spender can transfer from owner through SEP206
+func GetSep206Allowance(ctx *types.Context, owner, spender common.Address) *uint256.Int {
+	return getSep206Allowance(ctx, Sep206AllowanceKey(owner, spender))
+}
+
+// An allowance entry is deleted when the allowance becomes zero, which gets the SSTORE refund if the
+// entry existed
+func setSep206Allowance(ctx *types.Context, key string, owner, spender common.Address, allowance *uint256.Int) (refund uint64) {
+	if allowance.IsZero() {
+		if len(ctx.GetStorageAt(Sep206Sequence, key)) != 0 {
+			refund = sstoreClearRefund
+		}
+		ctx.DeleteStorageAt(Sep206Sequence, key)
+		return
+	}
+	entry := make([]byte, 0, sep206AllowanceEntrySize)
+	entry = append(entry, allowance.PaddedBytes(32)...)
+	entry = append(entry, owner[:]...)
+	entry = append(entry, spender[:]...)
+	ctx.SetStorageAt(Sep206Sequence, key, entry)
+	return 0
+}
+
+// sep206TransferBCH follows the transfer function of evmwrap, including the handling of EIP158. The caller
+// must make sure that the balance of 'from' is enough. It returns true if nothing happens.
+func sep206TransferBCH(ctx *types.Context, from, to common.Address, amount *uint256.Int) (isNop bool) {
+	toAcc := ctx.GetAccount(to)
+	if toAcc == nil {
+		if amount.IsZero() && !isPrecompiledAddress(ctx, to) {
+			return true
+		}
+		toAcc = types.ZeroAccountInfo()
+		// the same sequence as a new account created by evmwrap
+		binary.BigEndian.PutUint64(toAcc.SequenceSlice(), math.MaxUint64)
+	}
+	if amount.IsZero() {
+		if toAcc.Nonce() == 0 && toAcc.Balance().IsZero() && !hasBytecode(ctx, to) {
+			ctx.DeleteAccount(to) // eip158
+		}
+		return false
+	}
+	fromAcc := ctx.GetAccount(from)
+	fromAcc.UpdateBalance(uint256.NewInt(0).Sub(fromAcc.Balance(), amount))
+	ctx.SetAccount(from, fromAcc)
+	if to == from {
+		toAcc = fromAcc
+	}
+	toAcc.UpdateBalance(uint256.NewInt(0).Add(toAcc.Balance(), amount))
+	ctx.SetAccount(to, toAcc)
+	return false
+}
+
+func hasBytecode(ctx *types.Context, addr common.Address) bool {
+	bi := ctx.GetCode(addr)
+	return bi != nil && len(bi.BytecodeSlice()) != 0
+}
+
+func getBalance(ctx *types.Context, addr common.Address) *uint256.Int {
+	acc := ctx.GetAccount(addr)
+	if acc == nil {
+		return uint256.NewInt(0)
+	}
+	return acc.Balance()
+}
+
+// RunSep206 runs a call to SEP206 from sender, which must not be a DELEGATECALL or CALLCODE. The value
+// sent with the call must have been transferred to Sep206Address before.
+func RunSep206(ctx *types.Context, sender common.Address, input []byte, gas uint64, isStatic bool) *Sep206Result {
+	if len(input) < 4 {
+		return sep206Failure(types.StatusPrecompileFailure)
+	}
+	selector := binary.BigEndian.Uint32(input[:4])
+	requiredGas, ok := sep206Gas[selector]
+	if !ok {
+		return sep206Failure(types.StatusPrecompileFailure)
+	}
+	if requiredGas > gas {
+		return sep206Failure(types.StatusOutOfGas)
+	}
+	gas -= requiredGas
+	switch selector {
+	case SelectorApprove, SelectorIncreaseAllowance, SelectorDecreaseAllowance, SelectorTransfer, SelectorTransferFrom:
+		if isStatic {
+			return sep206Failure(types.StatusPrecompileFailure)
+		}
+	}
+	switch selector {
+	case SelectorName, SelectorSymbol:
+		return sep206Success(abiEncodeString("BCH"), nil, gas)
+	case SelectorDecimals:
+		return sep206Success(uint256.NewInt(18).PaddedBytes(32), nil, gas)
+	case SelectorTotalSupply:
+		return sep206Success(Sep206TotalSupply.PaddedBytes(32), nil, gas)
+	case SelectorBalanceOf:
+		if len(input) != 4+32 {
+			return sep206Failure(types.StatusPrecompileFailure)
+		}
+		owner := common.BytesToAddress(input[4+12 : 4+32])
+		return sep206Success(getBalance(ctx, owner).PaddedBytes(32), nil, gas)
+	case SelectorAllowance:
+		if len(input) != 4+64 {
+			return sep206Failure(types.StatusPrecompileFailure)
+		}
+		key := sep206AllowanceKeyFromArgs(input[4:4+32], input[4+32:4+64])
+		return sep206Success(getSep206Allowance(ctx, key).PaddedBytes(32), nil, gas)
+	case SelectorApprove:
+		return sep206Approve(ctx, sender, input, gas, true, false)
+	case SelectorIncreaseAllowance:
+		return sep206Approve(ctx, sender, input, gas, false, true)
+	case SelectorDecreaseAllowance:
+		return sep206Approve(ctx, sender, input, gas, false, false)
+	case SelectorTransfer:
+		return sep206Transfer(ctx, sender, input, gas)
+	default: // SelectorTransferFrom
+		return sep206TransferFrom(ctx, sender, input, gas)
+	}
+}
+
+func sep206Approve(ctx *types.Context, owner common.Address, input []byte, gas uint64, newValue, increase bool) *Sep206Result {
+	if len(input) != 4+64 {
+		return sep206Failure(types.StatusPrecompileFailure)
+	}
+	spender := common.BytesToAddress(input[4+12 : 4+32])
+	key := Sep206AllowanceKey(owner, spender)
+	allowance := uint256.NewInt(0).SetBytes32(input[4+32 : 4+64])
+	if !newValue {
+		delta := allowance
+		allowance = getSep206Allowance(ctx, key)
+		if increase {
+			var overflow bool
+			allowance, overflow = allowance.AddOverflow(allowance, delta)
+			if overflow {
+				allowance.SetAllOne()
+			}
+		} else if allowance.Gt(delta) {
+			allowance.Sub(allowance, delta)
+		} else {
+			allowance.Clear()
+		}
+	}
+	refund := setSep206Allowance(ctx, key, owner, spender, allowance)
+	logs := []types.EvmLog{makeSep206Log(ApprovalEventTopic, owner, spender, allowance)}
+	return sep206SuccessWithRefund(boolToWord(true), logs, gas, refund)
+}
+
+func sep206Transfer(ctx *types.Context, sender common.Address, input []byte, gas uint64) *Sep206Result {
+	if len(input) != 4+64 {
+		return sep206Failure(types.StatusPrecompileFailure)
+	}
+	to := common.BytesToAddress(input[4+12 : 4+32])
+	amount := uint256.NewInt(0).SetBytes32(input[4+32 : 4+64])
+	if getBalance(ctx, sender).Lt(amount) {
+		return sep206Failure(types.StatusInsufficientBalance)
+	}
+	var logs []types.EvmLog
+	if !sep206TransferBCH(ctx, sender, to, amount) {
+		logs = append(logs, makeSep206Log(TransferEventTopic, sender, to, amount))
+	}
+	return sep206Success(boolToWord(true), logs, gas)
+}
+
+func sep206TransferFrom(ctx *types.Context, spender common.Address, input []byte, gas uint64) *Sep206Result {
+	if len(input) != 4+96 {
+		return sep206Failure(types.StatusPrecompileFailure)
+	}
+	owner := common.BytesToAddress(input[4+12 : 4+32])
+	to := common.BytesToAddress(input[4+32+12 : 4+64])
+	amount := uint256.NewInt(0).SetBytes32(input[4+64 : 4+96])
+	required := amount.Clone()
+	if ctx.IsXHedgeFork() {
+		required.Add(required, sep206TransferFromMargin) // wraps around on overflow, just like evmwrap
+	}
+	if getBalance(ctx, owner).Lt(required) {
+		return sep206Failure(types.StatusInsufficientBalance)
+	}
+	key := Sep206AllowanceKey(owner, spender)
+	allowance := getSep206Allowance(ctx, key)
+	if allowance.Lt(amount) {
+		return sep206Failure(types.StatusPrecompileFailure)
+	}
+	var logs []types.EvmLog
+	var refund uint64
+	if !sep206TransferBCH(ctx, owner, to, amount) {
+		logs = append(logs, makeSep206Log(TransferEventTopic, owner, to, amount))
+		refund = setSep206Allowance(ctx, key, owner, spender, allowance.Sub(allowance, amount))
+	}
+	return sep206SuccessWithRefund(boolToWord(true), logs, gas, refund)
+}
+
+func makeSep206Log(topic common.Hash, addr1, addr2 common.Address, amount *uint256.Int) types.EvmLog {
+	log := makeTokenLog(topic, addr1, addr2, amount)
+	log.Address = Sep206Address
+	return log
+}
+
+// the ABI encoding of a string, which is not longer than 255 bytes
+func abiEncodeString(s string) []byte {
+	out := make([]byte, 64+(len(s)+31)/32*32)
+	out[31] = 32 // the offset pointer
+	out[63] = byte(len(s))
+	copy(out[64:], s)
+	return out
+}
+
+// sep206Spending returns the amount of BCH that a successful call to SEP206 transfers out of sender's account
+func sep206Spending(sender common.Address, data []byte) *uint256.Int {
+	if len(data) < 4 {
+		return uint256.NewInt(0)
+	}
+	switch binary.BigEndian.Uint32(data[:4]) {
+	case SelectorTransfer:
+		if len(data) == 4+64 {
+			return uint256.NewInt(0).SetBytes32(data[4+32 : 4+64])
+		}
+	case SelectorTransferFrom:
+		if len(data) == 4+96 && common.BytesToAddress(data[4+12:4+32]) == sender {
+			return uint256.NewInt(0).SetBytes32(data[4+64 : 4+96])
+		}
+	}
+	return uint256.NewInt(0)
+}
+
+// totalSpending returns the value of a transaction, plus the amount transferred out of the sender by SEP206
+// if the transaction calls it. The result is clamped to the maximum of uint256.
+func totalSpending(sender common.Address, to common.Address, value [32]byte, data []byte) [32]byte {
+	if to != Sep206Address {
+		return value
+	}
+	total, overflow := uint256.NewInt(0).AddOverflow(uint256.NewInt(0).SetBytes32(value[:]), sep206Spending(sender, data))
+	if overflow {
+		total.SetAllOne()
+	}
+	return total.Bytes32()
+}
@@ -0,0 +1,223 @@
+package ebp
+
+import (
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/holiman/uint256"
+	"github.com/smartbch/moeingads/store"
+	"github.com/smartbch/moeingads/store/rabbit"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/log"
+
+	"github.com/smartbch/moeingevm/evmwrap/testcase"
+	"github.com/smartbch/moeingevm/types"
+)
+
+func sep206Call(selector uint32, args ...interface{}) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, selector)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case common.Address:
+			data = append(data, common.LeftPadBytes(v[:], 32)...)
+		case *uint256.Int:
+			data = append(data, v.PaddedBytes(32)...)
+		case uint64:
+			data = append(data, uint256.NewInt(v).PaddedBytes(32)...)
+		}
+	}
+	return data
+}
+
+type sep206TestCall struct {
+	sender common.Address
+	data   []byte
+}
+
+func sep206TestCalls() []sep206TestCall {
+	maxUint := uint256.NewInt(0).SetAllOne()
+	empty := common.HexToAddress("0x99")
+	precompile := common.HexToAddress("0x5")
+	return []sep206TestCall{
+		{from1, sep206Call(SelectorName)},
+		{from1, sep206Call(SelectorSymbol)},
+		{from1, sep206Call(SelectorDecimals)},
+		{from1, sep206Call(SelectorTotalSupply)},
+		{from1, sep206Call(SelectorBalanceOf, from2)},
+		{from1, sep206Call(SelectorBalanceOf, from2, from1)}, // wrong length
+		{from1, sep206Call(0x12345678)},                      // wrong selector
+		{from1, sep206Call(SelectorTransfer, to1, uint64(1000))},
+		{from1, sep206Call(SelectorTransfer, to1, maxUint)}, // insufficient balance
+		{from1, sep206Call(SelectorTransfer, empty, uint64(0))},
+		{from1, sep206Call(SelectorTransfer, precompile, uint64(0))},
+		{from1, sep206Call(SelectorTransfer, from1, uint64(10))},
+		{from1, sep206Call(SelectorApprove, from2, uint64(5000))},
+		{from2, sep206Call(SelectorAllowance, from1, from2)},
+		{from1, sep206Call(SelectorIncreaseAllowance, from2, uint64(100))},
+		{from1, sep206Call(SelectorDecreaseAllowance, from2, uint64(50))},
+		{from2, sep206Call(SelectorTransferFrom, from1, to2, uint64(1000))},
+		{from2, sep206Call(SelectorTransferFrom, from1, to2, uint64(1000_0000))}, // insufficient allowance
+		{from2, sep206Call(SelectorTransferFrom, from1, empty, uint64(0))},
+		{from2, sep206Call(SelectorTransferFrom, from1, to2, uint64(4050))}, // spends all the allowance
+		{from1, sep206Call(SelectorApprove, from2, uint64(5000))},
+		{from2, sep206Call(SelectorAllowance, from1, from2)},
+		{from1, sep206Call(SelectorIncreaseAllowance, from2, maxUint)}, // saturated
+		{from1, sep206Call(SelectorDecreaseAllowance, from2, maxUint)}, // cleared
+		{from2, sep206Call(SelectorAllowance, from1, from2)},
+		{from2, sep206Call(SelectorApprove, from1, maxUint)},
+		{from1, sep206Call(SelectorTransferFrom, from2, from1, uint64(2000))},
+		{from1, sep206Call(SelectorTransfer, to1)}, // wrong length
+	}
+}
+
+// Runs the same calls to SEP206 with evmwrap and RunSep206, and compares their results
+func runSep206Differential(t *testing.T, afterXHedgeFork bool) {
+	AdjustGasUsed = false
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	mirror := store.NewMockRootStore().GetTrunkStore(1000).(*store.TrunkStore)
+	mirrorRbt := rabbit.NewRabbitStore(mirror)
+	goCtx := types.NewContext(&mirrorRbt, nil)
+	newCtx := func() *types.Context {
+		ctx := prepareCtx(trunk)
+		if afterXHedgeFork {
+			ctx.SetXHedgeForkBlock(0)
+		}
+		return ctx
+	}
+	if afterXHedgeFork {
+		goCtx.SetXHedgeForkBlock(0)
+	}
+
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(newCtx())
+	prepareAccAndTx(e)
+	for _, addr := range []common.Address{from1, from2} {
+		acc := types.ZeroAccountInfo()
+		acc.UpdateBalance(uint256.NewInt(10000_0000_0000))
+		goCtx.SetAccount(addr, acc)
+	}
+
+	accounts := []common.Address{from1, from2, to1, to2, common.HexToAddress("0x99"), common.HexToAddress("0x5")}
+	nonces := map[common.Address]uint64{}
+	for i, call := range sep206TestCalls() {
+		const gasLimit = 100000
+		tx, _ := gethtypes.NewTransaction(nonces[call.sender], Sep206Address, big.NewInt(0), gasLimit,
+			big.NewInt(0), call.data).WithSignature(e.signer, call.sender.Bytes())
+		nonces[call.sender]++
+		committedTxs := runTxInBlock(e, newCtx, int64(i+1), tx)
+		require.Equal(t, 1, len(committedTxs), "call %d", i)
+		committed := committedTxs[0]
+
+		intrinsic := intrinsicGas(call.data)
+		res := RunSep206(goCtx, call.sender, call.data, gasLimit-intrinsic, false)
+		if res.Status == types.StatusSuccess {
+			require.Equal(t, types.ReceiptStatusSuccessful, committed.Status, "call %d", i)
+			require.Equal(t, res.OutData, committed.OutData, "call %d", i)
+		} else {
+			require.Equal(t, types.ReceiptStatusFailed, committed.Status, "call %d", i)
+		}
+		gasUsed := gasLimit - res.GasLeft
+		if gasUsed < res.Refund+(gasUsed+1)/2 { // can refund no more than half
+			gasUsed = (gasUsed + 1) / 2
+		} else {
+			gasUsed -= res.Refund
+		}
+		require.Equal(t, gasUsed, committed.GasUsed, "call %d", i)
+		require.Equal(t, len(res.Logs), len(committed.Logs), "call %d", i)
+		for j, log := range res.Logs {
+			require.Equal(t, log.Address, common.Address(committed.Logs[j].Address), "call %d", i)
+			require.Equal(t, log.Data, committed.Logs[j].Data, "call %d", i)
+			require.Equal(t, len(log.Topics), len(committed.Logs[j].Topics), "call %d", i)
+			for k, topic := range log.Topics {
+				require.Equal(t, [32]byte(topic), committed.Logs[j].Topics[k], "call %d", i)
+			}
+		}
+
+		ctx := newCtx()
+		for _, addr := range accounts {
+			accC, accGo := ctx.GetAccount(addr), goCtx.GetAccount(addr)
+			require.Equal(t, accC == nil, accGo == nil, "call %d", i)
+			if accC != nil {
+				require.Equal(t, accC.Balance(), accGo.Balance(), "call %d", i)
+				require.Equal(t, accC.Sequence(), accGo.Sequence(), "call %d", i)
+			}
+			for _, spender := range accounts {
+				key := Sep206AllowanceKey(addr, spender)
+				require.Equal(t, ctx.GetStorageAt(Sep206Sequence, key), goCtx.GetStorageAt(Sep206Sequence, key), "call %d", i)
+			}
+		}
+		ctx.Close(false)
+	}
+}
+
+func TestSep206Differential(t *testing.T) {
+	runSep206Differential(t, false)
+	runSep206Differential(t, true)
+}
+
+func TestSep206StaticCall(t *testing.T) {
+	mirror := store.NewMockRootStore().GetTrunkStore(1000).(*store.TrunkStore)
+	rbt := rabbit.NewRabbitStore(mirror)
+	ctx := types.NewContext(&rbt, nil)
+	res := RunSep206(ctx, from1, sep206Call(SelectorApprove, from2, uint64(1)), 100000, true)
+	require.Equal(t, types.StatusPrecompileFailure, res.Status)
+	res = RunSep206(ctx, from1, sep206Call(SelectorBalanceOf, from2), 100000, true)
+	require.Equal(t, types.StatusSuccess, res.Status)
+	require.Equal(t, uint64(100000-20000), res.GasLeft)
+	res = RunSep206(ctx, from1, sep206Call(SelectorBalanceOf, from2), 19999, true)
+	require.Equal(t, types.StatusOutOfGas, res.Status)
+}
+
+func TestSep206Frontier(t *testing.T) {
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	prepareAccAndTx(e)
+	ctx := prepareCtx(trunk)
+	defer ctx.Close(false)
+	f := GetEmptyFrontier()
+	newTx := func(nonce uint64, data []byte) *gethtypes.Transaction {
+		tx, _ := gethtypes.NewTransaction(nonce, Sep206Address, big.NewInt(100), 100000, big.NewInt(1), data).WithSignature(e.signer, from1.Bytes())
+		return tx
+	}
+	_, err := CheckTx(ctx, e.signer, newTx(0, sep206Call(SelectorTransfer, to1, uint64(1000))), f, 0, DefaultTxGasLimit)
+	require.Nil(t, err)
+	balance, _ := f.GetLatestBalance(from1)
+	require.Equal(t, uint64(10000_0000_0000-100000-100-1000), balance.Uint64())
+	// transferFrom only spends the sender's BCH when the sender is the owner
+	_, err = CheckTx(ctx, e.signer, newTx(1, sep206Call(SelectorTransferFrom, from2, to1, uint64(1000))), f, 0, DefaultTxGasLimit)
+	require.Nil(t, err)
+	balance, _ = f.GetLatestBalance(from1)
+	require.Equal(t, uint64(10000_0000_0000-200000-200-1000), balance.Uint64())
+	_, err = CheckTx(ctx, e.signer, newTx(2, sep206Call(SelectorTransferFrom, from1, to1, uint64(1000))), f, 0, DefaultTxGasLimit)
+	require.Nil(t, err)
+	balance, _ = f.GetLatestBalance(from1)
+	require.Equal(t, uint64(10000_0000_0000-300000-300-2000), balance.Uint64())
+	_, err = CheckTx(ctx, e.signer, newTx(3, sep206Call(SelectorApprove, to1, uint64(1000))), f, 0, DefaultTxGasLimit)
+	require.Nil(t, err)
+	balance, _ = f.GetLatestBalance(from1)
+	require.Equal(t, uint64(10000_0000_0000-400000-400-2000), balance.Uint64())
+}
+
+func TestIsPrecompiledAddress(t *testing.T) {
+	ctx := &types.Context{Height: 9, XHedgeForkBlock: 10}
+	// the contracts implemented in C and the staking contract are always precompiled
+	for _, id := range []uint64{1, 2, 3, 4, 9, 0x2710, 0x2711, 0x2712} {
+		require.True(t, isPrecompiledAddress(ctx, common.BytesToAddress(uint256.NewInt(id).Bytes())))
+	}
+	require.False(t, isPrecompiledAddress(ctx, sep109ContractAddress))
+	require.False(t, isPrecompiledAddress(ctx, from1))
+	ctx.Height = 10
+	require.True(t, isPrecompiledAddress(ctx, sep109ContractAddress))
+	addr := common.HexToAddress("0x2798")
+	require.False(t, isPrecompiledAddress(ctx, addr))
+	PredefinedContractManager[addr] = &hookContract{}
+	defer delete(PredefinedContractManager, addr)
+	require.True(t, isPrecompiledAddress(ctx, addr))
+}
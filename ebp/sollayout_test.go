@@ -0,0 +1,299 @@
+package ebp
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/log"
+
+	"github.com/smartbch/moeingevm/evmwrap/testcase"
+	"github.com/smartbch/moeingevm/sollayout"
+	"github.com/smartbch/moeingevm/types"
+)
+
+// The following contracts are assembled by hand, following the storage accesses that solc generates for:
+//
+//	contract Layout {
+//	    uint64 a; address b; bool c;                                   // slot 0
+//	    mapping(address => mapping(uint256 => uint256)) m;             // slot 1
+//	    uint256[] arr;                                                 // slot 2
+//	}
+//
+// Each contract only accesses one of the state variables, and the others are left empty.
+
+// sstore(0, or(or(shl(224, 1), shl(64, caller())), and(calldataload(0), 0xffffffffffffffff)))
+const layoutPackedAsm = `
+push 1
+push 224
+shl
+caller
+push 64
+shl
+or
+push 0xffffffffffffffff
+push 0
+calldataload
+and
+or
+push 0
+sstore
+stop
+`
+
+// slot := keccak256(calldataload(0) . keccak256(caller() . 1))
+// if eq(calldatasize(), 64) { sstore(slot, calldataload(32)) stop() } mstore(0, sload(slot)) return(0, 32)
+const layoutMappingAsm = `
+caller
+push 0
+mstore
+push 1
+push 32
+mstore
+push 64
+push 0
+sha3
+push 32
+mstore
+push 0
+calldataload
+push 0
+mstore
+push 64
+push 0
+sha3
+calldatasize
+push 64
+eq
+jumpi @set
+sload
+push 0
+mstore
+push 32
+push 0
+return
+set:
+push 32
+calldataload
+swap1
+sstore
+stop
+`
+
+// arr.push(calldataload(0))
+const layoutArrayAsm = `
+push 2
+sload
+push 2
+push 0
+mstore
+push 32
+push 0
+sha3
+dup2
+add
+push 0
+calldataload
+swap1
+sstore
+push 1
+add
+push 2
+sstore
+stop
+`
+
+// The creation bytecode and the ABI of the Interactor contract compiled by solc, taken from the tests of
+// go-ethereum's accounts/abi/bind:
+//
+//	contract Interactor {
+//	    string public deployString;                                    // slot 0
+//	    string public transactString;                                  // slot 1
+//	    function Interactor(string str) { deployString = str; }
+//	    function transact(string str) { transactString = str; }
+//	}
+var (
+	interactorCode = "606060405260405161032838038061032883398101604052805101806000600050908051906020019082805460018160" +
+		"0116156101000203166002900490600052602060002090601f016020900481019282601f10608d57805160ff19168380" +
+		"011785555b50607c9291505b8082111560ba57838155600101606b565b50505061026a806100be6000396000f35b8280" +
+		"01600101855582156064579182015b828111156064578251826000505591602001919060010190609e565b5090566060" +
+		"60405260e060020a60003504630d86a0e181146100315780636874e8091461008d578063d736c513146100ea575b005b" +
+		"610190600180546020600282841615610100026000190190921691909104601f81018290049091026080908101604052" +
+		"6060828152929190828280156102295780601f106101fe57610100808354040283529160200191610229565b61019060" +
+		"008054602060026001831615610100026000190190921691909104601f81018290049091026080908101604052606082" +
+		"8152929190828280156102295780601f106101fe57610100808354040283529160200191610229565b60206004803580" +
+		"820135601f81018490049093026080908101604052606084815261002f94602493919291840191819083828082843750" +
+		"949650505050505050806001600050908051906020019082805460018160011615610100020316600290049060005260" +
+		"2060002090601f016020900481019282601f1061023157805160ff19168380011785555b506102619291505b80821115" +
+		"6102665760008155830161017d565b604051808060200182810382528381815181526020019150805190602001908083" +
+		"83829060006004602084601f0104600f02600301f150905090810190601f1680156101f0578082038051600183602003" +
+		"6101000a031916815260200191505b509250505060405180910390f35b820191906000526020600020905b8154815290" +
+		"6001019060200180831161020c57829003601f168201915b505050505081565b82800160010185558215610175579182" +
+		"015b82811115610175578251826000505591602001919060010190610243565b505050565b509056"
+	interactorABI = `[{"constant":true,"inputs":[],"name":"transactString","outputs":[{"name":"","type":"string"}],"type":"function"},{"constant":true,"inputs":[],"name":"deployString","outputs":[{"name":"","type":"string"}],"type":"function"},{"constant":false,"inputs":[{"name":"str","type":"string"}],"name":"transact","outputs":[],"type":"function"},{"inputs":[{"name":"str","type":"string"}],"type":"constructor"}]`
+)
+
+func TestSolLayout(t *testing.T) {
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetContext(prepareCtx(trunk))
+	prepareAccAndTx(e)
+	height := int64(0)
+	nonce := uint64(0)
+	runTx := func(to *common.Address, data []byte) *types.Transaction {
+		var tx *gethtypes.Transaction
+		if to == nil {
+			tx = gethtypes.NewContractCreation(nonce, big.NewInt(0), 1000000, big.NewInt(1), data)
+		} else {
+			tx = gethtypes.NewTransaction(nonce, *to, big.NewInt(0), 1000000, big.NewInt(1), data)
+		}
+		tx, _ = tx.WithSignature(e.signer, from1.Bytes())
+		nonce++
+		height++
+		committedTxs := runTxInBlock(e, func() *types.Context { return prepareCtx(trunk) }, height, tx)
+		require.Equal(t, 1, len(committedTxs))
+		require.Equal(t, uint64(1), committedTxs[0].Status)
+		return committedTxs[0]
+	}
+	deploy := func(runtimeAsm string) (common.Address, uint64) {
+		addr := gethcrypto.CreateAddress(from1, nonce)
+		runTx(nil, creationCode(compileAsm(runtimeAsm)))
+		ctx := prepareCtx(trunk)
+		defer ctx.Close(false)
+		return addr, ctx.GetAccount(addr).Sequence()
+	}
+
+	// packed slot
+	addr, seq := deploy(layoutPackedAsm)
+	runTx(&addr, uint256.NewInt(0x1234_5678_9abc_def0).PaddedBytes(32))
+	ctx := prepareCtx(trunk)
+	s := sollayout.NewStorage(ctx, seq)
+	slot0 := sollayout.NewSlot(0)
+	require.Equal(t, uint64(0x1234_5678_9abc_def0), s.GetField(slot0, sollayout.Field{Slot: 0, Offset: 0, Size: 8}).Uint64())
+	require.Equal(t, from1, s.GetAddress(slot0, 8))
+	require.True(t, s.GetBool(slot0, 28))
+	// writing one field keeps the others
+	s.SetBool(slot0, 28, false)
+	s.SetField(slot0, sollayout.Field{Slot: 0, Offset: 0, Size: 8}, uint256.NewInt(7))
+	require.Equal(t, uint64(7), s.GetPacked(slot0, 0, 8).Uint64())
+	require.Equal(t, from1, s.GetAddress(slot0, 8))
+	require.False(t, s.GetBool(slot0, 28))
+	ctx.Close(false)
+
+	// nested mapping
+	addr, seq = deploy(layoutMappingAsm)
+	runTx(&addr, append(uint256.NewInt(5).PaddedBytes(32), uint256.NewInt(500).PaddedBytes(32)...))
+	ctx = prepareCtx(trunk)
+	s = sollayout.NewStorage(ctx, seq)
+	mSlot := sollayout.NewSlot(1)
+	slot := sollayout.NestedMappingSlot(mSlot, sollayout.AddressKey(from1), sollayout.UintKey(uint256.NewInt(5)))
+	require.Equal(t, uint64(500), s.Get(slot).Uint64())
+	require.Equal(t, slot, sollayout.MappingSlot(sollayout.MappingSlot(mSlot, sollayout.AddressKey(from1)), sollayout.UintKey(uint256.NewInt(5))))
+	s.Set(sollayout.NestedMappingSlot(mSlot, sollayout.AddressKey(from1), sollayout.UintKey(uint256.NewInt(6))), uint256.NewInt(600))
+	ctx.Close(true)
+	tx := runTx(&addr, uint256.NewInt(6).PaddedBytes(32))
+	require.Equal(t, uint256.NewInt(600).PaddedBytes(32), tx.OutData)
+
+	// dynamic array
+	addr, seq = deploy(layoutArrayAsm)
+	for i := uint64(1); i <= 3; i++ {
+		runTx(&addr, uint256.NewInt(i*100).PaddedBytes(32))
+	}
+	ctx = prepareCtx(trunk)
+	s = sollayout.NewStorage(ctx, seq)
+	arrSlot := sollayout.NewSlot(2)
+	require.Equal(t, uint64(3), s.Get(arrSlot).Uint64())
+	for i := uint64(0); i < 3; i++ {
+		require.Equal(t, (i+1)*100, s.Get(sollayout.ArrayElementSlot(arrSlot, i, 1)).Uint64())
+	}
+	ctx.Close(false)
+
+	// strings written by solc are read by GetString, and those written by SetString are read by solc
+	abiInteractor, err := abi.JSON(strings.NewReader(interactorABI))
+	require.NoError(t, err)
+	args, err := abiInteractor.Pack("", "deployed")
+	require.NoError(t, err)
+	addr = gethcrypto.CreateAddress(from1, nonce)
+	runTx(nil, append(hexToBytes(interactorCode), args...))
+	ctx = prepareCtx(trunk)
+	seq = ctx.GetAccount(addr).Sequence()
+	s = sollayout.NewStorage(ctx, seq)
+	str, err := s.GetString(sollayout.NewSlot(0))
+	require.NoError(t, err)
+	require.Equal(t, "deployed", str)
+	ctx.Close(false)
+	getTransactString := func() string {
+		data, err := abiInteractor.Pack("transactString")
+		require.NoError(t, err)
+		out, err := abiInteractor.Unpack("transactString", runTx(&addr, data).OutData)
+		require.NoError(t, err)
+		return out[0].(string)
+	}
+	const mirrorSeq = 1 << 40
+	sSlot := sollayout.NewSlot(1)
+	dataSlot := sollayout.DynamicArrayDataSlot(sSlot)
+	for _, length := range []int{100, 5, 0, 31, 32, 33, 64, 65, 1} {
+		str := strings.Repeat("abcdefghij", 10)[:length]
+		data, err := abiInteractor.Pack("transact", str)
+		require.NoError(t, err)
+		runTx(&addr, data)
+		ctx = prepareCtx(trunk)
+		s = sollayout.NewStorage(ctx, seq)
+		got, err := s.GetString(sSlot)
+		require.NoError(t, err)
+		require.Equal(t, str, got, "length %d", length)
+		// SetString writes the same words as solc, and clears the unused slots like solc
+		mirror := sollayout.NewStorage(ctx, mirrorSeq)
+		require.NoError(t, mirror.SetString(sSlot, str))
+		for i := 0; i < 4; i++ {
+			slot := sollayout.Offset(dataSlot, uint64(i))
+			require.Equal(t, s.Get(slot), mirror.Get(slot), "length %d", length)
+		}
+		require.Equal(t, s.Get(sSlot), mirror.Get(sSlot), "length %d", length)
+		// the getter generated by solc reads the string written by SetString
+		reversed := []byte(str)
+		for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+			reversed[i], reversed[j] = reversed[j], reversed[i]
+		}
+		require.NoError(t, s.SetString(sSlot, string(reversed)))
+		ctx.Close(true)
+		require.Equal(t, string(reversed), getTransactString(), "length %d", length)
+	}
+}
+
+// The slots which make solc panic when it reads them as bytes or strings
+func TestSolLayoutInvalidBytes(t *testing.T) {
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	ctx := prepareCtx(trunk)
+	defer ctx.Close(false)
+	s := sollayout.NewStorage(ctx, 100)
+	slot := sollayout.NewSlot(0)
+	for _, c := range []struct {
+		word *uint256.Int
+		err  error
+	}{
+		{uint256.NewInt(64), sollayout.ErrInvalidBytesEncoding},  // short form of 32 bytes
+		{uint256.NewInt(254), sollayout.ErrInvalidBytesEncoding}, // short form of 127 bytes
+		{uint256.NewInt(63), sollayout.ErrInvalidBytesEncoding},  // long form of 31 bytes
+		{uint256.NewInt(sollayout.MaxBytesLength*2 + 3), sollayout.ErrBytesTooLong},
+		{uint256.NewInt(0).SetAllOne(), sollayout.ErrBytesTooLong},
+	} {
+		s.Set(slot, c.word)
+		_, err := s.GetBytes(slot)
+		require.Equal(t, c.err, err, "word %s", c.word.Hex())
+		require.Equal(t, c.err, s.SetBytes(slot, []byte{1}), "word %s", c.word.Hex())
+		require.Equal(t, c.word, s.Get(slot))
+	}
+	s.Set(slot, uint256.NewInt(sollayout.MaxBytesLength*2+1))
+	_, err := s.GetBytes(slot)
+	require.NoError(t, err)
+	require.Equal(t, sollayout.ErrBytesTooLong, s.SetBytes(slot, make([]byte, sollayout.MaxBytesLength+1)))
+}
@@ -0,0 +1,194 @@
+package ebp
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	gethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+	"github.com/smartbch/moeingads/store"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/libs/log"
+
+	"github.com/smartbch/moeingevm/evmwrap/testcase"
+	"github.com/smartbch/moeingevm/types"
+)
+
+func TestExecuteAfterLoadingGenesisAlloc(t *testing.T) {
+	trunk, root := prepareTruck()
+	defer closeTestCtx(root)
+	// returns sload(calldataload(0))
+	getter := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	code := compileAsm(`
+push 0
+calldataload
+sload
+push 0
+mstore
+push 32
+push 0
+return
+`)
+	ctx := prepareCtx(trunk)
+	err := ctx.LoadGenesisAlloc(bytes.NewBufferString(fmt.Sprintf(`{
+		"%s": {"balance": "10000000000000"},
+		"%s": {"balance": "0x0", "code": "%s", "storage": {
+			"0x0000000000000000000000000000000000000000000000000000000000000005": "0x0000000000000000000000000000000000000000000000000000000000001234"}}
+	}`, from1, getter, hexutil.Encode(code))))
+	require.Nil(t, err)
+	ctx.Close(true)
+
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	runTx := func(height int64, tx *gethtypes.Transaction) *types.Transaction {
+		tx, _ = tx.WithSignature(e.signer, from1.Bytes())
+		committedTxs := runTxInBlock(e, func() *types.Context { return prepareCtx(trunk) }, height, tx)
+		require.Equal(t, 1, len(committedTxs))
+		require.Equal(t, gethtypes.ReceiptStatusSuccessful, committedTxs[0].Status)
+		return committedTxs[0]
+	}
+	tx := runTx(1, gethtypes.NewTransaction(0, getter, big.NewInt(0), 100000, big.NewInt(1),
+		uint256.NewInt(5).PaddedBytes(32)))
+	require.Equal(t, uint256.NewInt(0x1234).PaddedBytes(32), tx.OutData)
+
+	// the creation counters are updated, so a contract created later gets a new sequence
+	runTx(2, gethtypes.NewContractCreation(1, big.NewInt(0), 1000000, big.NewInt(1), creationCode(code)))
+	ctx = prepareCtx(trunk)
+	defer ctx.Close(false)
+	created := ctx.GetAccount(gethcrypto.CreateAddress(from1, 1))
+	require.NotEqual(t, ctx.GetAccount(getter).Sequence(), created.Sequence())
+	require.Equal(t, code, ctx.GetCode(gethcrypto.CreateAddress(from1, 1)).BytecodeSlice())
+}
+
+func TestAddressBySequence(t *testing.T) {
+	trunk, root, mads := prepareTruckAndADS()
+	defer closeTestCtx(root)
+	const forkHeight = 3
+	e := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	e.SetStateScanner(mads)
+	e.SetContext(prepareCtx(trunk))
+	prepareAccAndTx(e)
+	heightCtx := func(height int64) *types.Context {
+		ctx := prepareCtx(trunk)
+		ctx.SetCurrentHeight(height)
+		ctx.SetSeqIndexForkBlock(forkHeight)
+		return ctx
+	}
+	// an engine without a state scanner refuses the contexts before the fork
+	noScanner := NewEbpTxExec(5, 5, 2, 10, &testcase.DumbSigner{}, log.NewNopLogger())
+	ctx := heightCtx(forkHeight)
+	require.Panics(t, func() { noScanner.SetContext(ctx) })
+	ctx.SetCurrentHeight(forkHeight + 1)
+	noScanner.SetContext(ctx)
+	ctx.Close(false)
+	runTx := func(height int64, tx *gethtypes.Transaction) {
+		tx, _ = tx.WithSignature(e.signer, from1.Bytes())
+		committedTxs := runTxInBlock(e, func() *types.Context { return heightCtx(height) }, height, tx)
+		require.Equal(t, 1, len(committedTxs))
+		require.Equal(t, gethtypes.ReceiptStatusSuccessful, committedTxs[0].Status)
+		// writes the block back to MoeingADS, such that the state scanner can see it. The context set
+		// for Execute holds the read lock of the root store until it is closed.
+		e.Context().Close(false)
+		trunk.Close(true)
+		root.SetHeight(height + 1)
+		trunk = root.GetTrunkStore(1000).(*store.TrunkStore)
+	}
+	getAddr := func(contract common.Address) (common.Address, bool) {
+		ctx := prepareCtx(trunk)
+		defer ctx.Close(false)
+		return ctx.GetAddressBySequence(ctx.GetAccount(contract).Sequence())
+	}
+	runtimeCode := compileAsm("push 0\npush 0\nreturn\n")
+	// an EOA has no sequence
+	contract1 := gethcrypto.CreateAddress(from1, 1)
+	runTx(1, gethtypes.NewTransaction(0, contract1, big.NewInt(1), 100000, big.NewInt(1), nil))
+	_, ok := getAddr(contract1)
+	require.False(t, ok)
+
+	// the contracts created before the fork are not indexed until the fork block
+	runTx(2, gethtypes.NewContractCreation(1, big.NewInt(0), 1000000, big.NewInt(1), creationCode(runtimeCode)))
+	_, ok = getAddr(contract1)
+	require.False(t, ok)
+
+	contract2 := gethcrypto.CreateAddress(from1, 2)
+	runTx(forkHeight, gethtypes.NewContractCreation(2, big.NewInt(0), 1000000, big.NewInt(1), creationCode(runtimeCode)))
+	for _, contract := range []common.Address{contract1, contract2} {
+		addr, ok := getAddr(contract)
+		require.True(t, ok)
+		require.Equal(t, contract, addr)
+	}
+	ctx = prepareCtx(trunk)
+	defer ctx.Close(false)
+	_, ok = ctx.GetAddressBySequence(ctx.GetAccount(contract2).Sequence() + 256)
+	require.False(t, ok)
+}
+
+// the shard roots taken from the proofs of a real MoeingADS must make up its root hash
+func TestShardRootsOfMoeingADS(t *testing.T) {
+	trunk, root, mads := prepareTruckAndADS()
+	defer closeTestCtx(root)
+	ctx := prepareCtx(trunk)
+	// enough accounts to make all the shards non-empty
+	for i := 0; i < 64; i++ {
+		acc := types.ZeroAccountInfo()
+		acc.UpdateBalance(uint256.NewInt(uint64(1000 + i)))
+		ctx.SetAccount(common.BigToAddress(big.NewInt(int64(1000+i))), acc)
+	}
+	ctx.Close(true)
+	trunk.Close(true)
+
+	shardRoots, err := types.GetShardRoots(mads)
+	require.Nil(t, err)
+	stateRoot := types.StateRootFromShardRoots(shardRoots)
+	require.Equal(t, mads.GetRootHash(), stateRoot[:])
+}
+
+// the proofs generated from a real MoeingADS, including those of absent keys, must be verified by its root hash
+func TestAccountProofOfMoeingADS(t *testing.T) {
+	trunk, root, mads := prepareTruckAndADS()
+	defer closeTestCtx(root)
+	ctx := prepareCtx(trunk)
+	// enough accounts to make all the shards non-empty
+	for i := 0; i < 64; i++ {
+		acc := types.ZeroAccountInfo()
+		acc.UpdateBalance(uint256.NewInt(uint64(1000 + i)))
+		ctx.SetAccount(common.BigToAddress(big.NewInt(int64(1000+i))), acc)
+	}
+	contract := common.HexToAddress("0x2")
+	acc := types.ZeroAccountInfo()
+	acc.UpdateBalance(uint256.NewInt(7))
+	acc.UpdateSequence(100)
+	ctx.SetAccount(contract, acc)
+	code := []byte{0x60, 0x00}
+	ctx.Rbt.Set(types.GetBytecodeKey(contract), append(append([]byte{0}, gethcrypto.Keccak256(code)...), code...))
+	slot1 := common.BigToHash(common.Big1)
+	slot2 := common.BigToHash(common.Big2)
+	ctx.SetStorageAt(100, string(slot1[:]), []byte{0x11})
+	ctx.Close(true)
+	trunk.Close(true)
+
+	var stateRoot [32]byte
+	copy(stateRoot[:], mads.GetRootHash())
+	height := mads.GetCurrHeight()
+	_, err := types.GetProof(mads, height+1, contract, nil)
+	require.ErrorIs(t, err, types.ErrInvalidHeight)
+	res, err := types.GetProof(mads, height, contract, []common.Hash{slot1, slot2})
+	require.Nil(t, err)
+	require.Equal(t, uint64(7), res.Balance.ToInt().Uint64())
+	require.Equal(t, gethcrypto.Keccak256Hash(code), res.CodeHash)
+	require.Equal(t, hexutil.Bytes{0x11}, res.StorageProof[0].Value)
+	require.Nil(t, res.StorageProof[1].Value)
+	require.Nil(t, types.VerifyAccountProof(stateRoot, res))
+	// an account which does not exist
+	res, err = types.GetProof(mads, height, common.HexToAddress("0x3"), []common.Hash{slot1})
+	require.Nil(t, err)
+	require.Nil(t, res.StorageProof[0].Value)
+	require.Equal(t, gethcrypto.Keccak256Hash(nil), res.CodeHash)
+	require.Nil(t, types.VerifyAccountProof(stateRoot, res))
+	res.Balance.ToInt().SetUint64(1)
+	require.Equal(t, types.ErrInvalidProof, types.VerifyAccountProof(stateRoot, res))
+}
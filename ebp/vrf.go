@@ -0,0 +1,44 @@
+package ebp
+
+import (
+	"errors"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/vechain/go-ecvrf"
+)
+
+// The helpers below generate proofs and build the inputs of VrfVerifyContract and VrfBatchVerifyContract,
+// such that contract developers and tests can prepare valid calldata.
+
+// VrfProve generates the output (beta) and the proof (pi) of alpha with the secp256k1 private key
+func VrfProve(privKey *btcec.PrivateKey, alpha [32]byte) (beta, pi []byte, err error) {
+	vrf := ecvrf.NewSecp256k1Sha256Tai()
+	return vrf.Prove(privKey.ToECDSA(), alpha[:])
+}
+
+// VrfVerifyInput returns abi.encodePacked(alpha, compressedPubKey, pi), the input of VrfVerifyContract
+func VrfVerifyInput(alpha [32]byte, pubKey *btcec.PublicKey, pi []byte) []byte {
+	input := make([]byte, 0, VRF_ALPHA_LEN+VRF_PUBKEY_LEN+len(pi))
+	input = append(input, alpha[:]...)
+	input = append(input, pubKey.SerializeCompressed()...)
+	return append(input, pi...)
+}
+
+type VrfProof struct {
+	Alpha  [32]byte
+	PubKey *btcec.PublicKey
+	Pi     []byte
+}
+
+// VrfBatchVerifyInput returns the input of VrfBatchVerifyContract, which is the concatenation of
+// the inputs of VrfVerifyContract
+func VrfBatchVerifyInput(proofs []VrfProof) ([]byte, error) {
+	input := make([]byte, 0, len(proofs)*VRF_BATCH_ITEM_LEN)
+	for _, proof := range proofs {
+		if len(proof.Pi) != VRF_PI_LEN {
+			return nil, errors.New("invalid length of pi")
+		}
+		input = append(input, VrfVerifyInput(proof.Alpha, proof.PubKey, proof.Pi)...)
+	}
+	return input, nil
+}
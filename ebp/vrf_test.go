@@ -0,0 +1,65 @@
+package ebp
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartbch/moeingevm/types"
+)
+
+func TestVrfBatchVerify(t *testing.T) {
+	var proofs []VrfProof
+	var betas []byte
+	single := &VrfVerifyContract{}
+	for i := 0; i < 3; i++ {
+		privKey, err := btcec.NewPrivateKey(btcec.S256())
+		require.NoError(t, err)
+		var alpha [32]byte
+		alpha[31] = byte(i)
+		beta, pi, err := VrfProve(privKey, alpha)
+		require.NoError(t, err)
+		require.Equal(t, VRF_PI_LEN, len(pi))
+		out, err := single.Run(VrfVerifyInput(alpha, privKey.PubKey(), pi))
+		require.NoError(t, err)
+		require.Equal(t, beta, out)
+		proofs = append(proofs, VrfProof{Alpha: alpha, PubKey: privKey.PubKey(), Pi: pi})
+		betas = append(betas, beta...)
+	}
+
+	batch := &VrfBatchVerifyContract{}
+	input, err := VrfBatchVerifyInput(proofs)
+	require.NoError(t, err)
+	require.Equal(t, 3*VRF_BATCH_ITEM_LEN, len(input))
+	require.Equal(t, 3*VRF_VERIFY_GAS, batch.RequiredGas(input))
+	out, err := batch.Run(input)
+	require.NoError(t, err)
+	require.Equal(t, betas, out)
+
+	input[VRF_BATCH_ITEM_LEN+1] ^= 1 // the second alpha does not match its proof
+	_, err = batch.Run(input)
+	require.Error(t, err)
+	_, err = batch.Run(input[:len(input)-1])
+	require.Error(t, err)
+	_, err = batch.Run(nil)
+	require.Error(t, err)
+	require.Equal(t, VRF_VERIFY_GAS, batch.RequiredGas(nil))
+
+	proofs[0].Pi = proofs[0].Pi[1:]
+	_, err = VrfBatchVerifyInput(proofs)
+	require.Error(t, err)
+}
+
+func TestRegisterVrfBatchVerifyContract(t *testing.T) {
+	defer delete(Precompiles.entries, VrfBatchVerifyContractAddress)
+	ctx := &types.Context{Height: 9}
+	_, ok := Precompiles.Get(ctx, VrfBatchVerifyContractAddress)
+	require.False(t, ok)
+	RegisterVrfBatchVerifyContract(ActiveSince(10))
+	_, ok = Precompiles.Get(ctx, VrfBatchVerifyContractAddress)
+	require.False(t, ok)
+	ctx.Height = 10
+	_, ok = Precompiles.Get(ctx, VrfBatchVerifyContractAddress)
+	require.True(t, ok)
+}
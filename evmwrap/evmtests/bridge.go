@@ -23,14 +23,22 @@ extern void get_value(int handler,
 extern evmc_bytes32 get_block_hash(int handler, uint64_t num);
 extern void collect_result(int handler, struct all_changed* result, struct evmc_result* ret_value);
 
-extern void call_precompiled_contract (struct evmc_address* contract_addr,
+extern void call_precompiled_contract (int handler,
+			       struct evmc_address* contract_addr,
+			       struct evmc_address* caller,
+			       struct evmc_bytes32* value,
+			       int kind,
+			       int is_static,
+			       int depth,
 			       void* input_ptr,
 			       int input_size,
 			       uint64_t* gas_left,
 			       int* ret_value,
 			       int* out_of_gas,
 			       struct small_buffer* output_ptr,
+			       uint8_t** big_output_ptr,
 			       int* output_size);
+extern void revert_precompiled_contract(int handler);
 
 int64_t zero_depth_call_wrap(evmc_bytes32 gas_price,
                      int64_t gas_limit,
@@ -59,7 +67,8 @@ int64_t zero_depth_call_wrap(evmc_bytes32 gas_price,
 		               get_value,
 		               get_block_hash,
 		               collect_result,
-		               call_precompiled_contract);
+		               call_precompiled_contract,
+		               revert_precompiled_contract);
 }
 
 */
@@ -409,6 +409,10 @@ func runTestCaseWithGasLimit(filename string, theCase *tc.TestCase, printLog boo
 	bi.timestamp = C.int64_t(currBlock.Timestamp)
 	bi.gas_limit = C.int64_t(currBlock.GasLimit)
 	bi.cfg.after_xhedge_fork = false
+	for i := 0; i < 9; i++ { // the precompiled contracts of Istanbul, at address 1~9
+		bi.cfg.go_precompiles[i] = C.uint64_t(i + 1)
+	}
+	bi.cfg.go_precompile_count = 9
 	writeCBytes32WithBytes32(&bi.difficulty, currBlock.Difficulty[:])
 	writeCBytes32WithBytes32(&bi.chain_id, currBlock.ChainId[:])
 	data_ptr := (*C.uint8_t)(nil)
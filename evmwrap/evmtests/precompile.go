@@ -26,13 +26,20 @@ import "C"
 //byte{9}): &blake2F{},
 
 //export call_precompiled_contract
-func call_precompiled_contract(contract_addr *evmc_address,
+func call_precompiled_contract(handler C.int,
+	contract_addr *evmc_address,
+	caller *evmc_address,
+	value *evmc_bytes32,
+	kind C.int,
+	is_static C.int,
+	depth C.int,
 	input_ptr unsafe.Pointer,
 	input_size C.int,
 	gas_left *C.uint64_t,
 	ret_value *C.int,
 	out_of_gas *C.int,
 	output_ptr *small_buffer,
+	big_output_ptr **C.uint8_t,
 	output_size *C.int) {
 	addr := toArr20(contract_addr)
 	contract, ok := vm.PrecompiledContractsIstanbul[addr]
@@ -58,17 +65,23 @@ func call_precompiled_contract(contract_addr *evmc_address,
 		return
 	}
 	size := len(output)
-	if size > 256 {
-		size = 256
-	}
 	*output_size = C.int(size)
 	//fmt.Printf("PRECOM %s %d  %d", common.Address(addr).String(), len(output), size)
-	for i := 0; i < size && i < C.SMALL_BUF_SIZE; i++ {
-		output_ptr.data[i] = C.uint8_t(output[i])
-		//fmt.Printf("%x", int(output[i]));
+	if size > C.SMALL_BUF_SIZE {
+		*big_output_ptr = (*C.uint8_t)(C.CBytes(output))
+	} else {
+		for i := 0; i < size; i++ {
+			output_ptr.data[i] = C.uint8_t(output[i])
+			//fmt.Printf("%x", int(output[i]));
+		}
 	}
 	//fmt.Printf("\n");
 	*ret_value = 1
 	*out_of_gas = 0
 	//return
 }
+
+//export revert_precompiled_contract
+func revert_precompiled_contract(handler C.int) {
+	// the precompiled contracts used in tests do not change states, so there is nothing to revert
+}
@@ -106,8 +106,16 @@ struct all_changed {
 	size_t internal_tx_return_num;
 };
 
+enum {
+	MAX_GO_PRECOMPILES = 64,
+};
+
 struct config {
 	bool after_xhedge_fork;
+	// the IDs of the precompiled contracts implemented in Go and active in current block,
+	// an ID is the last 8 bytes of the contract's address
+	uint64_t go_precompiles[MAX_GO_PRECOMPILES];
+	int go_precompile_count;
 };
 
 // Go environment passes information about a block through this struct to C environment
@@ -131,9 +139,10 @@ enum {
 	SMALL_BUF_SIZE = 2048,
 };
 
-// a small buffer is large enough to contain the output of precompiled contract
+// a small buffer is large enough to contain the output of most precompiled contracts. When a Go-implemented
+// precompiled contract's output is larger than it, Go allocates a big output buffer with malloc and C frees it
 struct small_buffer {
-	uint8_t data[SMALL_BUF_SIZE]; //bigModExp's output is variable-length, but we support 2048 bytes at most
+	uint8_t data[SMALL_BUF_SIZE];
 };
 
 // Pointers of the following functions will be provided by the Go environment
@@ -155,14 +164,24 @@ typedef void (*bridge_get_value_fn)(int handler,
                                     size_t* size);
 typedef struct evmc_bytes32 (*bridge_get_block_hash_fn)(int handler, uint64_t num);
 typedef void (*bridge_collect_result_fn)(int handler, struct all_changed* result, struct evmc_result* ret_value);
-typedef void (*bridge_call_precompiled_contract_fn)(struct evmc_address* contract_addr,
+typedef void (*bridge_call_precompiled_contract_fn)(int handler,
+                                                    struct evmc_address* contract_addr,
+                                                    struct evmc_address* caller,
+                                                    struct evmc_bytes32* value,
+                                                    int kind,
+                                                    int is_static,
+                                                    int depth,
                                                     void* input_ptr,
                                                     int input_size,
                                                     uint64_t *gas_left,
                                                     int* ret_value,
                                                     int* out_of_gas,
                                                     struct small_buffer* output_ptr,
+                                                    uint8_t** big_output_ptr,
                                                     int* output_size);
+// When an EVM frame reverts, the state changes made by the successful calls to Go-implemented precompiled
+// contracts inside it must also be reverted. Such calls are reverted one by one, in the reverse order.
+typedef void (*bridge_revert_precompiled_contract_fn)(int handler);
 
 // Since we want to compile evmwrap into a dynamic library (.so), it cannot have unlinked external functions.
 // Thus, there is only one way to allow C to call Go: pass function pointers from Go to C.
@@ -184,7 +203,11 @@ int64_t zero_depth_call(evmc_uint256be gas_price,
 		     bridge_get_value_fn get_value_fn,
 		     bridge_get_block_hash_fn get_block_hash_fn,
 		     bridge_collect_result_fn collect_result_fn,
-		     bridge_call_precompiled_contract_fn call_precompiled_contract_fn);
+		     bridge_call_precompiled_contract_fn call_precompiled_contract_fn,
+		     bridge_revert_precompiled_contract_fn revert_precompiled_contract_fn);
+
+// Whether the contract at 'addr' is precompiled under 'cfg'. Go calls it to follow the decision of evmwrap.
+bool is_precompiled_address(const evmc_address* addr, const struct config* cfg);
 
 #ifdef __cplusplus
 }
@@ -20,18 +20,27 @@ static inline int64_t get_precompiled_id(const evmc_address& addr) {
 	return res;
 }
 
-static inline bool is_precompiled(int64_t id, const config cfg) {
-	return (1 <= id && id <= 9) ||
-	       id == STAKING_CONTRACT_ID ||
-	       (id == SEP109_CONTRACT_ID && cfg.after_xhedge_fork) ||
-	       id == SEP101_CONTRACT_ID ||
-	       id == SEP206_CONTRACT_ID;
+static inline bool is_precompiled(int64_t id, const config& cfg) {
+	// the addresses which are always precompiled, no matter whether Go registers them. 2, 3, 4, SEP101
+	// and SEP206 are implemented in C, and the others in Go.
+	if((1 <= id && id <= 9) || id == STAKING_CONTRACT_ID || id == SEP101_CONTRACT_ID || id == SEP206_CONTRACT_ID) {
+		return true;
+	}
+	// the other precompiled contracts implemented in Go, whose activation is decided by Go
+	for(int i=0; i<cfg.go_precompile_count; i++) {
+		if(int64_t(cfg.go_precompiles[i]) == id) return true;
+	}
+	return false;
 }
 
-static inline bool is_precompiled(const evmc_address& addr, const config cfg) {
+static inline bool is_precompiled(const evmc_address& addr, const config& cfg) {
 	return is_precompiled(get_precompiled_id(addr), cfg);
 }
 
+bool is_precompiled_address(const evmc_address* addr, const struct config* cfg) {
+	return is_precompiled(*addr, *cfg);
+}
+
 // following functions wrap C++ member functions into C-style functions, thus
 // we can build the virtual function table evmc_host_interface
 struct evmc_tx_context evmc_get_tx_context(struct evmc_host_context* context) {
@@ -422,14 +431,26 @@ evmc_result evmc_host_context::run_precompiled_contract(const evmc_address& addr
 	// the others use golang implementations
 	int ret_value, out_of_gas, osize;
 	uint64_t gas_left = msg.gas;
+	uint8_t* big_output = nullptr;
 
-	this->txctrl->call_precompiled_contract((struct evmc_address*)&addr/*drop const*/, (void*)msg.input_data,
-			msg.input_size, &gas_left, &ret_value, &out_of_gas, this->smallbuf, &osize);
-	if(out_of_gas != 0) {
-		return evmc_result{.status_code=EVMC_OUT_OF_GAS};
+	bool is_static = (msg.flags & EVMC_STATIC) != 0;
+
+	this->txctrl->call_precompiled_contract(txctrl->get_handler(), (struct evmc_address*)&addr/*drop const*/,
+			(struct evmc_address*)&msg.sender, (struct evmc_bytes32*)&msg.value, int(msg.kind), is_static, msg.depth,
+			(void*)msg.input_data, msg.input_size, &gas_left, &ret_value, &out_of_gas, this->smallbuf,
+			&big_output, &osize);
+	if(out_of_gas != 0 || ret_value != 1) {
+		free(big_output);
+		return evmc_result{.status_code=(out_of_gas != 0)? EVMC_OUT_OF_GAS : EVMC_PRECOMPILE_FAILURE};
 	}
-	if(ret_value != 1) {
-		return evmc_result{.status_code=EVMC_PRECOMPILE_FAILURE};
+	txctrl->add_go_precompile_call();
+	if(big_output != nullptr) { // the output is too large to fit in smallbuf
+		return evmc_result{
+			.status_code=EVMC_SUCCESS,
+			.gas_left=int64_t(gas_left),
+			.output_data=big_output,
+			.output_size=uint64_t(osize),
+			.release=evmc_free_result_memory};
 	}
 	return evmc_result{
 		.status_code=EVMC_SUCCESS,
@@ -627,7 +648,8 @@ int64_t zero_depth_call(evmc_uint256be gas_price,
 		     bridge_get_value_fn get_value_fn,
 		     bridge_get_block_hash_fn get_block_hash_fn,
 		     bridge_collect_result_fn collect_result_fn,
-		     bridge_call_precompiled_contract_fn call_precompiled_contract_fn) {
+		     bridge_call_precompiled_contract_fn call_precompiled_contract_fn,
+		     bridge_revert_precompiled_contract_fn revert_precompiled_contract_fn) {
 
 	std::array<big_buffer, 1> bigbuf;
 	auto r = world_state_reader {
@@ -679,7 +701,8 @@ int64_t zero_depth_call(evmc_uint256be gas_price,
 	};
 	evmc_vm* vm = evmc_create_evmone();
 
-	tx_control txctrl(&r, tx_context, vm->execute, call_precompiled_contract_fn, need_gas_estimation, block->cfg);
+	tx_control txctrl(&r, tx_context, vm->execute, call_precompiled_contract_fn,
+		revert_precompiled_contract_fn, need_gas_estimation, block->cfg);
 	small_buffer smallbuf;
 	evmc_host_context ctx(&txctrl, msg, &smallbuf, revision);
 	uint256 balance = ctx.get_balance_as_uint256(*sender);
@@ -386,6 +386,8 @@ void journal_entry::revert(cached_state* state) {
 	case LOG_QUEUE_ADD:
 		state->pop_log();
 		break;
+	case GO_PRECOMPILE_CALL: // reverted by tx_control, because the changes are not cached in state
+		break;
 	}
 }
 
@@ -289,6 +289,7 @@ enum journal_type {
 	CREATION_COUNTER_INCR,
 	REFUND_CHG,
 	LOG_QUEUE_ADD,
+	GO_PRECOMPILE_CALL,
 };
 
 // We use Tagged-Union for journal_entry, instead of interface pointers, because it's friendly 
@@ -363,21 +364,29 @@ class tx_control {
 public:
 	// this function provides precompile contracts' functionality from Go to C
 	bridge_call_precompiled_contract_fn call_precompiled_contract;
+	// this function reverts the state changes made by the last successful call_precompiled_contract
+	bridge_revert_precompiled_contract_fn revert_precompiled_contract;
 
 	tx_control(world_state_reader* r, const evmc_tx_context& c, evmc_execute_fn f,
-		bridge_call_precompiled_contract_fn cpc, bool nge, const config cfg):
+		bridge_call_precompiled_contract_fn cpc, bridge_revert_precompiled_contract_fn rpc,
+		bool nge, const config cfg):
 		journal(), cstate(r), world(r), tx_context(c), execute_fn(f),
-		need_gas_estimation(nge), cfg(cfg), call_precompiled_contract(cpc) {
+		need_gas_estimation(nge), cfg(cfg), call_precompiled_contract(cpc),
+		revert_precompiled_contract(rpc) {
 		journal.reserve(100);
 		if(need_gas_estimation) {
 			gas_trace.reserve(100);
 		}
 	}
 
-	config get_cfg() {
+	const config& get_cfg() {
 		return cfg;
 	}
 
+	int get_handler() {
+		return world->handler;
+	}
+
 	int64_t get_block_number() {
 		return tx_context.block_number;
 	}
@@ -403,10 +412,18 @@ public:
 	void revert_to_snapshot(size_t snapshot_id) {
 		//std::cerr<<"revert "<<journal.size()<<" => "<<snapshot_id<<std::endl;
 		while(journal.size() > snapshot_id) {
-			journal.back().revert(&cstate);
+			if(journal.back().type == GO_PRECOMPILE_CALL) { // the changes are made in Go
+				revert_precompiled_contract(world->handler);
+			} else {
+				journal.back().revert(&cstate);
+			}
 			journal.pop_back();
 		}
 	}
+	// record a successful call to a Go-implemented precompiled contract, whose changes may be reverted later
+	void add_go_precompile_call() {
+		journal.push_back(journal_entry{.type=GO_PRECOMPILE_CALL});
+	}
 	// append new log to the transaction's log list
 	void add_log(const evmc_address& addr, const uint8_t* data_ptr, size_t data_size,
 			const evmc_bytes32 topics_ptr[], size_t topics_count) {
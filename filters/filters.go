@@ -0,0 +1,290 @@
+// Package filters implements the filters of eth_newFilter and eth_newBlockFilter, which are polled with
+// eth_getFilterChanges, and the subscriptions of eth_subscribe. They are fed with the ChainEvents of the
+// committed blocks, and the RPC layer wraps the Manager to serve the requests.
+package filters
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	"github.com/smartbch/moeingevm/types"
+)
+
+const (
+	// a filter is uninstalled if it is not polled for such a long time, like geth
+	DefaultFilterTimeout = 5 * time.Minute
+	// the number of ChainEvents a subscription can lag behind before it is dropped
+	SubscriptionBufferSize = 128
+)
+
+var (
+	ErrFilterNotFound      = errors.New("filter not found")
+	ErrSubscriptionLagging = errors.New("subscription dropped for lagging behind")
+)
+
+type Type int
+
+const (
+	LogsFilter Type = iota
+	BlocksFilter
+)
+
+type filter struct {
+	typ      Type
+	crit     ethereum.FilterQuery
+	deadline time.Time
+	logs     []*gethtypes.Log
+	hashes   []common.Hash
+}
+
+// Subscription receives the logs or the headers of the new blocks from its channel, until the channel is
+// closed because of Unsubscribe, Manager.Close, or lagging behind for more than SubscriptionBufferSize blocks.
+// Err tells the last case from the others.
+type Subscription struct {
+	ID      rpc.ID
+	Logs    <-chan []*gethtypes.Log // only for the subscriptions of logs
+	Headers <-chan *types.Header    // only for the subscriptions of new heads
+
+	crit    ethereum.FilterQuery
+	logs    chan []*gethtypes.Log
+	headers chan *types.Header
+	err     chan error
+	m       *Manager
+}
+
+// Err returns a channel which is closed together with the channel of the subscription, like geth's
+// event.Subscription. ErrSubscriptionLagging is sent to it before it is closed if the subscription is dropped
+// for lagging behind, and nothing is sent if it is closed by Unsubscribe or Manager.Close.
+func (sub *Subscription) Err() <-chan error {
+	return sub.err
+}
+
+func (sub *Subscription) Unsubscribe() {
+	sub.m.mtx.Lock()
+	defer sub.m.mtx.Unlock()
+	sub.m.removeSubscription(sub.ID, nil)
+}
+
+type Manager struct {
+	mtx     sync.Mutex
+	timeout time.Duration
+	now     func() time.Time
+	filters map[rpc.ID]*filter
+	subs    map[rpc.ID]*Subscription
+}
+
+// NewManager returns a Manager whose filters time out after timeout, or DefaultFilterTimeout if it is not positive
+func NewManager(timeout time.Duration) *Manager {
+	if timeout <= 0 {
+		timeout = DefaultFilterTimeout
+	}
+	return &Manager{
+		timeout: timeout,
+		now:     time.Now,
+		filters: make(map[rpc.ID]*filter),
+		subs:    make(map[rpc.ID]*Subscription),
+	}
+}
+
+// NewFilter installs a filter of the logs matching crit, in the new blocks
+func (m *Manager) NewFilter(crit ethereum.FilterQuery) rpc.ID {
+	return m.install(&filter{typ: LogsFilter, crit: crit})
+}
+
+// NewBlockFilter installs a filter of the hashes of the new blocks
+func (m *Manager) NewBlockFilter() rpc.ID {
+	return m.install(&filter{typ: BlocksFilter})
+}
+
+func (m *Manager) install(f *filter) rpc.ID {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	id := rpc.NewID()
+	f.deadline = m.now().Add(m.timeout)
+	m.filters[id] = f
+	return id
+}
+
+// GetFilterChanges returns the logs ([]*gethtypes.Log) or the block hashes ([]common.Hash) collected by the
+// filter since the last call, and postpones the deadline of the filter
+func (m *Manager) GetFilterChanges(id rpc.ID) (interface{}, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	f, ok := m.filters[id]
+	if !ok {
+		return nil, ErrFilterNotFound
+	}
+	f.deadline = m.now().Add(m.timeout)
+	if f.typ == BlocksFilter {
+		hashes := f.hashes
+		f.hashes = nil
+		if hashes == nil {
+			hashes = []common.Hash{}
+		}
+		return hashes, nil
+	}
+	logs := f.logs
+	f.logs = nil
+	if logs == nil {
+		logs = []*gethtypes.Log{}
+	}
+	return logs, nil
+}
+
+// UninstallFilter returns whether the filter was installed
+func (m *Manager) UninstallFilter(id rpc.ID) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	_, ok := m.filters[id]
+	delete(m.filters, id)
+	return ok
+}
+
+// SubscribeLogs subscribes the logs matching crit, in the new blocks
+func (m *Manager) SubscribeLogs(crit ethereum.FilterQuery) *Subscription {
+	logs := make(chan []*gethtypes.Log, SubscriptionBufferSize)
+	return m.subscribe(&Subscription{Logs: logs, logs: logs, crit: crit})
+}
+
+// SubscribeNewHeads subscribes the headers of the new blocks
+func (m *Manager) SubscribeNewHeads() *Subscription {
+	headers := make(chan *types.Header, SubscriptionBufferSize)
+	return m.subscribe(&Subscription{Headers: headers, headers: headers})
+}
+
+func (m *Manager) subscribe(sub *Subscription) *Subscription {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	sub.ID = rpc.NewID()
+	sub.err = make(chan error, 1)
+	sub.m = m
+	m.subs[sub.ID] = sub
+	return sub
+}
+
+// removeSubscription closes the channels of the subscription, after sending err to Err if it is not nil
+func (m *Manager) removeSubscription(id rpc.ID, err error) {
+	sub, ok := m.subs[id]
+	if !ok {
+		return
+	}
+	delete(m.subs, id)
+	if err != nil {
+		sub.err <- err
+	}
+	close(sub.err)
+	if sub.logs != nil {
+		close(sub.logs)
+	} else {
+		close(sub.headers)
+	}
+}
+
+// OnChainEvent feeds the block in ev to the filters and the subscriptions
+func (m *Manager) OnChainEvent(ev types.ChainEvent) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for _, f := range m.filters {
+		if f.typ == BlocksFilter {
+			f.hashes = append(f.hashes, ev.Hash)
+		} else {
+			f.logs = append(f.logs, filterLogs(ev.Logs, f.crit)...)
+		}
+	}
+	for id, sub := range m.subs {
+		var lagging bool
+		if sub.logs != nil {
+			logs := filterLogs(ev.Logs, sub.crit)
+			if len(logs) == 0 {
+				continue
+			}
+			select {
+			case sub.logs <- logs:
+			default:
+				lagging = true
+			}
+		} else {
+			select {
+			case sub.headers <- ev.BlockHeader:
+			default:
+				lagging = true
+			}
+		}
+		if lagging {
+			m.removeSubscription(id, ErrSubscriptionLagging)
+		}
+	}
+}
+
+// RemoveIdleFilters uninstalls the filters which are not polled before their deadlines
+func (m *Manager) RemoveIdleFilters() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	now := m.now()
+	for id, f := range m.filters {
+		if now.After(f.deadline) {
+			delete(m.filters, id)
+		}
+	}
+}
+
+// Run feeds the ChainEvents from events to the filters and the subscriptions, and removes the idle filters
+// periodically, so a filter is removed no later than a quarter of the timeout after its deadline. It returns
+// after events is closed, with all the subscriptions closed.
+func (m *Manager) Run(events <-chan types.ChainEvent) {
+	ticker := time.NewTicker(m.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				m.Close()
+				return
+			}
+			m.OnChainEvent(ev)
+		case <-ticker.C:
+			m.RemoveIdleFilters()
+		}
+	}
+}
+
+// Close uninstalls all the filters and closes all the subscriptions
+func (m *Manager) Close() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for id := range m.subs {
+		m.removeSubscription(id, nil)
+	}
+	m.filters = make(map[rpc.ID]*filter)
+}
+
+// filterLogs returns the logs matching crit with types.FilterLog. A negative block number in crit means
+// the latest or pending block, which does not limit the range, like geth.
+func filterLogs(logs []*gethtypes.Log, crit ethereum.FilterQuery) (res []*gethtypes.Log) {
+	for _, log := range logs {
+		if crit.BlockHash != nil && *crit.BlockHash != log.BlockHash {
+			continue
+		}
+		if isBlockNumberSet(crit.FromBlock) && crit.FromBlock.Uint64() > log.BlockNumber {
+			continue
+		}
+		if isBlockNumberSet(crit.ToBlock) && crit.ToBlock.Uint64() < log.BlockNumber {
+			continue
+		}
+		if types.FilterLog(log.Address, log.Topics, crit.Addresses, crit.Topics) {
+			res = append(res, log)
+		}
+	}
+	return
+}
+
+func isBlockNumberSet(n *big.Int) bool {
+	return n != nil && n.Sign() >= 0
+}
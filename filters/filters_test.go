@@ -0,0 +1,140 @@
+package filters
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/require"
+
+	"github.com/smartbch/moeingevm/types"
+)
+
+var (
+	contract = common.HexToAddress("0xc")
+	topicA   = common.HexToHash("0xa")
+	topicB   = common.HexToHash("0xb")
+)
+
+func chainEvent(height uint64, logTopics ...[]common.Hash) types.ChainEvent {
+	hash := common.BigToHash(new(big.Int).SetUint64(height))
+	ev := types.ChainEvent{
+		BlockHeader: &types.Header{Number: hexutil.Uint64(height), BlockHash: hash},
+		Hash:        hash,
+	}
+	for i, topics := range logTopics {
+		ev.Logs = append(ev.Logs, &gethtypes.Log{Address: contract, Topics: topics,
+			BlockNumber: height, BlockHash: hash, Index: uint(i)})
+	}
+	return ev
+}
+
+func TestFilters(t *testing.T) {
+	m := NewManager(time.Minute)
+	now := time.Unix(1000, 0)
+	m.now = func() time.Time { return now }
+
+	blockID := m.NewBlockFilter()
+	logID := m.NewFilter(ethereum.FilterQuery{Addresses: []common.Address{contract},
+		Topics: [][]common.Hash{{topicA}}})
+	rangeID := m.NewFilter(ethereum.FilterQuery{FromBlock: big.NewInt(2), ToBlock: big.NewInt(2)})
+	latestID := m.NewFilter(ethereum.FilterQuery{FromBlock: big.NewInt(2), ToBlock: big.NewInt(-1)})
+
+	m.OnChainEvent(chainEvent(1, []common.Hash{topicA}, []common.Hash{topicB}))
+	m.OnChainEvent(chainEvent(2, []common.Hash{topicB, topicA}, []common.Hash{topicA, topicB}))
+	m.OnChainEvent(chainEvent(3))
+
+	changes, err := m.GetFilterChanges(blockID)
+	require.Nil(t, err)
+	require.Equal(t, []common.Hash{chainEvent(1).Hash, chainEvent(2).Hash, chainEvent(3).Hash}, changes)
+	changes, err = m.GetFilterChanges(blockID)
+	require.Nil(t, err)
+	require.Equal(t, []common.Hash{}, changes)
+
+	changes, err = m.GetFilterChanges(logID)
+	require.Nil(t, err)
+	logs := changes.([]*gethtypes.Log)
+	require.Equal(t, 2, len(logs))
+	require.Equal(t, [2]uint64{1, 2}, [2]uint64{logs[0].BlockNumber, logs[1].BlockNumber})
+	require.Equal(t, uint(1), logs[1].Index) // topicA is not at position 0 in the first log of block 2
+
+	changes, err = m.GetFilterChanges(rangeID)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(changes.([]*gethtypes.Log)))
+	changes, err = m.GetFilterChanges(latestID)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(changes.([]*gethtypes.Log)))
+
+	// the filters not polled in time are removed
+	now = now.Add(40 * time.Second)
+	_, err = m.GetFilterChanges(blockID)
+	require.Nil(t, err)
+	now = now.Add(40 * time.Second)
+	m.RemoveIdleFilters()
+	_, err = m.GetFilterChanges(blockID)
+	require.Nil(t, err)
+	_, err = m.GetFilterChanges(logID)
+	require.Equal(t, ErrFilterNotFound, err)
+
+	require.True(t, m.UninstallFilter(blockID))
+	require.False(t, m.UninstallFilter(blockID))
+	_, err = m.GetFilterChanges(blockID)
+	require.Equal(t, ErrFilterNotFound, err)
+}
+
+func TestSubscriptions(t *testing.T) {
+	m := NewManager(time.Minute)
+	heads := m.SubscribeNewHeads()
+	logSub := m.SubscribeLogs(ethereum.FilterQuery{Topics: [][]common.Hash{nil, {topicA}}})
+	lagging := m.SubscribeNewHeads()
+
+	m.OnChainEvent(chainEvent(1, []common.Hash{topicA}))
+	m.OnChainEvent(chainEvent(2, []common.Hash{topicB, topicA}))
+	require.Equal(t, hexutil.Uint64(1), (<-heads.Headers).Number)
+	require.Equal(t, hexutil.Uint64(2), (<-heads.Headers).Number)
+	logs := <-logSub.Logs
+	require.Equal(t, 1, len(logs))
+	require.Equal(t, uint64(2), logs[0].BlockNumber)
+	select {
+	case <-logSub.Logs:
+		t.Fatal("block 1 has no matching logs")
+	default:
+	}
+
+	logSub.Unsubscribe()
+	_, ok := <-logSub.Logs
+	require.False(t, ok)
+	_, ok = <-logSub.Err()
+	require.False(t, ok)
+	logSub.Unsubscribe() // it is fine to unsubscribe twice
+
+	// a subscriber which does not keep up is dropped, without blocking the others
+	for h := uint64(3); h < 3+SubscriptionBufferSize; h++ {
+		m.OnChainEvent(chainEvent(h))
+		<-heads.Headers
+	}
+	for range lagging.Headers {
+	}
+	require.Equal(t, ErrSubscriptionLagging, <-lagging.Err())
+	_, ok = <-lagging.Err()
+	require.False(t, ok)
+
+	events := make(chan types.ChainEvent)
+	done := make(chan struct{})
+	go func() {
+		m.Run(events)
+		close(done)
+	}()
+	events <- chainEvent(1000)
+	require.Equal(t, hexutil.Uint64(1000), (<-heads.Headers).Number)
+	close(events)
+	<-done
+	_, ok = <-heads.Headers
+	require.False(t, ok)
+	_, ok = <-heads.Err()
+	require.False(t, ok)
+}
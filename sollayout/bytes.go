@@ -0,0 +1,105 @@
+package sollayout
+
+import (
+	"errors"
+
+	"github.com/holiman/uint256"
+)
+
+// Solidity stores a bytes or string value of at most 31 bytes in one slot: the data are left-aligned and
+// the lowest-order byte is length*2. A longer value stores length*2+1 at the slot, and its data start at
+// the slot keccak256(slot). So the lowest bit of the slot tells which encoding is used.
+
+// MaxBytesLength is the largest length accepted by GetBytes and SetBytes. Writing such a value with the
+// EVM takes 32768 SSTOREs, which cost more gas than a block has.
+const MaxBytesLength = 1 << 20
+
+var (
+	// solc panics with code 0x22 when it reads such a slot
+	ErrInvalidBytesEncoding = errors.New("incorrectly encoded bytes or string in storage")
+	ErrBytesTooLong         = errors.New("bytes or string is longer than MaxBytesLength")
+)
+
+// bytesLength decodes the word at the slot of a bytes or string value. Like solc, it rejects the long
+// encoding of less than 32 bytes and the short encoding of more than 31 bytes.
+func bytesLength(word *uint256.Int) (length uint64, isLong bool, err error) {
+	if word.Uint64()&1 == 0 {
+		length = (word.Uint64() & 0xFF) / 2
+		if length >= 32 {
+			return 0, false, ErrInvalidBytesEncoding
+		}
+		return length, false, nil
+	}
+	if !word.IsUint64() || (word.Uint64()-1)/2 > MaxBytesLength {
+		return 0, true, ErrBytesTooLong
+	}
+	length = (word.Uint64() - 1) / 2
+	if length < 32 {
+		return 0, true, ErrInvalidBytesEncoding
+	}
+	return length, true, nil
+}
+
+func (s *Storage) GetBytes(slot *uint256.Int) ([]byte, error) {
+	word := s.Get(slot)
+	length, isLong, err := bytesLength(word)
+	if err != nil {
+		return nil, err
+	}
+	if !isLong {
+		b := word.PaddedBytes(32)
+		return b[:length], nil
+	}
+	data := make([]byte, 0, length+31)
+	dataSlot := DynamicArrayDataSlot(slot)
+	for i := uint64(0); uint64(len(data)) < length; i++ {
+		data = append(data, s.Get(Offset(dataSlot, i)).PaddedBytes(32)...)
+	}
+	return data[:length], nil
+}
+
+// SetBytes writes data to slot, and clears the slots which were used by the old value but not by the new one.
+// It fails without writing anything if data is too long or the old value is not correctly encoded.
+func (s *Storage) SetBytes(slot *uint256.Int, data []byte) error {
+	if len(data) > MaxBytesLength {
+		return ErrBytesTooLong
+	}
+	oldLength, oldIsLong, err := bytesLength(s.Get(slot))
+	if err != nil {
+		return err
+	}
+	oldWords := uint64(0)
+	if oldIsLong {
+		oldWords = (oldLength + 31) / 32
+	}
+	newWords := uint64(0)
+	if len(data) < 32 {
+		var word [32]byte
+		copy(word[:], data)
+		word[31] = byte(len(data) * 2)
+		s.Set(slot, uint256.NewInt(0).SetBytes(word[:]))
+	} else {
+		s.Set(slot, uint256.NewInt(uint64(len(data))*2+1))
+		dataSlot := DynamicArrayDataSlot(slot)
+		for i := 0; i < len(data); i += 32 {
+			var word [32]byte
+			copy(word[:], data[i:])
+			s.Set(Offset(dataSlot, newWords), uint256.NewInt(0).SetBytes(word[:]))
+			newWords++
+		}
+	}
+	dataSlot := DynamicArrayDataSlot(slot)
+	for i := newWords; i < oldWords; i++ {
+		s.Set(Offset(dataSlot, i), uint256.NewInt(0))
+	}
+	return nil
+}
+
+func (s *Storage) GetString(slot *uint256.Int) (string, error) {
+	b, err := s.GetBytes(slot)
+	return string(b), err
+}
+
+func (s *Storage) SetString(slot *uint256.Int, str string) error {
+	return s.SetBytes(slot, []byte(str))
+}
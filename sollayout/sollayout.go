@@ -0,0 +1,165 @@
+// Package sollayout reads and writes the storage of smart contracts in the layout used by Solidity, such
+// that the system contracts implemented in Go can share states with the contracts compiled by solc.
+// See https://docs.soliditylang.org/en/latest/internals/layout_in_storage.html
+package sollayout
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+
+	"github.com/smartbch/moeingevm/types"
+)
+
+// A slot is the position of a 32-byte word in a contract's storage
+func NewSlot(n uint64) *uint256.Int {
+	return uint256.NewInt(n)
+}
+
+// SlotKey returns the key used by types.Context to store the word at slot
+func SlotKey(slot *uint256.Int) string {
+	return string(slot.PaddedBytes(32))
+}
+
+// Offset returns the slot of a struct member or a static array element, which is n slots after slot
+func Offset(slot *uint256.Int, n uint64) *uint256.Int {
+	return uint256.NewInt(0).AddUint64(slot, n)
+}
+
+// The keys of mappings are encoded before hashing: value types are padded to 32 bytes, while
+// strings and bytes are not padded
+
+func AddressKey(addr common.Address) []byte {
+	return common.LeftPadBytes(addr[:], 32)
+}
+
+func UintKey(n *uint256.Int) []byte {
+	return n.PaddedBytes(32)
+}
+
+func Bytes32Key(b [32]byte) []byte {
+	return b[:]
+}
+
+func StringKey(s string) []byte {
+	return []byte(s)
+}
+
+// MappingSlot returns the slot of mapping[key], where mapSlot is the slot of the mapping itself
+func MappingSlot(mapSlot *uint256.Int, key []byte) *uint256.Int {
+	return uint256.NewInt(0).SetBytes(crypto.Keccak256(key, mapSlot.PaddedBytes(32)))
+}
+
+// NestedMappingSlot returns the slot of mapping[keys[0]][keys[1]]...
+func NestedMappingSlot(mapSlot *uint256.Int, keys ...[]byte) *uint256.Int {
+	slot := mapSlot
+	for _, key := range keys {
+		slot = MappingSlot(slot, key)
+	}
+	return slot
+}
+
+// DynamicArrayDataSlot returns the slot of the first element of a dynamic array, whose length is stored at arrSlot
+func DynamicArrayDataSlot(arrSlot *uint256.Int) *uint256.Int {
+	return uint256.NewInt(0).SetBytes(crypto.Keccak256(arrSlot.PaddedBytes(32)))
+}
+
+// ArrayElementSlot returns the slot of the index-th element of a dynamic array, whose elements take
+// elemSlots slots each (for example, a struct with three uint256 members takes three slots)
+func ArrayElementSlot(arrSlot *uint256.Int, index uint64, elemSlots uint64) *uint256.Int {
+	return Offset(DynamicArrayDataSlot(arrSlot), index*elemSlots)
+}
+
+// PackedArrayElement returns the position of the index-th element of a dynamic array whose elements are
+// elemSize bytes (not larger than 16) and packed into slots, such as uint64[] and address[]... Note that
+// address takes 20 bytes, so an address[] array has only one element in each slot.
+func PackedArrayElement(arrSlot *uint256.Int, index uint64, elemSize int) (slot *uint256.Int, offset int) {
+	perSlot := uint64(32 / elemSize)
+	slot = Offset(DynamicArrayDataSlot(arrSlot), index/perSlot)
+	offset = int(index%perSlot) * elemSize
+	return
+}
+
+// Field locates a value in a contract or a struct, using the 'slot' and 'offset' of solc's storageLayout
+// output and the size of the value's type. Offset counts bytes from the lowest-order byte of the slot.
+type Field struct {
+	Slot   uint64
+	Offset int
+	Size   int
+}
+
+// Storage accesses the storage of the contract whose account sequence is seq
+type Storage struct {
+	ctx *types.Context
+	seq uint64
+}
+
+func NewStorage(ctx *types.Context, seq uint64) *Storage {
+	return &Storage{ctx: ctx, seq: seq}
+}
+
+func (s *Storage) Get(slot *uint256.Int) *uint256.Int {
+	return uint256.NewInt(0).SetBytes(s.ctx.GetStorageAt(s.seq, SlotKey(slot)))
+}
+
+// Set writes a word to storage. Just like the EVM, zero is not stored.
+func (s *Storage) Set(slot *uint256.Int, value *uint256.Int) {
+	if value.IsZero() {
+		s.ctx.DeleteStorageAt(s.seq, SlotKey(slot))
+	} else {
+		s.ctx.SetStorageAt(s.seq, SlotKey(slot), value.PaddedBytes(32))
+	}
+}
+
+func sizeMask(size int) *uint256.Int {
+	mask := uint256.NewInt(1)
+	mask.Lsh(mask, uint(size*8))
+	return mask.SubUint64(mask, 1)
+}
+
+// GetPacked reads a value of 'size' bytes at 'offset' of the slot, where offset counts from the lowest-order byte
+func (s *Storage) GetPacked(slot *uint256.Int, offset, size int) *uint256.Int {
+	value := s.Get(slot)
+	value.Rsh(value, uint(offset*8))
+	return value.And(value, sizeMask(size))
+}
+
+// SetPacked writes a value of 'size' bytes at 'offset' of the slot, and keeps the other bytes of the slot.
+// The higher bytes of value which do not fit in size are ignored.
+func (s *Storage) SetPacked(slot *uint256.Int, offset, size int, value *uint256.Int) {
+	mask := sizeMask(size)
+	v := uint256.NewInt(0).And(value, mask)
+	v.Lsh(v, uint(offset*8))
+	mask.Lsh(mask, uint(offset*8))
+	word := s.Get(slot)
+	word.And(word, mask.Not(mask))
+	s.Set(slot, word.Or(word, v))
+}
+
+func (s *Storage) GetField(base *uint256.Int, f Field) *uint256.Int {
+	return s.GetPacked(Offset(base, f.Slot), f.Offset, f.Size)
+}
+
+func (s *Storage) SetField(base *uint256.Int, f Field, value *uint256.Int) {
+	s.SetPacked(Offset(base, f.Slot), f.Offset, f.Size, value)
+}
+
+func (s *Storage) GetAddress(slot *uint256.Int, offset int) common.Address {
+	return common.Address(s.GetPacked(slot, offset, common.AddressLength).Bytes20())
+}
+
+func (s *Storage) SetAddress(slot *uint256.Int, offset int, addr common.Address) {
+	s.SetPacked(slot, offset, common.AddressLength, uint256.NewInt(0).SetBytes(addr[:]))
+}
+
+func (s *Storage) GetBool(slot *uint256.Int, offset int) bool {
+	return !s.GetPacked(slot, offset, 1).IsZero()
+}
+
+func (s *Storage) SetBool(slot *uint256.Int, offset int, b bool) {
+	var v uint64
+	if b {
+		v = 1
+	}
+	s.SetPacked(slot, offset, 1, uint256.NewInt(v))
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/holiman/uint256"
 	"github.com/smartbch/moeingads/store/rabbit"
+	storetypes "github.com/smartbch/moeingads/store/types"
 	modbtypes "github.com/smartbch/moeingdb/types"
 )
 
@@ -18,42 +19,74 @@ var (
 	ErrSameNonceAlredyInBlock = errors.New("tx with same nonce already in block")
 	ErrNonceTooLarge          = errors.New("tx nonce is larger than the account nonce")
 	ErrTooManyEntries         = errors.New("too many candidicate entries to be returned, please limit the difference between startHeight and endHeight")
+	ErrTooManyAddresses       = errors.New("too many addresses to query logs")
+	ErrAccountsLocked         = errors.New("accounts and bytecodes cannot be written while they are locked")
 )
 
 type Context struct {
-	Rbt              *rabbit.RabbitStore
-	Db               modbtypes.DB
-	Height           int64
-	XHedgeForkBlock  int64
-	ShaGateForkBlock int64
+	Rbt                    *rabbit.RabbitStore
+	Db                     modbtypes.DB
+	Height                 int64
+	XHedgeForkBlock        int64
+	ShaGateForkBlock       int64
+	BerlinForkBlock        int64
+	SeqIndexForkBlock      int64
+	BlockGasLimitForkBlock int64
+
+	// when historical is true, Rbt reads the state as of the end of the block at Height
+	historical bool
+
+	// when accountsLocked is true, writing accounts or bytecodes through the methods of Context panics
+	accountsLocked bool
+
+	// when journalOn is true, the original values of the keys written through the methods of Context
+	// are recorded in journal, such that the writes can be reverted
+	journalOn bool
+	journal   []journalEntry
+}
+
+type journalEntry struct {
+	key      []byte
+	oldValue []byte // nil means the key did not exist
 }
 
 func NewContext(rbt *rabbit.RabbitStore, db modbtypes.DB) *Context {
 	return &Context{
-		Rbt:              rbt,
-		Db:               db,
-		XHedgeForkBlock:  math.MaxInt64,
-		ShaGateForkBlock: math.MaxInt64,
+		Rbt:                    rbt,
+		Db:                     db,
+		XHedgeForkBlock:        math.MaxInt64,
+		ShaGateForkBlock:       math.MaxInt64,
+		BerlinForkBlock:        math.MaxInt64,
+		SeqIndexForkBlock:      math.MaxInt64,
+		BlockGasLimitForkBlock: math.MaxInt64,
 	}
 }
 
 func (c *Context) WithRbt(rabbitStore *rabbit.RabbitStore) *Context {
 	return &Context{
-		Rbt:              rabbitStore,
-		Db:               c.Db,
-		XHedgeForkBlock:  c.XHedgeForkBlock,
-		ShaGateForkBlock: c.ShaGateForkBlock,
-		Height:           c.Height,
+		Rbt:                    rabbitStore,
+		Db:                     c.Db,
+		XHedgeForkBlock:        c.XHedgeForkBlock,
+		ShaGateForkBlock:       c.ShaGateForkBlock,
+		BerlinForkBlock:        c.BerlinForkBlock,
+		SeqIndexForkBlock:      c.SeqIndexForkBlock,
+		BlockGasLimitForkBlock: c.BlockGasLimitForkBlock,
+		Height:                 c.Height,
+		historical:             c.historical,
 	}
 }
 
 func (c *Context) WithDb(db modbtypes.DB) *Context {
 	return &Context{
-		Rbt:              c.Rbt,
-		Db:               db,
-		XHedgeForkBlock:  c.XHedgeForkBlock,
-		ShaGateForkBlock: c.ShaGateForkBlock,
-		Height:           c.Height,
+		Rbt:                    c.Rbt,
+		Db:                     db,
+		XHedgeForkBlock:        c.XHedgeForkBlock,
+		ShaGateForkBlock:       c.ShaGateForkBlock,
+		BerlinForkBlock:        c.BerlinForkBlock,
+		SeqIndexForkBlock:      c.SeqIndexForkBlock,
+		BlockGasLimitForkBlock: c.BlockGasLimitForkBlock,
+		Height:                 c.Height,
+		historical:             c.historical,
 	}
 }
 
@@ -65,6 +98,22 @@ func (c *Context) SetShaGateForkBlock(shaGateForkBlock int64) {
 	c.ShaGateForkBlock = shaGateForkBlock
 }
 
+// SetBerlinForkBlock sets the height since which bigModExp is repriced with EIP-2565. evmwrap still
+// runs EVMC_ISTANBUL, so the other changes of Berlin (such as EIP-2929) are not applied.
+func (c *Context) SetBerlinForkBlock(berlinForkBlock int64) {
+	c.BerlinForkBlock = berlinForkBlock
+}
+
+func (c *Context) SetSeqIndexForkBlock(seqIndexForkBlock int64) {
+	c.SeqIndexForkBlock = seqIndexForkBlock
+}
+
+// SetBlockGasLimitForkBlock sets the height since which the total gas of the transactions executed in a
+// block is limited by the block's GasLimit
+func (c *Context) SetBlockGasLimitForkBlock(blockGasLimitForkBlock int64) {
+	c.BlockGasLimitForkBlock = blockGasLimitForkBlock
+}
+
 func (c *Context) SetCurrentHeight(height int64) {
 	c.Height = height
 }
@@ -77,20 +126,66 @@ func (c *Context) IsShaGateFork() bool {
 	return c.Height >= c.ShaGateForkBlock
 }
 
+func (c *Context) IsBerlinFork() bool {
+	return c.Height >= c.BerlinForkBlock
+}
+
+func (c *Context) IsSeqIndexFork() bool {
+	return c.Height >= c.SeqIndexForkBlock
+}
+
+func (c *Context) IsBlockGasLimitFork() bool {
+	return c.Height >= c.BlockGasLimitForkBlock
+}
+
 //new empty rbt with same parent store as the old one
 func (c *Context) WithRbtCopy() *Context {
 	if !c.Rbt.IsClean() {
 		panic("Can not copy when rabbitstore is not clean")
 	}
+	return c.WithNestedRbt()
+}
+
+// NewContextAtHeight returns a Context which reads the state as of the end of the block at height from parent,
+// through a read-only RabbitStore. parent must keep the history, which requires the MoeingADS under it to be
+// created with canQueryHistory set to true. The writes made to the returned Context are only kept in the cache
+// of its Rbt, so it can be used to run transactions for RPC, but it must be closed with Close(false).
+func NewContextAtHeight(parent storetypes.BaseStoreI, db modbtypes.DB, height int64) (*Context, error) {
+	if height < 0 || (db != nil && height > db.GetLatestHeight()) {
+		return nil, ErrInvalidHeight
+	}
+	r := rabbit.NewReadOnlyRabbitStoreAtHeight(parent, uint64(height))
+	ctx := NewContext(&r, db)
+	ctx.Height = height
+	ctx.historical = true
+	return ctx, nil
+}
+
+// WithRbtAtHeight is like NewContextAtHeight, with the parent store of c.Rbt and the settings of c
+func (c *Context) WithRbtAtHeight(height int64) (*Context, error) {
+	ctx, err := NewContextAtHeight(c.Rbt.GetBaseStore(), c.Db, height)
+	if err != nil {
+		return nil, err
+	}
+	ctx.XHedgeForkBlock = c.XHedgeForkBlock
+	ctx.ShaGateForkBlock = c.ShaGateForkBlock
+	ctx.BerlinForkBlock = c.BerlinForkBlock
+	ctx.SeqIndexForkBlock = c.SeqIndexForkBlock
+	ctx.BlockGasLimitForkBlock = c.BlockGasLimitForkBlock
+	return ctx, nil
+}
+
+// WithNestedRbt returns a Context with a new RabbitStore over the parent store of c.Rbt, which reads the same
+// state as c.Rbt, without the writes cached in c.Rbt
+func (c *Context) WithNestedRbt() *Context {
 	parent := c.Rbt.GetBaseStore()
-	r := rabbit.NewRabbitStore(parent)
-	return &Context{
-		Rbt:              &r,
-		Db:               c.Db,
-		ShaGateForkBlock: c.ShaGateForkBlock,
-		XHedgeForkBlock:  c.XHedgeForkBlock,
-		Height:           c.Height,
+	var r rabbit.RabbitStore
+	if c.historical {
+		r = rabbit.NewReadOnlyRabbitStoreAtHeight(parent, uint64(c.Height))
+	} else {
+		r = rabbit.NewRabbitStore(parent)
 	}
+	return c.WithRbt(&r)
 }
 
 func (c *Context) Close(dirty bool) {
@@ -99,6 +194,70 @@ func (c *Context) Close(dirty bool) {
 	}
 }
 
+// StartJournal begins to record the writes made through the methods of Context, such that they can be
+// reverted with RevertToSnapshot. The writes made directly to c.Rbt are not recorded.
+func (c *Context) StartJournal() {
+	c.journalOn = true
+	c.journal = c.journal[:0]
+}
+
+// StopJournal stops recording the writes and forgets the recorded ones
+func (c *Context) StopJournal() {
+	c.journalOn = false
+	c.journal = nil
+}
+
+// Snapshot returns an ID which can be used to revert the writes made after this call
+func (c *Context) Snapshot() int {
+	return len(c.journal)
+}
+
+// RevertToSnapshot reverts the recorded writes made after snapshot was taken, in the reverse order
+func (c *Context) RevertToSnapshot(snapshot int) {
+	for i := len(c.journal) - 1; i >= snapshot; i-- {
+		e := c.journal[i]
+		if e.oldValue == nil {
+			c.Rbt.Delete(e.key)
+		} else {
+			c.Rbt.Set(e.key, e.oldValue)
+		}
+	}
+	c.journal = c.journal[:snapshot]
+}
+
+// LockAccounts makes the writes to accounts and bytecodes through the methods of Context panic with
+// ErrAccountsLocked, until UnlockAccounts is called. The EVM caches the accounts it has touched and writes
+// them back at the end of the transaction, so such writes made by the Go code it calls would be lost.
+func (c *Context) LockAccounts() {
+	c.accountsLocked = true
+}
+
+func (c *Context) UnlockAccounts() {
+	c.accountsLocked = false
+}
+
+func (c *Context) checkAccountsUnlocked(k []byte) {
+	if c.accountsLocked && (k[0] == ACCOUNT_KEY || k[0] == BYTECODE_KEY) {
+		panic(ErrAccountsLocked)
+	}
+}
+
+func (c *Context) set(k, v []byte) {
+	c.checkAccountsUnlocked(k)
+	if c.journalOn {
+		c.journal = append(c.journal, journalEntry{key: k, oldValue: c.Rbt.Get(k)})
+	}
+	c.Rbt.Set(k, v)
+}
+
+func (c *Context) delete(k []byte) {
+	c.checkAccountsUnlocked(k)
+	if c.journalOn {
+		c.journal = append(c.journal, journalEntry{key: k, oldValue: c.Rbt.Get(k)})
+	}
+	c.Rbt.Delete(k)
+}
+
 func (c *Context) GetAccount(address common.Address) *AccountInfo {
 	k := GetAccountKey(address)
 	v := c.Rbt.Get(k)
@@ -110,7 +269,39 @@ func (c *Context) GetAccount(address common.Address) *AccountInfo {
 
 func (c *Context) SetAccount(address common.Address, acc *AccountInfo) {
 	k := GetAccountKey(address)
-	c.Rbt.Set(k, acc.Bytes())
+	c.set(k, acc.Bytes())
+}
+
+func (c *Context) DeleteAccount(address common.Address) {
+	c.delete(GetAccountKey(address))
+}
+
+// GetAddressBySequence returns the contract which was assigned the account sequence seq. Sequences are never
+// reused, so the result is still valid after the contract is selfdestructed. The index is only available after
+// the block at SeqIndexForkBlock, whose BeginBlock backfills it with BackfillSequenceIndex.
+func (c *Context) GetAddressBySequence(seq uint64) (addr common.Address, ok bool) {
+	v := c.Rbt.Get(GetSeqToAddrKey(seq))
+	if v == nil {
+		return
+	}
+	return common.BytesToAddress(v), true
+}
+
+func (c *Context) SetAddressOfSequence(seq uint64, addr common.Address) {
+	c.set(GetSeqToAddrKey(seq), addr[:])
+}
+
+// BackfillSequenceIndex indexes the contracts created before SeqIndexForkBlock, and returns how many of them
+// are indexed. The scanner must see all the accounts committed before the current block.
+func (c *Context) BackfillSequenceIndex(scanner StoreScanner) (count int) {
+	c.IterateAccounts(scanner, func(addr common.Address, acc *AccountInfo) bool {
+		if seq := acc.Sequence(); seq != math.MaxUint64 {
+			c.SetAddressOfSequence(seq, addr)
+			count++
+		}
+		return false
+	})
+	return
 }
 
 func (c *Context) GetCode(contract common.Address) *BytecodeInfo {
@@ -149,54 +340,14 @@ func (c *Context) GetAndDeleteValueAtMapKey(seq uint64, mapSlot string, mapKey s
 	return res
 }
 
-func (c *Context) GetDynamicArray(seq uint64, arrSlot string) (res [][]byte) {
-	arrLen := uint256.NewInt(0)
-	arrLenBz := c.GetStorageAt(seq, arrSlot)
-	if len(arrLenBz) == 32 {
-		arrLen.SetBytes32(arrLenBz)
-	}
-	startSlot := uint256.NewInt(0).SetBytes32(crypto.Keccak256([]byte(arrSlot)))
-	endSlot := uint256.NewInt(0).Add(startSlot, arrLen)
-	for startSlot.Lt(endSlot) {
-		res = append(res, c.GetStorageAt(seq, string(startSlot.Bytes())))
-		startSlot.AddUint64(startSlot, 1)
-	}
-	return res
-}
-
-func (c *Context) CreateDynamicArray(seq uint64, arrSlot string, contents [][]byte) {
-	arrLen := uint256.NewInt(uint64(len(contents)))
-	c.SetStorageAt(seq, arrSlot, arrLen.PaddedBytes(32))
-	startSlot := uint256.NewInt(0).SetBytes32(crypto.Keccak256([]byte(arrSlot)))
-	for i, val := range contents {
-		currSlot := uint256.NewInt(0).AddUint64(startSlot, uint64(i))
-		c.SetStorageAt(seq, string(currSlot.PaddedBytes(32)), val)
-	}
-}
-
-func (c *Context) DeleteDynamicArray(seq uint64, arrSlot string) {
-	arrLen := uint256.NewInt(0)
-	arrLenBz := c.GetStorageAt(seq, arrSlot)
-	if len(arrLenBz) == 32 {
-		arrLen.SetBytes32(arrLenBz)
-	}
-	startSlot := uint256.NewInt(0).SetBytes32(crypto.Keccak256([]byte(arrSlot)))
-	endSlot := uint256.NewInt(0).Add(startSlot, arrLen)
-	for startSlot.Lt(endSlot) {
-		c.DeleteStorageAt(seq, string(startSlot.Bytes()))
-		startSlot.AddUint64(startSlot, 1)
-	}
-	c.DeleteStorageAt(seq, arrSlot)
-}
-
 func (c *Context) SetStorageAt(seq uint64, key string, val []byte) {
 	k := GetValueKey(seq, key)
-	c.Rbt.Set(k, val)
+	c.set(k, val)
 }
 
 func (c *Context) DeleteStorageAt(seq uint64, key string) {
 	k := GetValueKey(seq, key)
-	c.Rbt.Delete(k)
+	c.delete(k)
 }
 
 func (c *Context) GetCurrBlockBasicInfo() *Block {
@@ -210,7 +361,7 @@ func (c *Context) GetCurrBlockBasicInfo() *Block {
 }
 
 func (c *Context) SetCurrBlockBasicInfo(blk *Block) {
-	c.Rbt.Set([]byte{CURR_BLOCK_KEY}, blk.SerializeBasicInfo())
+	c.set([]byte{CURR_BLOCK_KEY}, blk.SerializeBasicInfo())
 }
 
 func (c *Context) StoreBlock(blk *modbtypes.Block, txid2sigMap map[[32]byte][65]byte) {
@@ -326,20 +477,105 @@ func (c *Context) CheckNonce(sender common.Address, nonce uint64) (*AccountInfo,
 //	return nil
 //}
 
-func isInTopicSlice(topic [32]byte, topics [][32]byte) bool {
+type FilterFunc func(addr common.Address, topics []common.Hash, addrList []common.Address, topicsList [][]common.Hash) (ok bool)
+
+// FilterLog is the FilterFunc with the semantics of eth_getLogs: addr must be in addrList unless addrList is empty,
+// and the topic at position i must be in topicsList[i] unless topicsList[i] is empty, which matches any topic.
+func FilterLog(addr common.Address, topics []common.Hash, addrList []common.Address, topicsList [][]common.Hash) bool {
+	if len(addrList) != 0 && !isInAddressSlice(addr, addrList) {
+		return false
+	}
+	for i, list := range topicsList {
+		if len(list) == 0 {
+			continue
+		}
+		if i >= len(topics) || !isInTopicSlice(topics[i], list) {
+			return false
+		}
+	}
+	return true
+}
+
+func isInAddressSlice(addr common.Address, addrList []common.Address) bool {
+	for _, a := range addrList {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func isInTopicSlice(topic common.Hash, topics []common.Hash) bool {
 	for _, t := range topics {
-		if bytes.Equal(t[:], topic[:]) {
+		if t == topic {
 			return true
 		}
 	}
 	return false
 }
 
-func (c *Context) BasicQueryLogs(address common.Address, topics []common.Hash,
+// the topics which must appear in the matched logs, at any position, to narrow down the candidates in the index
+func requiredTopics(topics [][]common.Hash) (required []common.Hash) {
+	for _, list := range topics {
+		if len(list) == 1 {
+			required = append(required, list[0])
+		}
+	}
+	return
+}
+
+// MaxExpandedLogConditions is MoeingDB's modb.MaxExpandedSize. MoeingDB expands the conditions of QueryLogs into
+// the combinations of an address and one topic from each non-empty topic list, and silently drops the
+// combinations after the first MaxExpandedLogConditions ones.
+const MaxExpandedLogConditions = 64
+
+// logQueryConditions converts the conditions of QueryLogs for MoeingDB. If they expand into more than
+// MaxExpandedLogConditions combinations, only the topics of the positions that have a single value are kept,
+// like BasicQueryLogs, and the other topics are checked by the filter. ErrTooManyAddresses is returned if the
+// addresses alone are too many.
+func logQueryConditions(addresses []common.Address, topics [][]common.Hash) ([][20]byte, [][][32]byte, error) {
+	if len(addresses) > MaxExpandedLogConditions {
+		return nil, nil, ErrTooManyAddresses
+	}
+	expandedSize := 1
+	if len(addresses) != 0 {
+		expandedSize = len(addresses)
+	}
+	for _, list := range topics {
+		if len(list) != 0 && expandedSize <= MaxExpandedLogConditions {
+			expandedSize *= len(list)
+		}
+	}
+	rawTopics := make([][][32]byte, len(topics))
+	for i, list := range topics {
+		if expandedSize <= MaxExpandedLogConditions || len(list) == 1 {
+			rawTopics[i] = FromGethHashes(list)
+		}
+	}
+	return FromGethAddreses(addresses), rawTopics, nil
+}
+
+// filterLogsInTx returns the logs in tx which are accepted by filter
+func filterLogsInTx(tx *Transaction, addresses []common.Address, topics [][]common.Hash, filter FilterFunc) (logs []Log) {
+	var topicArr [4]common.Hash
+	for _, log := range tx.Logs {
+		for i, topic := range log.Topics {
+			topicArr[i] = common.Hash(topic)
+		}
+		if filter(common.Address(log.Address), topicArr[:len(log.Topics)], addresses, topics) {
+			logs = append(logs, log)
+		}
+	}
+	return
+}
+
+// BasicQueryLogs returns the logs emitted by address whose topics match the topics lists with FilterLog
+func (c *Context) BasicQueryLogs(address common.Address, topics [][]common.Hash,
 	startHeight, endHeight, limit uint32) (logs []Log, err error) {
 
 	var rawAddress [20]byte = address
-	rawTopics := FromGethHashes(topics)
+	rawTopics := FromGethHashes(requiredTopics(topics))
+	addresses := []common.Address{address}
 	c.Db.BasicQueryLogs(&rawAddress, rawTopics, startHeight, endHeight, func(data []byte) (needMore bool) {
 		if data == nil {
 			err = ErrTooManyEntries
@@ -349,19 +585,10 @@ func (c *Context) BasicQueryLogs(address common.Address, topics []common.Hash,
 		if _, err = tx.UnmarshalMsg(data[65:]); err != nil {
 			return false
 		}
-		for _, log := range tx.Logs {
-			hasAll := rawAddress == log.Address
-			for _, t := range topics {
-				if !hasAll {
-					break
-				}
-				hasAll = hasAll && isInTopicSlice(t, log.Topics)
-			}
-			if hasAll {
-				logs = append(logs, log)
-				if limit > 0 && len(logs) >= int(limit) {
-					return false
-				}
+		for _, log := range filterLogsInTx(&tx, addresses, topics, FilterLog) {
+			logs = append(logs, log)
+			if limit > 0 && len(logs) >= int(limit) {
+				return false
 			}
 		}
 		return true
@@ -370,13 +597,16 @@ func (c *Context) BasicQueryLogs(address common.Address, topics []common.Hash,
 	return
 }
 
-type FilterFunc func(addr common.Address, topics []common.Hash, addrList []common.Address, topicsList [][]common.Hash) (ok bool)
-
+// QueryLogs returns the logs which are accepted by filter, or by FilterLog if filter is nil. When addresses and
+// topics expand into too many conditions for MoeingDB, some topics are not used to narrow the candidates, as
+// described in logQueryConditions, so filter must check all the topics.
 func (c *Context) QueryLogs(addresses []common.Address, topics [][]common.Hash, startHeight, endHeight uint32, filter FilterFunc) (logs []Log, err error) {
-	rawAddresses := FromGethAddreses(addresses)
-	rawTopics := make([][][32]byte, len(topics))
-	for i, t := range topics {
-		rawTopics[i] = FromGethHashes(t)
+	if filter == nil {
+		filter = FilterLog
+	}
+	rawAddresses, rawTopics, err := logQueryConditions(addresses, topics)
+	if err != nil {
+		return nil, err
 	}
 
 	c.Db.QueryLogs(rawAddresses, rawTopics, startHeight, endHeight, func(data []byte) bool {
@@ -388,16 +618,7 @@ func (c *Context) QueryLogs(addresses []common.Address, topics [][]common.Hash,
 		if _, err = tx.UnmarshalMsg(data[65:]); err != nil {
 			return false
 		}
-
-		var topicArr [4]common.Hash
-		for _, log := range tx.Logs {
-			for i, topic := range log.Topics {
-				topicArr[i] = common.Hash(topic)
-			}
-			if filter(common.Address(log.Address), topicArr[:len(log.Topics)], addresses, topics) {
-				logs = append(logs, log)
-			}
-		}
+		logs = append(logs, filterLogsInTx(&tx, addresses, topics, filter)...)
 		return true
 	})
 
@@ -0,0 +1,172 @@
+package types
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+)
+
+// historyStore is a scannableStore which keeps a snapshot of the values at the end of each height
+type historyStore struct {
+	scannableStore
+	snapshots []map[string][]byte
+}
+
+func (s *historyStore) GetAtHeight(key []byte, height uint64) []byte {
+	if height >= uint64(len(s.snapshots)) {
+		return nil
+	}
+	return s.snapshots[height][string(key)]
+}
+
+func (s *historyStore) endBlock() {
+	m := make(map[string][]byte, len(s.m))
+	for k, v := range s.m {
+		m[k] = v
+	}
+	s.snapshots = append(s.snapshots, m)
+}
+
+func TestContextAtHeight(t *testing.T) {
+	s := &historyStore{scannableStore: scannableStore{m: make(map[string][]byte)}}
+	addr := common.HexToAddress("0x1")
+	slot := string(common.BigToHash(common.Big1).Bytes())
+	for height, balance := range []uint64{100, 200} {
+		ctx := newContextOnStore(&s.scannableStore)
+		acc := ZeroAccountInfo()
+		acc.UpdateBalance(uint256.NewInt(balance))
+		ctx.SetAccount(addr, acc)
+		if height == 1 {
+			ctx.SetStorageAt(10, slot, []byte{0x11})
+		}
+		ctx.Close(true)
+		s.endBlock()
+	}
+
+	latest := newContextOnStore(&s.scannableStore)
+	latest.SetBerlinForkBlock(1)
+	defer latest.Close(false)
+	_, err := latest.WithRbtAtHeight(-1)
+	require.Equal(t, ErrInvalidHeight, err)
+
+	ctx, err := NewContextAtHeight(s, nil, 0)
+	require.Nil(t, err)
+	// the copies keep reading the same height
+	copied := ctx.WithRbtCopy()
+	require.Equal(t, uint64(100), copied.GetAccount(addr).Balance().Uint64())
+	copied.Close(false)
+	require.Equal(t, uint64(100), ctx.GetAccount(addr).Balance().Uint64())
+	withDb := ctx.WithDb(nil)
+	require.Equal(t, uint64(100), withDb.GetAccount(addr).Balance().Uint64())
+	require.Equal(t, uint64(100), withDb.WithNestedRbt().GetAccount(addr).Balance().Uint64())
+	require.Nil(t, ctx.GetStorageAt(10, slot))
+	// the writes are only visible to this Context
+	ctx.SetStorageAt(10, slot, []byte{0x22})
+	require.Equal(t, []byte{0x22}, ctx.GetStorageAt(10, slot))
+	require.False(t, ctx.IsBerlinFork())
+	// a nested Context reads the same height
+	nested := ctx.WithNestedRbt()
+	require.Equal(t, uint64(100), nested.GetAccount(addr).Balance().Uint64())
+	require.Nil(t, nested.GetStorageAt(10, slot))
+	nested.Close(false)
+	ctx.Close(false)
+
+	ctx, err = latest.WithRbtAtHeight(1)
+	require.Nil(t, err)
+	defer ctx.Close(false)
+	require.Equal(t, int64(1), ctx.Height)
+	require.True(t, ctx.IsBerlinFork())
+	require.Equal(t, uint64(200), ctx.GetAccount(addr).Balance().Uint64())
+	require.Equal(t, []byte{0x11}, ctx.GetStorageAt(10, slot))
+	require.Equal(t, []byte{0x11}, latest.GetStorageAt(10, slot))
+}
+
+func TestFilterLog(t *testing.T) {
+	a, b, c := common.HexToHash("0xa"), common.HexToHash("0xb"), common.HexToHash("0xc")
+	contract := common.HexToAddress("0x1")
+	topics := []common.Hash{a, b}
+	for _, tc := range []struct {
+		addrList   []common.Address
+		topicsList [][]common.Hash
+		ok         bool
+	}{
+		{nil, nil, true},
+		{[]common.Address{common.HexToAddress("0x2"), contract}, nil, true},
+		{[]common.Address{common.HexToAddress("0x2")}, nil, false},
+		{nil, [][]common.Hash{{a}}, true},
+		{nil, [][]common.Hash{{b}}, false}, // b is not at position 0
+		{nil, [][]common.Hash{nil, {b}}, true},
+		{nil, [][]common.Hash{{c, a}, {c, b}}, true},
+		{nil, [][]common.Hash{{a}, {c}}, false},
+		{nil, [][]common.Hash{{a}, nil, nil}, true},
+		{nil, [][]common.Hash{nil, nil, {c}}, false}, // there is no topic at position 2
+	} {
+		require.Equal(t, tc.ok, FilterLog(contract, topics, tc.addrList, tc.topicsList), "%v %v", tc.addrList, tc.topicsList)
+	}
+}
+
+func TestBasicQueryLogs(t *testing.T) {
+	a, b := common.HexToHash("0xa"), common.HexToHash("0xb")
+	contract := common.HexToAddress("0x1")
+	db := &queryDB{maxCount: 100}
+	for i, topics := range [][][32]byte{{a, b}, {b, a}, {a}} {
+		db.txs = append(db.txs, &Transaction{BlockNumber: 1, TransactionIndex: int64(i),
+			Logs: []Log{{Address: contract, Topics: topics, TxIndex: uint(i), Index: uint(i)}}})
+	}
+	ctx := NewContext(nil, db)
+	for _, tc := range []struct {
+		topics  [][]common.Hash
+		indexes []uint
+	}{
+		{nil, []uint{0, 1, 2}},
+		{[][]common.Hash{{a}}, []uint{0, 2}},
+		{[][]common.Hash{nil, {a}}, []uint{1}},
+		{[][]common.Hash{{a, b}, {a, b}}, []uint{0, 1}},
+	} {
+		logs, err := ctx.BasicQueryLogs(contract, tc.topics, 1, 2, 0)
+		require.Nil(t, err)
+		var indexes []uint
+		for _, log := range logs {
+			indexes = append(indexes, log.Index)
+		}
+		require.Equal(t, tc.indexes, indexes, "%v", tc.topics)
+	}
+	logs, err := ctx.BasicQueryLogs(contract, nil, 1, 2, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(logs))
+}
+
+func TestQueryLogsWithManyConditions(t *testing.T) {
+	var topics []common.Hash
+	for i := 1; i <= 9; i++ {
+		topics = append(topics, common.BigToHash(big.NewInt(int64(i))))
+	}
+	c := common.HexToHash("0xc")
+	contract := common.HexToAddress("0x1")
+	db := &queryDB{maxCount: 100}
+	// the first log matches only the last of the 9*9 combinations of the first two lists
+	for i, logTopics := range [][][32]byte{{topics[8], topics[8], c}, {topics[8], topics[0], topics[0]}} {
+		db.txs = append(db.txs, &Transaction{BlockNumber: 1, TransactionIndex: int64(i),
+			Logs: []Log{{Address: contract, Topics: logTopics, BlockNumber: 1, TxIndex: uint(i), Index: uint(i)}}})
+	}
+	ctx := NewContext(nil, db)
+	conditions := [][]common.Hash{topics, topics, {c}}
+	logs, err := ctx.QueryLogs([]common.Address{contract}, conditions, 1, 2, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(logs))
+	require.Equal(t, uint(0), logs[0].Index)
+	logs, _, err = ctx.QueryLogsWithCursor([]common.Address{contract}, conditions, nil,
+		QueryOptions{StartHeight: 1, EndHeight: 2, MaxResults: 10})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(logs))
+	require.Equal(t, uint(0), logs[0].Index)
+
+	addresses := make([]common.Address, MaxExpandedLogConditions+1)
+	_, err = ctx.QueryLogs(addresses, nil, 1, 2, nil)
+	require.Equal(t, ErrTooManyAddresses, err)
+	_, _, err = ctx.QueryLogsWithCursor(addresses, nil, nil, QueryOptions{StartHeight: 1, EndHeight: 2, MaxResults: 10})
+	require.Equal(t, ErrTooManyAddresses, err)
+}
@@ -3,6 +3,7 @@ package types
 import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/holiman/uint256"
 )
 
 type SystemContractExecutor interface {
@@ -11,3 +12,44 @@ type SystemContractExecutor interface {
 	IsSystemContract(addr common.Address) bool
 	Execute(context *Context, currBlock *BlockInfo, tx *TxToRun) (status int, logs []EvmLog, gasUsed uint64, outData []byte)
 }
+
+// A SystemContractExecutor may also implement the following optional interfaces. The hooks are invoked
+// by the engine with a dedicated context, whose changes are discarded if the hook returns an error.
+
+// BeginBlocker runs before the transactions of a block are executed
+type BeginBlocker interface {
+	BeginBlock(ctx *Context, currBlock *BlockInfo) error
+}
+
+// EndBlocker runs after the transactions of a block are executed and the gas fees are distributed
+type EndBlocker interface {
+	EndBlock(ctx *Context, currBlock *BlockInfo) error
+}
+
+// Migrator upgrades the states of a system contract when the chain reaches a scheduled height
+type Migrator interface {
+	Migrate(ctx *Context, fromVersion uint64) error
+}
+
+// SystemContractCall describes a CALL (or STATICCALL, etc) from a smart contract to a system contract
+type SystemContractCall struct {
+	CurrBlock *BlockInfo
+	Caller    common.Address
+	// Value has been transferred to the system contract's account before it runs
+	Value    *uint256.Int
+	IsStatic bool
+	Depth    int
+}
+
+// ComposableSystemContract can be called by smart contracts with full context. RunWithContext is used instead
+// of Run, and ctx is the context of the running transaction, such that the writes to it join the transaction's
+// state changes. Only the writes made through the methods of Context (not directly to ctx.Rbt) are reverted
+// when the calling frame reverts. Since the EVM caches the accounts it has touched, RunWithContext should only
+// change the storage of system contracts. The accounts (such as balances) and bytecodes of ctx are locked with
+// LockAccounts while it runs, so writing them makes the call fail. Smart contracts can only reach it with
+// CALL and STATICCALL, since Caller and Value belong to the calling frame in DELEGATECALL and CALLCODE.
+// RequiredGas is still used to charge gas before RunWithContext runs. In a static call, any write is reverted
+// and makes the call fail.
+type ComposableSystemContract interface {
+	RunWithContext(ctx *Context, call *SystemContractCall, input []byte) ([]byte, error)
+}
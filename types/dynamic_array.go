@@ -0,0 +1,165 @@
+package types
+
+import (
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+)
+
+// A dynamic array is stored in the same way as Solidity: its length is stored at arrSlot and its i-th
+// element is stored at keccak256(arrSlot)+i. Just like the EVM, the slots holding zero are deleted.
+// arrSlot and the keys of the elements are all 32 bytes.
+
+// MaxDynamicArrayLength is the largest length accepted by the following functions, which access the
+// elements one by one
+const MaxDynamicArrayLength = 1 << 20
+
+func arrayElementKey(startSlot *uint256.Int, index uint64) string {
+	return string(uint256.NewInt(0).AddUint64(startSlot, index).PaddedBytes(32))
+}
+
+func arrayStartSlot(arrSlot string) *uint256.Int {
+	return uint256.NewInt(0).SetBytes32(crypto.Keccak256([]byte(arrSlot)))
+}
+
+func isZeroWord(val []byte) bool {
+	for _, b := range val {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Context) setStorageWord(seq uint64, key string, val []byte) {
+	if isZeroWord(val) {
+		c.DeleteStorageAt(seq, key)
+	} else {
+		c.SetStorageAt(seq, key, val)
+	}
+}
+
+// Returns ErrArrayTooLong if the length stored at arrSlot is larger than MaxDynamicArrayLength
+func (c *Context) GetDynamicArrayLength(seq uint64, arrSlot string) (uint64, error) {
+	length := uint256.NewInt(0).SetBytes(c.GetStorageAt(seq, arrSlot))
+	if !length.IsUint64() || length.Uint64() > MaxDynamicArrayLength {
+		return 0, ErrArrayTooLong
+	}
+	return length.Uint64(), nil
+}
+
+func (c *Context) setDynamicArrayLength(seq uint64, arrSlot string, length uint64) {
+	c.setStorageWord(seq, arrSlot, uint256.NewInt(length).PaddedBytes(32))
+}
+
+// Returns the index-th element, which is nil if it is zero
+func (c *Context) GetDynamicArrayElement(seq uint64, arrSlot string, index uint64) ([]byte, error) {
+	length, err := c.GetDynamicArrayLength(seq, arrSlot)
+	if err != nil {
+		return nil, err
+	}
+	if index >= length {
+		return nil, ErrIndexOutOfRange
+	}
+	return c.GetStorageAt(seq, arrayElementKey(arrayStartSlot(arrSlot), index)), nil
+}
+
+func (c *Context) SetDynamicArrayElement(seq uint64, arrSlot string, index uint64, val []byte) error {
+	length, err := c.GetDynamicArrayLength(seq, arrSlot)
+	if err != nil {
+		return err
+	}
+	if index >= length {
+		return ErrIndexOutOfRange
+	}
+	c.setStorageWord(seq, arrayElementKey(arrayStartSlot(arrSlot), index), val)
+	return nil
+}
+
+func (c *Context) PushToDynamicArray(seq uint64, arrSlot string, val []byte) error {
+	length, err := c.GetDynamicArrayLength(seq, arrSlot)
+	if err != nil {
+		return err
+	}
+	if length == MaxDynamicArrayLength {
+		return ErrArrayTooLong
+	}
+	c.setStorageWord(seq, arrayElementKey(arrayStartSlot(arrSlot), length), val)
+	c.setDynamicArrayLength(seq, arrSlot, length+1)
+	return nil
+}
+
+// Removes the last element and returns it
+func (c *Context) PopFromDynamicArray(seq uint64, arrSlot string) ([]byte, error) {
+	length, err := c.GetDynamicArrayLength(seq, arrSlot)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, ErrEmptyArray
+	}
+	key := arrayElementKey(arrayStartSlot(arrSlot), length-1)
+	res := c.GetStorageAt(seq, key)
+	c.DeleteStorageAt(seq, key)
+	c.setDynamicArrayLength(seq, arrSlot, length-1)
+	return res, nil
+}
+
+// Calls fn with the elements in order, until fn returns true
+func (c *Context) IterateDynamicArray(seq uint64, arrSlot string, fn func(index uint64, val []byte) (stop bool)) error {
+	length, err := c.GetDynamicArrayLength(seq, arrSlot)
+	if err != nil {
+		return err
+	}
+	startSlot := arrayStartSlot(arrSlot)
+	for i := uint64(0); i < length; i++ {
+		if fn(i, c.GetStorageAt(seq, arrayElementKey(startSlot, i))) {
+			break
+		}
+	}
+	return nil
+}
+
+// Deletes the elements whose indexes are no less than newLength
+func (c *Context) TruncateDynamicArray(seq uint64, arrSlot string, newLength uint64) error {
+	length, err := c.GetDynamicArrayLength(seq, arrSlot)
+	if err != nil {
+		return err
+	}
+	if newLength > length {
+		return ErrIndexOutOfRange
+	}
+	startSlot := arrayStartSlot(arrSlot)
+	for i := newLength; i < length; i++ {
+		c.DeleteStorageAt(seq, arrayElementKey(startSlot, i))
+	}
+	c.setDynamicArrayLength(seq, arrSlot, newLength)
+	return nil
+}
+
+func (c *Context) GetDynamicArray(seq uint64, arrSlot string) (res [][]byte, err error) {
+	err = c.IterateDynamicArray(seq, arrSlot, func(index uint64, val []byte) bool {
+		res = append(res, val)
+		return false
+	})
+	return
+}
+
+// Replaces the old contents of the array, if any, with new contents
+func (c *Context) CreateDynamicArray(seq uint64, arrSlot string, contents [][]byte) error {
+	if len(contents) > MaxDynamicArrayLength {
+		return ErrArrayTooLong
+	}
+	if err := c.DeleteDynamicArray(seq, arrSlot); err != nil {
+		return err
+	}
+	startSlot := arrayStartSlot(arrSlot)
+	for i, val := range contents {
+		c.setStorageWord(seq, arrayElementKey(startSlot, uint64(i)), val)
+	}
+	c.setDynamicArrayLength(seq, arrSlot, uint64(len(contents)))
+	return nil
+}
+
+func (c *Context) DeleteDynamicArray(seq uint64, arrSlot string) error {
+	return c.TruncateDynamicArray(seq, arrSlot, 0)
+}
@@ -8,9 +8,15 @@ var (
 	ErrBadAccData          = errors.New("bad account data")
 	ErrBadNonce            = errors.New("bad nonce")
 	ErrBadGasPrice         = errors.New("bad gas price")
+	ErrBadGasLimit         = errors.New("bad gas limit")
+	ErrInvalidSignature    = errors.New("invalid signature")
 	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrNotEnoughGasFee     = errors.New("not enough balance to pay gasfee")
 	ErrBlockNotFound       = errors.New("block not found")
 	ErrTxNotFound          = errors.New("tx not found")
 	ErrNoFromAddr          = errors.New("missing from address")
 	ErrInvalidHeight       = errors.New("invalid height")
+	ErrEmptyArray          = errors.New("empty array")
+	ErrIndexOutOfRange     = errors.New("index out of range")
+	ErrArrayTooLong        = errors.New("dynamic array is longer than MaxDynamicArrayLength")
 )
@@ -17,23 +17,20 @@ import (
 //	25, 20-byte
 //	bytes get_value(uint64_t seq, const evmc_bytes32& key) {
 //	27, 8-byte, 32-byte
+//	the address owning an account sequence, maintained on the Go side
+//	31, 8-byte
 
 const CREATION_COUNTER_KEY byte = 21
 const ACCOUNT_KEY byte = 23
 const BYTECODE_KEY byte = 25
 const VALUE_KEY byte = 27
 const CURR_BLOCK_KEY byte = 29
+const SEQ_TO_ADDR_KEY byte = 31
 
 var StandbyTxQueueKey [8]byte = [8]byte{255, 255, 255, 255, 255, 255, 255, 0}
 
 const TOO_OLD_THRESHOLD uint64 = 10
 
-const IGNORE_TOO_OLD_TX int = 1024
-const FAILED_TO_COMMIT int = 1025
-const ACCOUNT_NOT_EXIST int = 1026
-const TX_NONCE_TOO_SMALL int = 1027
-const TX_NONCE_TOO_LARGE int = 1029
-
 func GetCreationCounterKey(lsb uint8) []byte {
 	bz := make([]byte, 2)
 	bz[0] = CREATION_COUNTER_KEY
@@ -63,6 +60,13 @@ func GetValueKey(seq uint64, key string) []byte {
 	return append(bz, []byte(key)...)
 }
 
+func GetSeqToAddrKey(seq uint64) []byte {
+	bz := make([]byte, 9)
+	bz[0] = SEQ_TO_ADDR_KEY
+	binary.BigEndian.PutUint64(bz[1:], seq)
+	return bz
+}
+
 func GetStandbyTxKey(num uint64) []byte {
 	var buf [8]byte
 	num += uint64(128+64) << 56 // raise it to the non-rabbit range
@@ -0,0 +1,394 @@
+package types
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/smartbch/moeingads/datatree"
+	"github.com/smartbch/moeingads/store/rabbit"
+	adstypes "github.com/smartbch/moeingads/types"
+)
+
+var (
+	ErrIncompleteProof = errors.New("incomplete proof")
+	ErrInvalidProof    = errors.New("invalid proof")
+	ErrStateRootDiffer = errors.New("shard roots do not match the state root")
+)
+
+// The start guard of MoeingADS, which is the predecessor of the smallest entry
+var proofStartGuard = []byte{0, 0, 0, 0, 0, 0, 0, 0}
+
+// The number of entries GetShardRoots visits at most before giving up. The shard of an entry is decided
+// by the last byte of its hashed key, so all the shards are found within a few dozen entries in practice.
+const MaxShardRootSteps = 1024
+
+// EntryProver is implemented by moeingads.MoeingADS, whose root hash is used as Block.StateRoot
+type EntryProver interface {
+	GetRootHash() []byte
+	GetProof(k []byte) (entryBz, proofBz []byte, err error)
+}
+
+// ProofSource is implemented by moeingads.MoeingADS. MoeingADS only keeps the merkle tree of the latest
+// height, so only the state at GetCurrHeight can be proved.
+type ProofSource interface {
+	EntryProver
+	GetCurrHeight() int64
+	// ScanAll visits the keys and values of all the entries except the start guard
+	ScanAll(fn func(key, value []byte))
+}
+
+// EntryProof proves that an entry of MoeingADS is active in the merkle tree of its shard
+type EntryProof struct {
+	Entry hexutil.Bytes `json:"entry"`
+	Path  hexutil.Bytes `json:"path"`
+}
+
+// KeyProof proves the value of a key (before RabbitStore hashes it) or its absence, with the entries of
+// the rabbit holes on its path. When the last hole is not in MoeingADS, the last EntryProof is for the
+// entry before it, whose NextKey is after it.
+type KeyProof []EntryProof
+
+type StorageProofResult struct {
+	Key   common.Hash   `json:"key"`
+	Value hexutil.Bytes `json:"value"`
+	Proof KeyProof      `json:"proof"`
+}
+
+// AccountProofResult has the same shape as the result of eth_getProof. Since the storage slots are not
+// organized per account, StorageHash is always zero, while ShardRoots and Sequence are added for verification.
+type AccountProofResult struct {
+	Address      common.Address                   `json:"address"`
+	AccountProof KeyProof                         `json:"accountProof"`
+	Balance      *hexutil.Big                     `json:"balance"`
+	CodeHash     common.Hash                      `json:"codeHash"`
+	CodeProof    KeyProof                         `json:"codeProof"`
+	Nonce        hexutil.Uint64                   `json:"nonce"`
+	Sequence     hexutil.Uint64                   `json:"sequence"`
+	StorageHash  common.Hash                      `json:"storageHash"`
+	StorageProof []StorageProofResult             `json:"storageProof"`
+	ShardRoots   [adstypes.ShardCount]common.Hash `json:"shardRoots"`
+}
+
+func rabbitHole(hash [32]byte) []byte {
+	k := make([]byte, rabbit.KeySize)
+	copy(k, hash[:])
+	k[0] = adstypes.LimitRange(k[0])
+	return k
+}
+
+type proofGenerator struct {
+	source     ProofSource
+	shardRoots [adstypes.ShardCount]common.Hash
+	hasRoot    [adstypes.ShardCount]bool
+	// the empty rabbit holes found by proveKey, and the proofs which must end with their previous entries
+	holes      [][]byte
+	holeProofs []*KeyProof
+}
+
+func (g *proofGenerator) getEntryProof(k []byte) (ep EntryProof, entry *adstypes.Entry, err error) {
+	ep.Entry, ep.Path, err = g.source.GetProof(k)
+	if err != nil {
+		return
+	}
+	entry, err = g.recordRoot(ep)
+	return
+}
+
+// appends the proof of the entry before each empty hole to the proof ending at it. MoeingADS does not
+// export the lookup of its index tree, so the previous entries are found with a single scan of all the
+// entries, whose cost grows with the size of the state.
+func (g *proofGenerator) proveHoles() error {
+	if len(g.holes) == 0 {
+		return nil
+	}
+	prevKeys := make([][]byte, len(g.holes))
+	for i := range prevKeys {
+		prevKeys[i] = proofStartGuard
+	}
+	g.source.ScanAll(func(key, _ []byte) {
+		for i, k := range g.holes {
+			if bytes.Compare(key, k) < 0 && bytes.Compare(key, prevKeys[i]) > 0 {
+				prevKeys[i] = append([]byte{}, key...)
+			}
+		}
+	})
+	for i, k := range prevKeys {
+		ep, _, err := g.getEntryProof(k)
+		if err != nil {
+			return err
+		}
+		*g.holeProofs[i] = append(*g.holeProofs[i], ep)
+	}
+	return nil
+}
+
+func (g *proofGenerator) recordRoot(ep EntryProof) (*adstypes.Entry, error) {
+	entry := datatree.EntryFromRawBytes(ep.Entry)
+	pp, err := datatree.BytesToProofPath(ep.Path)
+	if err != nil {
+		return nil, err
+	}
+	shardID := adstypes.GetShardID(entry.Key)
+	g.shardRoots[shardID] = pp.Root
+	g.hasRoot[shardID] = true
+	return entry, nil
+}
+
+// follows the path that RabbitStore.Get takes to find key. If the path ends at an empty hole, the proof is
+// not complete until proveHoles appends the entry before the hole to *proof.
+func (g *proofGenerator) proveKey(proof *KeyProof, key []byte) (value []byte, err error) {
+	hash := sha256.Sum256(key)
+	for i := 0; i < rabbit.MaxFindDepth; i++ {
+		k := rabbitHole(hash)
+		ep, entry, err := g.getEntryProof(k)
+		if err != nil { // the hole is empty
+			g.holes = append(g.holes, k)
+			g.holeProofs = append(g.holeProofs, proof)
+			return nil, nil
+		}
+		*proof = append(*proof, ep)
+		cv := rabbit.BytesToCachedValue(entry.Value)
+		if cv == nil {
+			return nil, ErrInvalidProof
+		}
+		if bytes.Equal(cv.GetKey(), key) {
+			if cv.IsEmpty() {
+				return nil, nil
+			}
+			return append([]byte{}, cv.GetValue()...), nil
+		} else if !hasPassby(entry.Value) {
+			return nil, nil
+		}
+		hash = sha256.Sum256(hash[:])
+	}
+	return nil, ErrIncompleteProof
+}
+
+func hasPassby(cachedValue []byte) bool {
+	return cachedValue[rabbit.PassbyNumIndex]|cachedValue[rabbit.PassbyNumIndex+1]|
+		cachedValue[rabbit.PassbyNumIndex+2]|cachedValue[rabbit.PassbyNumIndex+3] != 0
+}
+
+// GetShardRoots returns the roots of the shards of prover, which are taken from the proofs of the entries
+// visited from the start guard along their NextKeys, until every shard is found or MaxShardRootSteps
+// entries are visited.
+func GetShardRoots(prover EntryProver) (shardRoots [adstypes.ShardCount]common.Hash, err error) {
+	var hasRoot [adstypes.ShardCount]bool
+	found := 0
+	k := proofStartGuard
+	for i := 0; i < MaxShardRootSteps && found < adstypes.ShardCount; i++ {
+		entryBz, proofBz, err := prover.GetProof(k)
+		if err != nil {
+			return shardRoots, err
+		}
+		entry := datatree.EntryFromRawBytes(entryBz)
+		pp, err := datatree.BytesToProofPath(proofBz)
+		if err != nil {
+			return shardRoots, err
+		}
+		shardID := adstypes.GetShardID(entry.Key)
+		if !hasRoot[shardID] {
+			shardRoots[shardID] = pp.Root
+			hasRoot[shardID] = true
+			found++
+		}
+		if len(entry.NextKey) != rabbit.KeySize { // the end guard, which is not a rabbit hole
+			break
+		}
+		k = entry.NextKey
+	}
+	for i := range hasRoot {
+		if !hasRoot[i] {
+			return shardRoots, fmt.Errorf("no entry found in shard %d", i)
+		}
+	}
+	return shardRoots, nil
+}
+
+// GetProof proves the account at addr and its storage slots at keys against the state root of height.
+// Only the latest height of source can be proved, because MoeingADS does not keep the merkle trees of
+// the earlier heights.
+func GetProof(source ProofSource, height int64, addr common.Address, keys []common.Hash) (*AccountProofResult, error) {
+	if currHeight := source.GetCurrHeight(); height != currHeight {
+		return nil, fmt.Errorf("%w: only the latest height %d can be proved, not %d", ErrInvalidHeight, currHeight, height)
+	}
+	g := &proofGenerator{source: source}
+	res := &AccountProofResult{Address: addr, Balance: (*hexutil.Big)(common.Big0)}
+	accBz, err := g.proveKey(&res.AccountProof, GetAccountKey(addr))
+	if err != nil {
+		return nil, err
+	}
+	if accBz != nil {
+		acc := NewAccountInfo(accBz)
+		res.Balance = (*hexutil.Big)(acc.Balance().ToBig())
+		res.Nonce = hexutil.Uint64(acc.Nonce())
+		res.Sequence = hexutil.Uint64(acc.Sequence())
+	}
+	codeBz, err := g.proveKey(&res.CodeProof, GetBytecodeKey(addr))
+	if err != nil {
+		return nil, err
+	}
+	res.CodeHash = codeHashOf(codeBz)
+	res.StorageProof = make([]StorageProofResult, len(keys))
+	for i, key := range keys {
+		sp := &res.StorageProof[i]
+		sp.Key = key
+		sp.Value, err = g.proveKey(&sp.Proof, GetValueKey(uint64(res.Sequence), string(key[:])))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = g.proveHoles(); err != nil {
+		return nil, err
+	}
+
+	// the shards not on the paths of the keys
+	shardRoots, err := GetShardRoots(source)
+	if err != nil {
+		return nil, err
+	}
+	for i := range shardRoots {
+		if g.hasRoot[i] && g.shardRoots[i] != shardRoots[i] {
+			return nil, ErrStateRootDiffer
+		}
+	}
+	res.ShardRoots = shardRoots
+	root := StateRootFromShardRoots(res.ShardRoots)
+	if !bytes.Equal(root[:], source.GetRootHash()) {
+		return nil, ErrStateRootDiffer
+	}
+	return res, nil
+}
+
+// the code hash of EOA is keccak256 of empty bytes, just like Ethereum
+func codeHashOf(bytecodeInfo []byte) common.Hash {
+	if bytecodeInfo == nil {
+		return crypto.Keccak256Hash(nil)
+	}
+	return common.BytesToHash(NewBytecodeInfo(bytecodeInfo).CodeHashSlice())
+}
+
+// StateRootFromShardRoots computes the root hash of MoeingADS from the roots of its shards
+func StateRootFromShardRoots(shardRoots [adstypes.ShardCount]common.Hash) (root [32]byte) {
+	nodes := make([][32]byte, len(shardRoots))
+	for i := range shardRoots {
+		nodes[i] = shardRoots[i]
+	}
+	for len(nodes) > 1 {
+		upper := make([][32]byte, len(nodes)/2)
+		for i := range upper {
+			upper[i] = sha256.Sum256(append(nodes[2*i][:], nodes[2*i+1][:]...))
+		}
+		nodes = upper
+	}
+	return nodes[0]
+}
+
+// verifies an entry against the shard roots, and returns the entry
+func verifyEntryProof(shardRoots [adstypes.ShardCount]common.Hash, ep EntryProof) (entry *adstypes.Entry, err error) {
+	defer func() {
+		if r := recover(); r != nil { // EntryFromRawBytes panics with malformed bytes
+			entry, err = nil, ErrInvalidProof
+		}
+	}()
+	pp, err := datatree.BytesToProofPath(ep.Path)
+	if err != nil || len(pp.UpperPath) == 0 || sha256.Sum256(ep.Entry) != pp.LeftOfTwig[0].SelfHash {
+		return nil, ErrInvalidProof
+	}
+	entry = datatree.EntryFromRawBytes(ep.Entry)
+	if entry.SerialNum != pp.SerialNum || pp.Check(true) != nil {
+		return nil, ErrInvalidProof
+	}
+	if common.Hash(pp.Root) != shardRoots[adstypes.GetShardID(entry.Key)] {
+		return nil, ErrInvalidProof
+	}
+	n := pp.SerialNum & datatree.TwigMask
+	activeBits := pp.RightOfTwig[0].SelfHash
+	if activeBits[(n%256)/8]&(1<<(n%8)) == 0 { // the entry has been deactivated
+		return nil, ErrInvalidProof
+	}
+	return entry, nil
+}
+
+// VerifyKeyProof checks the proof of key against the shard roots and returns the proved value, which is
+// nil if the key is absent
+func VerifyKeyProof(shardRoots [adstypes.ShardCount]common.Hash, key []byte, proof KeyProof) ([]byte, error) {
+	hash := sha256.Sum256(key)
+	for i, ep := range proof {
+		entry, err := verifyEntryProof(shardRoots, ep)
+		if err != nil {
+			return nil, err
+		}
+		isLast := i == len(proof)-1
+		k := rabbitHole(hash)
+		if !bytes.Equal(entry.Key, k) { // the hole is empty
+			if !isLast || bytes.Compare(entry.Key, k) >= 0 || bytes.Compare(k, entry.NextKey) >= 0 {
+				return nil, ErrInvalidProof
+			}
+			return nil, nil
+		}
+		cv := rabbit.BytesToCachedValue(entry.Value)
+		if cv == nil {
+			return nil, ErrInvalidProof
+		}
+		if bytes.Equal(cv.GetKey(), key) || !hasPassby(entry.Value) {
+			if !isLast {
+				return nil, ErrInvalidProof
+			}
+			if !bytes.Equal(cv.GetKey(), key) || cv.IsEmpty() {
+				return nil, nil
+			}
+			return cv.GetValue(), nil
+		}
+		hash = sha256.Sum256(hash[:])
+	}
+	return nil, ErrIncompleteProof
+}
+
+// VerifyAccountProof checks all the proofs in res against stateRoot, and checks that the fields of res
+// are the proved values
+func VerifyAccountProof(stateRoot [32]byte, res *AccountProofResult) error {
+	if StateRootFromShardRoots(res.ShardRoots) != stateRoot {
+		return ErrStateRootDiffer
+	}
+	accBz, err := VerifyKeyProof(res.ShardRoots, GetAccountKey(res.Address), res.AccountProof)
+	if err != nil {
+		return err
+	}
+	acc := ZeroAccountInfo()
+	if accBz != nil {
+		if len(accBz) != len(acc.Bytes()) {
+			return ErrInvalidProof
+		}
+		acc = NewAccountInfo(accBz)
+	}
+	if res.Balance == nil || acc.Balance().ToBig().Cmp(res.Balance.ToInt()) != 0 ||
+		acc.Nonce() != uint64(res.Nonce) || acc.Sequence() != uint64(res.Sequence) {
+		return ErrInvalidProof
+	}
+	codeBz, err := VerifyKeyProof(res.ShardRoots, GetBytecodeKey(res.Address), res.CodeProof)
+	if err != nil {
+		return err
+	}
+	if len(codeBz) != 0 && len(codeBz) <= 33 {
+		return ErrInvalidProof
+	}
+	if codeHashOf(codeBz) != res.CodeHash {
+		return ErrInvalidProof
+	}
+	for _, sp := range res.StorageProof {
+		value, err := VerifyKeyProof(res.ShardRoots, GetValueKey(uint64(res.Sequence), string(sp.Key[:])), sp.Proof)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(value, sp.Value) {
+			return ErrInvalidProof
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+	"github.com/smartbch/moeingads/datatree"
+	adstypes "github.com/smartbch/moeingads/types"
+	"github.com/stretchr/testify/require"
+)
+
+var proofEndGuard = []byte{255, 255, 255, 255, 255, 255, 255, 255, 255}
+
+// treeProofSource puts the entries of a scannableStore into the merkle trees of 8 shards, like what
+// MoeingADS does when it is created
+type treeProofSource struct {
+	trees [adstypes.ShardCount]*datatree.Tree
+	keys  [][]byte // sorted, including the guards
+	pos   map[string]int64
+	sn    map[string]int64
+	m     map[string][]byte
+	root  [32]byte
+}
+
+func newTreeProofSource(dir string, s *scannableStore) *treeProofSource {
+	src := &treeProofSource{
+		pos: make(map[string]int64),
+		sn:  make(map[string]int64),
+		m:   s.m,
+	}
+	keys := [][]byte{proofStartGuard, proofEndGuard}
+	for k := range s.m {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	for i := range src.trees {
+		src.trees[i] = datatree.NewEmptyTree(datatree.SmallBufferSize, 8*4096*32, dir, fmt.Sprintf(".%d", i))
+	}
+	// like MoeingADS, the first twig of each shard is filled with dummy entries
+	var maxSN [adstypes.ShardCount]int64
+	for i, tree := range src.trees {
+		for ; maxSN[i] < datatree.LeafCountInTwig; maxSN[i]++ {
+			tree.AppendEntry(datatree.DummyEntry(maxSN[i]))
+		}
+	}
+	for i, k := range keys {
+		shardID := adstypes.GetShardID(k)
+		if bytes.Equal(k, proofEndGuard) {
+			shardID = adstypes.ShardCount - 1
+		}
+		entry := &adstypes.Entry{
+			Key:       k,
+			Value:     s.m[string(k)],
+			NextKey:   proofEndGuard,
+			SerialNum: maxSN[shardID],
+		}
+		if i+1 < len(keys) {
+			entry.NextKey = keys[i+1]
+		}
+		if entry.Value == nil {
+			entry.Value = []byte{}
+		}
+		src.pos[string(k)] = src.trees[shardID].AppendEntry(entry)
+		src.sn[string(k)] = maxSN[shardID]
+		maxSN[shardID]++
+	}
+	var shardRoots [adstypes.ShardCount]common.Hash
+	for i, tree := range src.trees {
+		shardRoots[i] = tree.EndBlock()
+		tree.WaitForFlushing()
+	}
+	src.keys = keys
+	src.root = StateRootFromShardRoots(shardRoots)
+	return src
+}
+
+func (src *treeProofSource) close() {
+	for _, tree := range src.trees {
+		tree.Close()
+	}
+}
+
+func (src *treeProofSource) GetRootHash() []byte  { return src.root[:] }
+func (src *treeProofSource) GetCurrHeight() int64 { return 1 }
+
+func (src *treeProofSource) GetProof(k []byte) (entryBz, proofBz []byte, err error) {
+	pos, ok := src.pos[string(k)]
+	if !ok {
+		return nil, nil, fmt.Errorf("Cannot find entry")
+	}
+	tree := src.trees[adstypes.GetShardID(k)]
+	entryBz = tree.ReadEntryBytesForProof(pos)
+	proofBz, err = tree.GetProofBytesAndCheck(src.sn[string(k)], entryBz)
+	return
+}
+
+// like MoeingADS, the start guard is not visited
+func (src *treeProofSource) ScanAll(fn func(key, value []byte)) {
+	for i := len(src.keys) - 1; i > 0; i-- {
+		fn(src.keys[i], src.m[string(src.keys[i])])
+	}
+}
+
+func TestAccountProof(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proof")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &scannableStore{m: make(map[string][]byte)}
+	ctx := newContextOnStore(s)
+	contract := common.HexToAddress("0x2")
+	// enough accounts to make all the shards non-empty
+	for i := 0; i < 64; i++ {
+		acc := ZeroAccountInfo()
+		acc.UpdateBalance(uint256.NewInt(uint64(1000 + i)))
+		acc.UpdateNonce(uint64(i))
+		acc.UpdateSequence(^uint64(0))
+		ctx.SetAccount(common.BigToAddress(big.NewInt(int64(1000+i))), acc)
+	}
+	acc := ZeroAccountInfo()
+	acc.UpdateBalance(uint256.NewInt(7))
+	acc.UpdateSequence(100)
+	ctx.SetAccount(contract, acc)
+	code := []byte{0x60, 0x00}
+	ctx.Rbt.Set(GetBytecodeKey(contract), append(append([]byte{0}, crypto.Keccak256(code)...), code...))
+	slot1 := common.BigToHash(common.Big1)
+	slot2 := common.BigToHash(common.Big2)
+	ctx.SetStorageAt(100, string(slot1[:]), []byte{0x11})
+	ctx.Close(true)
+
+	src := newTreeProofSource(dir, s)
+	defer src.close()
+	_, err = GetProof(src, 2, contract, nil)
+	require.ErrorIs(t, err, ErrInvalidHeight)
+	shardRoots, err := GetShardRoots(src)
+	require.Nil(t, err)
+	require.Equal(t, src.root, StateRootFromShardRoots(shardRoots))
+
+	res, err := GetProof(src, 1, contract, []common.Hash{slot1, slot2})
+	require.Nil(t, err)
+	require.Equal(t, uint64(7), res.Balance.ToInt().Uint64())
+	require.Equal(t, uint64(100), uint64(res.Sequence))
+	require.Equal(t, crypto.Keccak256Hash(code), res.CodeHash)
+	require.Equal(t, []byte{0x11}, []byte(res.StorageProof[0].Value))
+	require.Nil(t, res.StorageProof[1].Value)
+	require.Nil(t, VerifyAccountProof(src.root, res))
+
+	// the result survives JSON encoding
+	bz, err := json.Marshal(res)
+	require.Nil(t, err)
+	var decoded AccountProofResult
+	require.Nil(t, json.Unmarshal(bz, &decoded))
+	require.Nil(t, VerifyAccountProof(src.root, &decoded))
+
+	// an account which does not exist
+	res, err = GetProof(src, 1, common.HexToAddress("0x3"), []common.Hash{slot1})
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), res.Balance.ToInt().Uint64())
+	require.Equal(t, crypto.Keccak256Hash(nil), res.CodeHash)
+	require.Nil(t, VerifyAccountProof(src.root, res))
+	// the proof of absence for another key does not cover this one
+	res2, err := GetProof(src, 1, common.HexToAddress("0x4"), nil)
+	require.Nil(t, err)
+	res.AccountProof = res2.AccountProof
+	require.Equal(t, ErrInvalidProof, VerifyAccountProof(src.root, res))
+
+	// tampered results
+	res, err = GetProof(src, 1, contract, []common.Hash{slot1})
+	require.Nil(t, err)
+	require.Equal(t, ErrStateRootDiffer, VerifyAccountProof([32]byte{1}, res))
+	res.StorageProof[0].Value = []byte{0x12}
+	require.Equal(t, ErrInvalidProof, VerifyAccountProof(src.root, res))
+	res.StorageProof[0].Value = []byte{0x11}
+	res.Balance.ToInt().SetUint64(8)
+	require.Equal(t, ErrInvalidProof, VerifyAccountProof(src.root, res))
+	res.Balance.ToInt().SetUint64(7)
+	res.StorageProof[0].Proof = res.AccountProof
+	require.NotNil(t, VerifyAccountProof(src.root, res))
+	res.StorageProof = nil
+	res.AccountProof[0].Entry[len(res.AccountProof[0].Entry)-1] ^= 1
+	require.Equal(t, ErrInvalidProof, VerifyAccountProof(src.root, res))
+	res.AccountProof[0].Entry[len(res.AccountProof[0].Entry)-1] ^= 1
+	res.AccountProof = res.AccountProof[:0]
+	require.Equal(t, ErrIncompleteProof, VerifyAccountProof(src.root, res))
+}
+
+func TestShardRootsOfEmptyShard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proof")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	s := &scannableStore{m: make(map[string][]byte)}
+	ctx := newContextOnStore(s)
+	ctx.SetAccount(common.HexToAddress("0x2"), ZeroAccountInfo())
+	ctx.Close(true)
+	src := newTreeProofSource(dir, s)
+	defer src.close()
+	_, err = GetShardRoots(src)
+	require.NotNil(t, err)
+	_, err = GetProof(src, 1, common.HexToAddress("0x2"), nil)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,318 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+var (
+	ErrInvalidCursor     = errors.New("invalid query cursor")
+	ErrInvalidMaxResults = errors.New("max results must be positive")
+)
+
+// QueryCursor is the position of a transaction or a log in the chain. The LogIndex of a transaction is zero.
+type QueryCursor struct {
+	Height   uint32 `json:"height"`
+	TxIndex  uint32 `json:"txIndex"`
+	LogIndex uint32 `json:"logIndex"`
+}
+
+func (cur QueryCursor) less(other QueryCursor) bool {
+	if cur.Height != other.Height {
+		return cur.Height < other.Height
+	}
+	if cur.TxIndex != other.TxIndex {
+		return cur.TxIndex < other.TxIndex
+	}
+	return cur.LogIndex < other.LogIndex
+}
+
+// String encodes cur as a continuation token, which can be decoded by ParseQueryCursor
+func (cur QueryCursor) String() string {
+	var buf [12]byte
+	binary.BigEndian.PutUint32(buf[0:4], cur.Height)
+	binary.BigEndian.PutUint32(buf[4:8], cur.TxIndex)
+	binary.BigEndian.PutUint32(buf[8:12], cur.LogIndex)
+	return hexutil.Encode(buf[:])
+}
+
+func ParseQueryCursor(token string) (*QueryCursor, error) {
+	buf, err := hexutil.Decode(token)
+	if err != nil || len(buf) != 12 {
+		return nil, ErrInvalidCursor
+	}
+	return &QueryCursor{
+		Height:   binary.BigEndian.Uint32(buf[0:4]),
+		TxIndex:  binary.BigEndian.Uint32(buf[4:8]),
+		LogIndex: binary.BigEndian.Uint32(buf[8:12]),
+	}, nil
+}
+
+// QueryOptions selects a page of the results in the heights [StartHeight, EndHeight). The page starts at Cursor,
+// or at the first result in the order given by Descending if Cursor is nil, and has at most MaxResults results.
+type QueryOptions struct {
+	StartHeight uint32
+	EndHeight   uint32
+	Descending  bool
+	MaxResults  int
+	Cursor      *QueryCursor
+}
+
+type cursorItem struct {
+	pos QueryCursor
+	tx  *Transaction
+	sig [65]byte
+	log Log
+}
+
+// queryWithCursor runs query over windows of the height range, from the cursor in the order of opts. A window is
+// halved when query reports ErrTooManyEntries, so a busy range is read in several calls instead of failing, unless
+// a single block has too many entries, and it is doubled again after a window is read. For the descending order,
+// query is called with startHeight > endHeight, which makes MoeingDB feed the transactions in [endHeight, startHeight)
+// in the reverse order. match returns the results in a transaction, in ascending order.
+// The returned cursor points to the first result of the next page, and it is nil when there are no more results.
+func (c *Context) queryWithCursor(opts QueryOptions, query func(startHeight, endHeight uint32, fn func([]byte) bool),
+	match func(tx *Transaction, sig [65]byte) []cursorItem) (items []cursorItem, next *QueryCursor, err error) {
+
+	if opts.MaxResults <= 0 {
+		return nil, nil, ErrInvalidMaxResults
+	}
+	if opts.StartHeight >= opts.EndHeight {
+		return nil, nil, nil
+	}
+	var cur QueryCursor
+	if opts.Cursor != nil {
+		cur = *opts.Cursor
+		if cur.Height < opts.StartHeight || cur.Height >= opts.EndHeight {
+			return nil, nil, ErrInvalidCursor
+		}
+	} else if opts.Descending {
+		cur = QueryCursor{Height: opts.EndHeight - 1, TxIndex: math.MaxUint32, LogIndex: math.MaxUint32}
+	} else {
+		cur = QueryCursor{Height: opts.StartHeight}
+	}
+	window := opts.EndHeight - opts.StartHeight
+	for {
+		var lo, hi uint32
+		if opts.Descending {
+			hi = cur.Height + 1
+			lo = opts.StartHeight
+			if hi-lo > window {
+				lo = hi - window
+			}
+		} else {
+			lo = cur.Height
+			hi = opts.EndHeight
+			if hi-lo > window {
+				hi = lo + window
+			}
+		}
+		var windowItems []cursorItem
+		tooMany := false
+		var lastTx *Transaction
+		start, end := lo, hi
+		if opts.Descending {
+			start, end = hi, lo
+		}
+		query(start, end, func(data []byte) bool {
+			if data == nil {
+				tooMany = true
+				return false
+			}
+			tx := &Transaction{}
+			if _, err = tx.UnmarshalMsg(data[65:]); err != nil {
+				return false
+			}
+			// a transaction may be fed more than once if it matches the query in several ways
+			if lastTx != nil && lastTx.BlockNumber == tx.BlockNumber && lastTx.TransactionIndex == tx.TransactionIndex {
+				return true
+			}
+			lastTx = tx
+			var sig [65]byte
+			copy(sig[:], data[:65])
+			txItems := match(tx, sig)
+			for i := range txItems {
+				if opts.Descending {
+					if item := txItems[len(txItems)-1-i]; !cur.less(item.pos) {
+						windowItems = append(windowItems, item)
+					}
+				} else if !txItems[i].pos.less(cur) {
+					windowItems = append(windowItems, txItems[i])
+				}
+			}
+			// one more result is needed to get the cursor of the next page
+			return len(items)+len(windowItems) <= opts.MaxResults
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if tooMany {
+			if window == 1 {
+				return nil, nil, ErrTooManyEntries
+			}
+			window /= 2
+			continue
+		}
+		if window <= math.MaxUint32/2 {
+			window *= 2
+		}
+		for _, item := range windowItems {
+			if len(items) == opts.MaxResults {
+				return items, &item.pos, nil
+			}
+			items = append(items, item)
+		}
+		if opts.Descending {
+			if lo == opts.StartHeight {
+				return items, nil, nil
+			}
+			cur = QueryCursor{Height: lo - 1, TxIndex: math.MaxUint32, LogIndex: math.MaxUint32}
+		} else {
+			if hi == opts.EndHeight {
+				return items, nil, nil
+			}
+			cur = QueryCursor{Height: hi}
+		}
+		if len(items) == opts.MaxResults {
+			return items, &cur, nil
+		}
+	}
+}
+
+func logCursorItems(logs []Log) []cursorItem {
+	items := make([]cursorItem, len(logs))
+	for i, log := range logs {
+		items[i] = cursorItem{
+			pos: QueryCursor{Height: uint32(log.BlockNumber), TxIndex: uint32(log.TxIndex), LogIndex: uint32(log.Index)},
+			log: log,
+		}
+	}
+	return items
+}
+
+func txCursorItems(tx *Transaction, sig [65]byte) []cursorItem {
+	return []cursorItem{{
+		pos: QueryCursor{Height: uint32(tx.BlockNumber), TxIndex: uint32(tx.TransactionIndex)},
+		tx:  tx,
+		sig: sig,
+	}}
+}
+
+// BasicQueryLogsWithCursor is like BasicQueryLogs, but returns a page of the logs and the cursor of the next page
+func (c *Context) BasicQueryLogsWithCursor(address common.Address, topics [][]common.Hash,
+	opts QueryOptions) (logs []Log, next *QueryCursor, err error) {
+
+	var rawAddress [20]byte = address
+	rawTopics := FromGethHashes(requiredTopics(topics))
+	addresses := []common.Address{address}
+	query := func(startHeight, endHeight uint32, fn func([]byte) bool) {
+		c.Db.BasicQueryLogs(&rawAddress, rawTopics, startHeight, endHeight, fn)
+	}
+	items, next, err := c.queryWithCursor(opts, query, func(tx *Transaction, _ [65]byte) []cursorItem {
+		return logCursorItems(filterLogsInTx(tx, addresses, topics, FilterLog))
+	})
+	for _, item := range items {
+		logs = append(logs, item.log)
+	}
+	return
+}
+
+// QueryLogsWithCursor is like QueryLogs, but returns a page of the logs and the cursor of the next page
+func (c *Context) QueryLogsWithCursor(addresses []common.Address, topics [][]common.Hash, filter FilterFunc,
+	opts QueryOptions) (logs []Log, next *QueryCursor, err error) {
+
+	if filter == nil {
+		filter = FilterLog
+	}
+	rawAddresses, rawTopics, err := logQueryConditions(addresses, topics)
+	if err != nil {
+		return nil, nil, err
+	}
+	query := func(startHeight, endHeight uint32, fn func([]byte) bool) {
+		if startHeight <= endHeight {
+			c.Db.QueryLogs(rawAddresses, rawTopics, startHeight, endHeight, fn)
+			return
+		}
+		// unlike the other queries, MoeingDB's QueryLogs does not support the reverse order, so the range is
+		// read in chunks from the top, each of which is buffered and fed in reverse. A chunk starts with one
+		// block and is doubled while fn wants more, so a small page does not buffer a whole busy range.
+		size := uint32(1)
+		for hi := startHeight; hi > endHeight; {
+			lo := endHeight
+			if hi-lo > size {
+				lo = hi - size
+			}
+			var chunk [][]byte
+			c.Db.QueryLogs(rawAddresses, rawTopics, lo, hi, func(data []byte) bool {
+				chunk = append(chunk, data)
+				return data != nil
+			})
+			for i := len(chunk) - 1; i >= 0; i-- {
+				if !fn(chunk[i]) {
+					return
+				}
+			}
+			hi = lo
+			if size <= math.MaxUint32/2 {
+				size *= 2
+			}
+		}
+	}
+	items, next, err := c.queryWithCursor(opts, query, func(tx *Transaction, _ [65]byte) []cursorItem {
+		return logCursorItems(filterLogsInTx(tx, addresses, topics, filter))
+	})
+	for _, item := range items {
+		logs = append(logs, item.log)
+	}
+	return
+}
+
+func (c *Context) queryTxsWithCursor(opts QueryOptions, query func(startHeight, endHeight uint32, fn func([]byte) bool),
+	match func(tx *Transaction) bool) (txs []*Transaction, sigs [][65]byte, next *QueryCursor, err error) {
+
+	items, next, err := c.queryWithCursor(opts, query, func(tx *Transaction, sig [65]byte) []cursorItem {
+		if !match(tx) { // compare the addresses to prevent hash-conflict corner case
+			return nil
+		}
+		return txCursorItems(tx, sig)
+	})
+	for _, item := range items {
+		txs = append(txs, item.tx)
+		sigs = append(sigs, item.sig)
+	}
+	return
+}
+
+// QueryTxBySrcWithCursor is like QueryTxBySrc, but returns a page of the transactions and the cursor of the next page
+func (c *Context) QueryTxBySrcWithCursor(addr common.Address, opts QueryOptions) (txs []*Transaction, sigs [][65]byte, next *QueryCursor, err error) {
+	query := func(startHeight, endHeight uint32, fn func([]byte) bool) {
+		c.Db.QueryTxBySrc(addr, startHeight, endHeight, fn)
+	}
+	return c.queryTxsWithCursor(opts, query, func(tx *Transaction) bool {
+		return tx.From == addr
+	})
+}
+
+// QueryTxByDstWithCursor is like QueryTxByDst, but returns a page of the transactions and the cursor of the next page
+func (c *Context) QueryTxByDstWithCursor(addr common.Address, opts QueryOptions) (txs []*Transaction, sigs [][65]byte, next *QueryCursor, err error) {
+	query := func(startHeight, endHeight uint32, fn func([]byte) bool) {
+		c.Db.QueryTxByDst(addr, startHeight, endHeight, fn)
+	}
+	return c.queryTxsWithCursor(opts, query, func(tx *Transaction) bool {
+		return tx.To == addr
+	})
+}
+
+// QueryTxByAddrWithCursor is like QueryTxByAddr, but returns a page of the transactions and the cursor of the next page
+func (c *Context) QueryTxByAddrWithCursor(addr common.Address, opts QueryOptions) (txs []*Transaction, sigs [][65]byte, next *QueryCursor, err error) {
+	query := func(startHeight, endHeight uint32, fn func([]byte) bool) {
+		c.Db.QueryTxBySrcOrDst(addr, startHeight, endHeight, fn)
+	}
+	return c.queryTxsWithCursor(opts, query, func(tx *Transaction) bool {
+		return tx.From == addr || tx.To == addr
+	})
+}
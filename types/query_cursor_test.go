@@ -0,0 +1,263 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	modbtypes "github.com/smartbch/moeingdb/types"
+	"github.com/stretchr/testify/require"
+)
+
+// queryDB feeds the transactions in the height range to the queries, and reports too many entries like
+// MoeingDB when more than maxCount of them match. Like MoeingDB, startHeight > endHeight means the reverse order.
+type queryDB struct {
+	modbtypes.DB
+	txs      []*Transaction
+	maxCount int
+	calls    int // the number of queries
+	fed      int // the number of transactions fed to the queries
+}
+
+func (db *queryDB) query(startHeight, endHeight uint32, match func(tx *Transaction) bool, fn func([]byte) bool) {
+	db.calls++
+	reverse := startHeight > endHeight
+	if reverse {
+		startHeight, endHeight = endHeight, startHeight
+	}
+	var matched [][]byte
+	for _, tx := range db.txs {
+		if tx.BlockNumber >= int64(startHeight) && tx.BlockNumber < int64(endHeight) && match(tx) {
+			bz, _ := tx.MarshalMsg(make([]byte, 65))
+			matched = append(matched, bz)
+			if len(tx.Logs) > 1 { // fed again, like a transaction matching more than one condition
+				matched = append(matched, bz)
+			}
+		}
+	}
+	if len(matched) > db.maxCount {
+		fn(nil)
+		return
+	}
+	if reverse {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+	for _, bz := range matched {
+		db.fed++
+		if !fn(bz) {
+			return
+		}
+	}
+}
+
+// like the index of MoeingDB, the positions of the topics are ignored, and a nil addr matches any address
+func hasLogWithTopics(tx *Transaction, addr *[20]byte, topics [][32]byte) bool {
+	for _, log := range tx.Logs {
+		hasAll := addr == nil || log.Address == *addr
+		for _, t := range topics {
+			found := false
+			for _, topic := range log.Topics {
+				found = found || topic == t
+			}
+			hasAll = hasAll && found
+		}
+		if hasAll {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *queryDB) BasicQueryLogs(addr *[20]byte, topics [][32]byte, startHeight, endHeight uint32, fn func([]byte) bool) {
+	db.query(startHeight, endHeight, func(tx *Transaction) bool {
+		return hasLogWithTopics(tx, addr, topics)
+	}, fn)
+}
+
+type logCondition struct {
+	addr   *[20]byte
+	topics [][32]byte
+}
+
+// Like MoeingDB's QueryLogs, the conditions are expanded into the combinations of an address and one topic from
+// each non-empty list, and the combinations after the first MaxExpandedLogConditions ones are dropped.
+// Unlike the other queries, it finds nothing when startHeight > endHeight.
+func (db *queryDB) QueryLogs(addrOrList [][20]byte, topicsOrList [][][32]byte, startHeight, endHeight uint32, fn func([]byte) bool) {
+	if startHeight > endHeight {
+		return
+	}
+	conds := []logCondition{{}}
+	if len(addrOrList) != 0 {
+		conds = conds[:0]
+		for i := range addrOrList {
+			conds = append(conds, logCondition{addr: &addrOrList[i]})
+		}
+	}
+	for _, list := range topicsOrList {
+		if len(list) == 0 || len(conds) > MaxExpandedLogConditions {
+			continue
+		}
+		var expanded []logCondition
+		for _, cond := range conds {
+			for _, topic := range list {
+				topics := append(append([][32]byte{}, cond.topics...), topic)
+				expanded = append(expanded, logCondition{addr: cond.addr, topics: topics})
+			}
+		}
+		conds = expanded
+	}
+	if len(conds) > MaxExpandedLogConditions {
+		conds = conds[:MaxExpandedLogConditions]
+	}
+	db.query(startHeight, endHeight, func(tx *Transaction) bool {
+		for _, cond := range conds {
+			if hasLogWithTopics(tx, cond.addr, cond.topics) {
+				return true
+			}
+		}
+		return false
+	}, fn)
+}
+
+func (db *queryDB) QueryTxBySrc(addr [20]byte, startHeight, endHeight uint32, fn func([]byte) bool) {
+	db.query(startHeight, endHeight, func(tx *Transaction) bool {
+		return tx.From == addr
+	}, fn)
+}
+
+func TestQueryWithCursor(t *testing.T) {
+	alice := common.HexToAddress("0xa")
+	contract := common.HexToAddress("0xc")
+	topic := common.HexToHash("0x1")
+	db := &queryDB{maxCount: 5}
+	logIndex := uint(0)
+	for h := int64(1); h <= 10; h++ {
+		for i := int64(0); i < h%4; i++ {
+			tx := &Transaction{BlockNumber: h, TransactionIndex: i, From: alice}
+			for j := int64(0); j <= i; j++ {
+				tx.Logs = append(tx.Logs, Log{Address: contract, Topics: [][32]byte{topic},
+					BlockNumber: uint64(h), TxIndex: uint(i), Index: logIndex})
+				logIndex++
+			}
+			db.txs = append(db.txs, tx)
+		}
+	}
+	ctx := NewContext(nil, db)
+
+	// pages through all the transactions, in both orders
+	for _, desc := range []bool{false, true} {
+		var all []*Transaction
+		opts := QueryOptions{StartHeight: 1, EndHeight: 11, Descending: desc, MaxResults: 3}
+		for {
+			txs, sigs, next, err := ctx.QueryTxBySrcWithCursor(alice, opts)
+			require.Nil(t, err)
+			require.Equal(t, len(txs), len(sigs))
+			require.LessOrEqual(t, len(txs), 3)
+			all = append(all, txs...)
+			if next == nil {
+				break
+			}
+			// the token survives encoding
+			opts.Cursor, err = ParseQueryCursor(next.String())
+			require.Nil(t, err)
+			require.Equal(t, next, opts.Cursor)
+		}
+		require.Equal(t, len(db.txs), len(all))
+		for i, tx := range all {
+			expected := db.txs[i]
+			if desc {
+				expected = db.txs[len(db.txs)-1-i]
+			}
+			require.Equal(t, expected.BlockNumber, tx.BlockNumber)
+			require.Equal(t, expected.TransactionIndex, tx.TransactionIndex)
+		}
+	}
+
+	// a page can end in the middle of a transaction's logs
+	logs, next, err := ctx.BasicQueryLogsWithCursor(contract, [][]common.Hash{{topic}},
+		QueryOptions{StartHeight: 3, EndHeight: 11, MaxResults: 4})
+	require.Nil(t, err)
+	require.Equal(t, 4, len(logs))
+	require.Equal(t, QueryCursor{Height: 3, TxIndex: 2, LogIndex: 8}, *next)
+	logs, next, err = ctx.BasicQueryLogsWithCursor(contract, [][]common.Hash{{topic}},
+		QueryOptions{StartHeight: 3, EndHeight: 11, MaxResults: 100, Cursor: next})
+	require.Nil(t, err)
+	require.Nil(t, next)
+	require.Equal(t, int(logIndex-8), len(logs))
+	for i, log := range logs {
+		require.Equal(t, uint(8+i), log.Index)
+	}
+
+	logs, next, err = ctx.BasicQueryLogsWithCursor(contract, [][]common.Hash{{topic}},
+		QueryOptions{StartHeight: 3, EndHeight: 11, Descending: true, MaxResults: 2})
+	require.Nil(t, err)
+	require.Equal(t, []uint{logIndex - 1, logIndex - 2}, []uint{logs[0].Index, logs[1].Index})
+	require.Equal(t, QueryCursor{Height: 10, TxIndex: 0, LogIndex: uint32(logIndex - 3)}, *next)
+	logs2, next2, err := ctx.QueryLogsWithCursor([]common.Address{contract}, [][]common.Hash{{topic}}, nil,
+		QueryOptions{StartHeight: 3, EndHeight: 11, Descending: true, MaxResults: 2})
+	require.Nil(t, err)
+	require.Equal(t, logs, logs2)
+	require.Equal(t, next, next2)
+
+	_, _, _, err = ctx.QueryTxBySrcWithCursor(alice, QueryOptions{StartHeight: 1, EndHeight: 11})
+	require.Equal(t, ErrInvalidMaxResults, err)
+	_, _, _, err = ctx.QueryTxBySrcWithCursor(alice, QueryOptions{StartHeight: 1, EndHeight: 11, MaxResults: 1,
+		Cursor: &QueryCursor{Height: 11}})
+	require.Equal(t, ErrInvalidCursor, err)
+	_, err = ParseQueryCursor("0x1234")
+	require.Equal(t, ErrInvalidCursor, err)
+	// a single block with too many entries can not be queried
+	db.maxCount = 4
+	_, _, _, err = ctx.QueryTxBySrcWithCursor(alice, QueryOptions{StartHeight: 1, EndHeight: 11, MaxResults: 100})
+	require.Equal(t, ErrTooManyEntries, err)
+}
+
+func TestQueryWindow(t *testing.T) {
+	alice := common.HexToAddress("0xa")
+	db := &queryDB{maxCount: 20}
+	// ten busy blocks followed by sparse ones
+	for h := int64(1); h <= 1000; h++ {
+		n := int64(0)
+		if h <= 10 {
+			n = 10
+		} else if h%100 == 0 {
+			n = 1
+		}
+		for i := int64(0); i < n; i++ {
+			db.txs = append(db.txs, &Transaction{BlockNumber: h, TransactionIndex: i, From: alice})
+		}
+	}
+	ctx := NewContext(nil, db)
+
+	// the window grows again after the busy blocks
+	txs, _, next, err := ctx.QueryTxBySrcWithCursor(alice, QueryOptions{StartHeight: 1, EndHeight: 1001, MaxResults: 1000})
+	require.Nil(t, err)
+	require.Nil(t, next)
+	require.Equal(t, len(db.txs), len(txs))
+	require.Less(t, db.calls, 30)
+
+	// the descending order stops reading once the page is full
+	db.fed = 0
+	txs, _, next, err = ctx.QueryTxBySrcWithCursor(alice, QueryOptions{StartHeight: 1, EndHeight: 11, Descending: true, MaxResults: 3})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(txs))
+	require.Equal(t, QueryCursor{Height: 10, TxIndex: 6}, *next)
+	require.Equal(t, 4, db.fed)
+
+	// the descending logs are read from the top in growing chunks, instead of all at once
+	contract := common.HexToAddress("0x1")
+	db = &queryDB{maxCount: 2000}
+	for h := int64(1); h <= 1000; h++ {
+		db.txs = append(db.txs, &Transaction{BlockNumber: h,
+			Logs: []Log{{Address: contract, BlockNumber: uint64(h)}}})
+	}
+	ctx = NewContext(nil, db)
+	logs, next, err := ctx.QueryLogsWithCursor([]common.Address{contract}, nil, nil,
+		QueryOptions{StartHeight: 1, EndHeight: 1001, Descending: true, MaxResults: 3})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(logs))
+	require.Equal(t, uint64(1000), logs[0].BlockNumber)
+	require.Equal(t, QueryCursor{Height: 997}, *next)
+	require.Less(t, db.fed, 10)
+}
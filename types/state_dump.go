@@ -0,0 +1,121 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	gethmath "github.com/ethereum/go-ethereum/common/math"
+	"github.com/smartbch/moeingads/store/rabbit"
+)
+
+// StoreScanner enumerates all the entries of the store under a RabbitStore, for example, moeingads.MoeingADS.
+// RabbitStore hashes the keys, so the entries can not be found by prefix unless all of them are scanned.
+type StoreScanner interface {
+	ScanAll(fn func(key, value []byte))
+}
+
+// GenesisAccount and GenesisAlloc have the same JSON format as the 'alloc' field of geth's genesis file
+type GenesisAccount struct {
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+	Balance *gethmath.HexOrDecimal256   `json:"balance"`
+	Nonce   gethmath.HexOrDecimal64     `json:"nonce,omitempty"`
+}
+
+type GenesisAlloc map[common.Address]GenesisAccount
+
+// scanByPrefix calls fn with the entries whose keys start with prefix, in the order of keys, until fn
+// returns true. The values are read through c.Rbt, so the changes and deletions which are not written back
+// yet are respected, but the entries newly created in c.Rbt are not visible to the scanner.
+func (c *Context) scanByPrefix(scanner StoreScanner, prefix []byte, fn func(key, value []byte) (stop bool)) {
+	var keys [][]byte
+	scanner.ScanAll(func(_, value []byte) {
+		cv := rabbit.BytesToCachedValue(value)
+		if cv == nil || cv.IsEmpty() || !bytes.HasPrefix(cv.GetKey(), prefix) {
+			return
+		}
+		keys = append(keys, append([]byte{}, cv.GetKey()...))
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	for _, key := range keys {
+		value := c.Rbt.Get(key)
+		if value == nil {
+			continue
+		}
+		if fn(key, value) {
+			return
+		}
+	}
+}
+
+func (c *Context) IterateAccounts(scanner StoreScanner, fn func(addr common.Address, acc *AccountInfo) (stop bool)) {
+	c.scanByPrefix(scanner, []byte{ACCOUNT_KEY}, func(key, value []byte) bool {
+		return fn(common.BytesToAddress(key[1:]), NewAccountInfo(value))
+	})
+}
+
+func (c *Context) IterateBytecodes(scanner StoreScanner, fn func(addr common.Address, code *BytecodeInfo) (stop bool)) {
+	c.scanByPrefix(scanner, []byte{BYTECODE_KEY}, func(key, value []byte) bool {
+		return fn(common.BytesToAddress(key[1:]), NewBytecodeInfo(value))
+	})
+}
+
+// IterateStorage calls fn with the storage slots of the contract whose account sequence is seq
+func (c *Context) IterateStorage(scanner StoreScanner, seq uint64, fn func(key string, value []byte) (stop bool)) {
+	prefix := make([]byte, 9)
+	prefix[0] = VALUE_KEY
+	binary.BigEndian.PutUint64(prefix[1:], seq)
+	c.scanByPrefix(scanner, prefix, func(key, value []byte) bool {
+		return fn(string(key[9:]), value)
+	})
+}
+
+// DumpState writes all the accounts, with their bytecodes and storage slots, as a JSON GenesisAlloc.
+// The storage slots whose sequence does not belong to a contract with bytecode, such as the ones of
+// the system contracts implemented in Go, are not included.
+func (c *Context) DumpState(scanner StoreScanner, w io.Writer) error {
+	alloc := make(GenesisAlloc)
+	c.IterateAccounts(scanner, func(addr common.Address, acc *AccountInfo) bool {
+		alloc[addr] = GenesisAccount{
+			Balance: (*gethmath.HexOrDecimal256)(acc.Balance().ToBig()),
+			Nonce:   gethmath.HexOrDecimal64(acc.Nonce()),
+		}
+		return false
+	})
+	seqToAddr := make(map[uint64]common.Address)
+	c.IterateBytecodes(scanner, func(addr common.Address, code *BytecodeInfo) bool {
+		genAcc, ok := alloc[addr]
+		if !ok {
+			genAcc.Balance = gethmath.NewHexOrDecimal256(0)
+		}
+		genAcc.Code = append([]byte{}, code.BytecodeSlice()...)
+		alloc[addr] = genAcc
+		if acc := c.GetAccount(addr); acc != nil {
+			seqToAddr[acc.Sequence()] = addr
+		}
+		return false
+	})
+	c.scanByPrefix(scanner, []byte{VALUE_KEY}, func(key, value []byte) bool {
+		addr, ok := seqToAddr[binary.BigEndian.Uint64(key[1:9])]
+		if !ok || len(key) != 9+32 {
+			return false
+		}
+		genAcc := alloc[addr]
+		if genAcc.Storage == nil {
+			genAcc.Storage = make(map[common.Hash]common.Hash)
+		}
+		genAcc.Storage[common.BytesToHash(key[9:])] = common.BytesToHash(value)
+		alloc[addr] = genAcc
+		return false
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(alloc)
+}
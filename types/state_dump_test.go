@@ -0,0 +1,167 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+	"github.com/smartbch/moeingads/store/rabbit"
+	storetypes "github.com/smartbch/moeingads/store/types"
+	"github.com/stretchr/testify/require"
+)
+
+// scannableStore is an in-memory BaseStoreI which can be scanned
+type scannableStore struct {
+	m map[string][]byte
+}
+
+func (s *scannableStore) RLock()                                        {}
+func (s *scannableStore) RUnlock()                                      {}
+func (s *scannableStore) Get(key []byte) []byte                         { return s.m[string(key)] }
+func (s *scannableStore) GetAtHeight(key []byte, height uint64) []byte  { return s.m[string(key)] }
+func (s *scannableStore) PrepareForUpdate(key []byte)                   {}
+func (s *scannableStore) PrepareForDeletion(key []byte)                 {}
+func (s *scannableStore) ActiveCount() int                              { return len(s.m) }
+func (s *scannableStore) Set(key, value []byte)                         { s.m[string(key)] = append([]byte{}, value...) }
+func (s *scannableStore) Delete(key []byte)                             { delete(s.m, string(key)) }
+func (s *scannableStore) Update(updater func(db storetypes.SetDeleter)) { updater(s) }
+
+func (s *scannableStore) ScanAll(fn func(key, value []byte)) {
+	for k, v := range s.m {
+		fn([]byte(k), v)
+	}
+}
+
+func newContextOnStore(s *scannableStore) *Context {
+	rbt := rabbit.NewRabbitStore(s)
+	return NewContext(&rbt, nil)
+}
+
+func TestDumpState(t *testing.T) {
+	s := &scannableStore{m: make(map[string][]byte)}
+	eoa := common.HexToAddress("0x1")
+	contract := common.HexToAddress("0x2")
+	slot1 := string(common.BigToHash(common.Big1).Bytes())
+	slot2 := string(common.BigToHash(common.Big2).Bytes())
+
+	ctx := newContextOnStore(s)
+	acc := ZeroAccountInfo()
+	acc.UpdateBalance(uint256.NewInt(1000))
+	acc.UpdateNonce(3)
+	ctx.SetAccount(eoa, acc)
+	acc = ZeroAccountInfo()
+	acc.UpdateSequence(100)
+	ctx.SetAccount(contract, acc)
+	ctx.Rbt.Set(GetBytecodeKey(contract), append(make([]byte, 33), 0x60, 0x00))
+	ctx.SetStorageAt(100, slot1, []byte{0x11})
+	ctx.SetStorageAt(100, slot2, []byte{0x22})
+	ctx.SetStorageAt(101, slot1, []byte{0x33}) // no contract owns it
+	ctx.Close(true)
+
+	ctx = newContextOnStore(s)
+	defer ctx.Close(false)
+	var addrs []common.Address
+	ctx.IterateAccounts(s, func(addr common.Address, acc *AccountInfo) bool {
+		addrs = append(addrs, addr)
+		return false
+	})
+	require.Equal(t, []common.Address{eoa, contract}, addrs)
+	addrs = nil
+	ctx.IterateAccounts(s, func(addr common.Address, acc *AccountInfo) bool {
+		addrs = append(addrs, addr)
+		return true
+	})
+	require.Equal(t, []common.Address{eoa}, addrs)
+	ctx.IterateBytecodes(s, func(addr common.Address, code *BytecodeInfo) bool {
+		require.Equal(t, contract, addr)
+		require.Equal(t, []byte{0x60, 0x00}, code.BytecodeSlice())
+		return false
+	})
+
+	// the deletions not written back yet are respected
+	ctx.DeleteStorageAt(100, slot2)
+	var keys []string
+	ctx.IterateStorage(s, 100, func(key string, value []byte) bool {
+		keys = append(keys, key)
+		require.Equal(t, []byte{0x11}, value)
+		return false
+	})
+	require.Equal(t, []string{slot1}, keys)
+
+	var buf bytes.Buffer
+	require.Nil(t, ctx.DumpState(s, &buf))
+	expected := `{
+  "0x0000000000000000000000000000000000000001": {"balance": "0x3e8", "nonce": "0x3"},
+  "0x0000000000000000000000000000000000000002": {
+    "code": "0x6000",
+    "storage": {"0x0000000000000000000000000000000000000000000000000000000000000001": "0x0000000000000000000000000000000000000000000000000000000000000011"},
+    "balance": "0x0"
+  }
+}`
+	require.JSONEq(t, expected, buf.String())
+	var alloc GenesisAlloc
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &alloc))
+	require.Equal(t, uint64(3), uint64(alloc[eoa].Nonce))
+}
+
+func TestGenesisAllocRoundTrip(t *testing.T) {
+	s := &scannableStore{m: make(map[string][]byte)}
+	ctx := newContextOnStore(s)
+	err := ctx.LoadGenesisAlloc(bytes.NewBufferString(`{
+  "0x0100000000000000000000000000000000000001": {"balance": "1000", "nonce": "0x1"},
+  "0x0100000000000000000000000000000000000002": {"balance": "0x10", "code": "0x6000", "storage": {
+    "0x0000000000000000000000000000000000000000000000000000000000000001": "0x0000000000000000000000000000000000000000000000000000000000000022",
+    "0x0000000000000000000000000000000000000000000000000000000000000002": "0x0000000000000000000000000000000000000000000000000000000000000000"}},
+  "0x0100000000000000000000000000000000000003": {"balance": "0x0", "code": "0x6001"}
+}`))
+	require.Nil(t, err)
+	ctx.Close(true)
+
+	ctx = newContextOnStore(s)
+	acc := ctx.GetAccount(common.HexToAddress("0x0100000000000000000000000000000000000001"))
+	require.Equal(t, uint64(1000), acc.Balance().Uint64())
+	require.Equal(t, uint64(1), acc.Nonce())
+	require.Equal(t, ^uint64(0), acc.Sequence())
+	// the sequences are assigned like the C host does for new contracts
+	seq := ctx.GetAccount(common.HexToAddress("0x0100000000000000000000000000000000000002")).Sequence()
+	require.Equal(t, uint64(1<<8|1), seq)
+	require.Equal(t, uint64(2<<8|1), ctx.GetAccount(common.HexToAddress("0x0100000000000000000000000000000000000003")).Sequence())
+	require.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 2}, ctx.Rbt.Get(GetCreationCounterKey(1)))
+	// the index is not written before SeqIndexForkBlock, and it is backfilled at the fork
+	_, ok := ctx.GetAddressBySequence(seq)
+	require.False(t, ok)
+	require.Equal(t, 2, ctx.BackfillSequenceIndex(s))
+	addr, ok := ctx.GetAddressBySequence(seq)
+	require.True(t, ok)
+	require.Equal(t, common.HexToAddress("0x0100000000000000000000000000000000000002"), addr)
+	code := ctx.GetCode(common.HexToAddress("0x0100000000000000000000000000000000000002"))
+	require.Equal(t, []byte{0x60, 0x00}, code.BytecodeSlice())
+	require.Equal(t, crypto.Keccak256([]byte{0x60, 0x00}), code.CodeHashSlice())
+	require.Nil(t, ctx.GetStorageAt(seq, string(common.BigToHash(common.Big2).Bytes())))
+
+	var dump1 bytes.Buffer
+	require.Nil(t, ctx.DumpState(s, &dump1))
+	ctx.Close(false)
+	s2 := &scannableStore{m: make(map[string][]byte)}
+	ctx = newContextOnStore(s2)
+	ctx.SetSeqIndexForkBlock(0)
+	require.Nil(t, ctx.LoadGenesisAlloc(bytes.NewReader(dump1.Bytes())))
+	ctx.Close(true)
+	ctx = newContextOnStore(s2)
+	defer ctx.Close(false)
+	addr, ok = ctx.GetAddressBySequence(seq)
+	require.True(t, ok)
+	require.Equal(t, common.HexToAddress("0x0100000000000000000000000000000000000002"), addr)
+	var dump2 bytes.Buffer
+	require.Nil(t, ctx.DumpState(s2, &dump2))
+	require.Equal(t, dump1.String(), dump2.String())
+
+	err = ctx.LoadGenesisAlloc(bytes.NewBufferString(`{"0x0000000000000000000000000000000000000001": {"balance": "0x0", "storage": {
+    "0x0000000000000000000000000000000000000000000000000000000000000001": "0x0000000000000000000000000000000000000000000000000000000000000022"}}}`))
+	require.NotNil(t, err)
+	err = ctx.LoadGenesisAlloc(bytes.NewBufferString(`{"0x0000000000000000000000000000000000000001": {"balance": "-1"}}`))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,87 @@
+package types
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/holiman/uint256"
+)
+
+// LoadGenesisAlloc reads a JSON GenesisAlloc, the 'alloc' field of geth's genesis file, and writes it to c
+func (c *Context) LoadGenesisAlloc(r io.Reader) error {
+	var alloc GenesisAlloc
+	if err := json.NewDecoder(r).Decode(&alloc); err != nil {
+		return err
+	}
+	return c.ImportGenesisAlloc(alloc)
+}
+
+// ImportGenesisAlloc writes the accounts in alloc to c, overwriting the existing ones at the same addresses.
+// Just like what the C host does in set_bytecode, an account with bytecode gets a new sequence made of its
+// address's first byte and the increased creation counter of this byte, while the other accounts get a
+// sequence of all ones. The accounts are imported in the order of addresses, so the result is deterministic.
+func (c *Context) ImportGenesisAlloc(alloc GenesisAlloc) error {
+	addrs := make([]common.Address, 0, len(alloc))
+	for addr, genAcc := range alloc {
+		if len(genAcc.Code) == 0 && len(genAcc.Storage) != 0 {
+			return fmt.Errorf("account %s has storage but no code", addr)
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return string(addrs[i][:]) < string(addrs[j][:])
+	})
+	for _, addr := range addrs {
+		genAcc := alloc[addr]
+		acc := ZeroAccountInfo()
+		if genAcc.Balance != nil {
+			b := (*big.Int)(genAcc.Balance)
+			balance, overflow := uint256.FromBig(b)
+			if overflow || b.Sign() < 0 {
+				return fmt.Errorf("invalid balance of account %s", addr)
+			}
+			acc.UpdateBalance(balance)
+		}
+		acc.UpdateNonce(uint64(genAcc.Nonce))
+		if len(genAcc.Code) == 0 {
+			acc.UpdateSequence(math.MaxUint64)
+			c.SetAccount(addr, acc)
+			continue
+		}
+		acc.UpdateSequence(c.incrCreationCounter(addr[0])<<8 | uint64(addr[0]))
+		c.SetAccount(addr, acc)
+		if c.IsSeqIndexFork() {
+			c.SetAddressOfSequence(acc.Sequence(), addr)
+		}
+		bz := make([]byte, 33, 33+len(genAcc.Code))
+		bz[0] = 0 // version byte is zero
+		copy(bz[1:33], crypto.Keccak256(genAcc.Code))
+		c.set(GetBytecodeKey(addr), append(bz, genAcc.Code...))
+		for key, value := range genAcc.Storage {
+			if value != (common.Hash{}) {
+				c.SetStorageAt(acc.Sequence(), string(key[:]), value.Bytes())
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Context) incrCreationCounter(lsb uint8) uint64 {
+	k := GetCreationCounterKey(lsb)
+	counter := uint64(0)
+	if v := c.Rbt.Get(k); v != nil {
+		counter = binary.BigEndian.Uint64(v)
+	}
+	counter++
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], counter)
+	c.set(k, buf[:])
+	return counter
+}
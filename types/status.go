@@ -0,0 +1,156 @@
+package types
+
+import "errors"
+
+// Status is the outcome of a transaction. It covers the status codes returned by the EVM (which are
+// the same as evmc_status_code), the reasons why a transaction is not executed at runtime and the
+// reasons why a transaction is rejected in Prepare. The numeric codes are stable because they are
+// stored in the receipts. Each condition has only one code, no matter whether it is found in Prepare,
+// in CheckTx or at runtime, and ErrorToStatus maps the sentinel errors to their codes.
+type Status int
+
+// The status codes returned by the EVM, see evmc_status_code in evmc.h
+const (
+	StatusSuccess                   Status = 0
+	StatusFailure                   Status = 1
+	StatusRevert                    Status = 2
+	StatusOutOfGas                  Status = 3
+	StatusInvalidInstruction        Status = 4
+	StatusUndefinedInstruction      Status = 5
+	StatusStackOverflow             Status = 6
+	StatusStackUnderflow            Status = 7
+	StatusBadJumpDestination        Status = 8
+	StatusInvalidMemoryAccess       Status = 9
+	StatusCallDepthExceeded         Status = 10
+	StatusStaticModeViolation       Status = 11
+	StatusPrecompileFailure         Status = 12
+	StatusContractValidationFailure Status = 13
+	StatusArgumentOutOfRange        Status = 14
+	StatusWasmUnreachable           Status = 15
+	StatusWasmTrap                  Status = 16
+	StatusInsufficientBalance       Status = 17
+	StatusInternalError             Status = -1
+	StatusRejected                  Status = -2
+	StatusOutOfMemory               Status = -3
+)
+
+// The reasons why a transaction in the standby queue is not executed
+const (
+	StatusIgnoreTooOldTx  Status = 1024
+	StatusFailedToCommit  Status = 1025
+	StatusAccountNotExist Status = 1026
+	StatusTxNonceTooSmall Status = 1027
+	StatusTxNonceTooLarge Status = 1029
+)
+
+// The reasons why a transaction is rejected in Prepare and never enters the standby queue. Prepare also
+// rejects a transaction with StatusAccountNotExist, StatusTxNonceTooSmall or StatusTxNonceTooLarge.
+const (
+	StatusInvalidSignature Status = 1100
+	StatusInvalidGasPrice  Status = 1101
+	StatusInvalidGasLimit  Status = 1102
+	StatusNotEnoughGasFee  Status = 1105
+)
+
+// Kept for compatibility, new code should use the Status constants
+const (
+	IGNORE_TOO_OLD_TX  = int(StatusIgnoreTooOldTx)
+	FAILED_TO_COMMIT   = int(StatusFailedToCommit)
+	ACCOUNT_NOT_EXIST  = int(StatusAccountNotExist)
+	TX_NONCE_TOO_SMALL = int(StatusTxNonceTooSmall)
+	TX_NONCE_TOO_LARGE = int(StatusTxNonceTooLarge)
+)
+
+var statusToStr = map[Status]string{
+	StatusSuccess:                   "success",
+	StatusFailure:                   "failure",
+	StatusRevert:                    "revert",
+	StatusOutOfGas:                  "out-of-gas",
+	StatusInvalidInstruction:        "invalid-instruction",
+	StatusUndefinedInstruction:      "undefined-instruction",
+	StatusStackOverflow:             "stack-overflow",
+	StatusStackUnderflow:            "stack-underflow",
+	StatusBadJumpDestination:        "bad-jump-destination",
+	StatusInvalidMemoryAccess:       "invalid-memory-access",
+	StatusCallDepthExceeded:         "call-depth-exceeded",
+	StatusStaticModeViolation:       "static-mode-violation",
+	StatusPrecompileFailure:         "precompile-failure",
+	StatusContractValidationFailure: "contract-validation-failure",
+	StatusArgumentOutOfRange:        "argument-out-of-range",
+	StatusWasmUnreachable:           "wasm-unreachable-instruction",
+	StatusWasmTrap:                  "wasm-trap",
+	StatusInsufficientBalance:       "insufficient-balance",
+	StatusInternalError:             "internal-error",
+	StatusRejected:                  "rejected",
+	StatusOutOfMemory:               "out-of-memory",
+
+	StatusIgnoreTooOldTx:  "too-old-and-ignored",
+	StatusFailedToCommit:  "failed-to-commit",
+	StatusAccountNotExist: "account-not-exist",
+	StatusTxNonceTooSmall: "nonce-too-small",
+	StatusTxNonceTooLarge: "nonce-too-large",
+
+	// these strings were used as StatusStr of receipts before Status was introduced
+	StatusInvalidSignature: "invalid signature",
+	StatusInvalidGasPrice:  "invalid gas price",
+	StatusInvalidGasLimit:  "invalid gas limit",
+	StatusNotEnoughGasFee:  "not enough balance to pay gasfee",
+}
+
+// the strings used as StatusStr of the receipts of the transactions rejected in Prepare before Status was
+// introduced, which are different from the strings of the same conditions at runtime
+var prepareStatusToStr = map[Status]string{
+	StatusAccountNotExist: "non-existent account",
+	StatusTxNonceTooSmall: "incorrect nonce",
+	StatusTxNonceTooLarge: "incorrect nonce",
+}
+
+// the sentinel errors in the order they are checked by Prepare, so an error which wraps more than one of
+// them always gets the Status of the first one
+var errToStatus = []struct {
+	err    error
+	status Status
+}{
+	{ErrInvalidSignature, StatusInvalidSignature},
+	{ErrBadGasPrice, StatusInvalidGasPrice},
+	{ErrBadGasLimit, StatusInvalidGasLimit},
+	{ErrAccountNotExist, StatusAccountNotExist},
+	{ErrNonceTooSmall, StatusTxNonceTooSmall},
+	{ErrNonceTooLarge, StatusTxNonceTooLarge},
+	{ErrNotEnoughGasFee, StatusNotEnoughGasFee},
+	{ErrInsufficientBalance, StatusInsufficientBalance},
+}
+
+// ErrorToStatus returns the Status of the condition reported by err, which is one of the sentinel errors
+// or wraps one of them
+func ErrorToStatus(err error) (Status, bool) {
+	for _, e := range errToStatus {
+		if errors.Is(err, e.err) {
+			return e.status, true
+		}
+	}
+	return StatusSuccess, false
+}
+
+func (s Status) String() string {
+	if str, ok := statusToStr[s]; ok {
+		return str
+	}
+	return "unknown"
+}
+
+// PrepareStatusStr returns the StatusStr of the receipt of a transaction rejected in Prepare because of s
+func (s Status) PrepareStatusStr() string {
+	if str, ok := prepareStatusToStr[s]; ok {
+		return str
+	}
+	return s.String()
+}
+
+func (s Status) Error() string {
+	return s.String()
+}
+
+func (s Status) IsFailure() bool {
+	return s != StatusSuccess
+}